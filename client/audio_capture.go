@@ -1,23 +1,32 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"robot-head/shared"
+	"sync/atomic"
 	"time"
 
 	"github.com/gordonklaus/portaudio"
-	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func recordAudio(duration time.Duration) ([]byte, error) {
+// voiceLevel is the RMS level above which we take the microphone to be
+// hearing someone speak.
+const voiceLevel = 0.02
+
+// recordAudio records one chunk of audio. onVoice is called, possibly more
+// than once, when the level suggests someone is speaking.
+func recordAudio(duration time.Duration, onVoice func()) ([]byte, error) {
 	err := portaudio.Initialize()
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize PortAudio: %v", err)
 	}
 	defer portaudio.Terminate()
 
-	sampleRate := 16000
+	sampleRate := captureSampleRate
 	channels := 1
 	framesPerBuffer := 1024
 
@@ -34,6 +43,10 @@ func recordAudio(duration time.Duration) ([]byte, error) {
 	inputParams.FramesPerBuffer = framesPerBuffer
 
 	stream, err := portaudio.OpenStream(inputParams, func(in []float32) {
+		if onVoice != nil && level(in) > voiceLevel {
+			onVoice()
+		}
+
 		// Prevent buffer overflow
 		remainingSpace := len(audioBuffer) - bufferIndex
 		if remainingSpace > 0 {
@@ -76,35 +89,55 @@ func recordAudio(duration time.Duration) ([]byte, error) {
 	return audioBytes, nil
 }
 
-func sendVoiceMessage(conn *websocket.Conn, audioData []byte) error {
-	voiceData := shared.AudioData{
-		AudioData: audioData,
-		MimeType:  "audio/pcm",
+// level returns the RMS level of the samples.
+func level(samples []float32) float64 {
+	if len(samples) == 0 {
+		return 0
 	}
-
-	voiceMessage := shared.Message{
-		Type:      shared.MessageTypeAudio,
-		Timestamp: time.Now().Unix(),
-		Data:      voiceData,
+	sum := 0.0
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
 	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
 
-	return conn.WriteJSON(voiceMessage)
+// sendVoiceMessage sends a recorded chunk as part of ctx's trace. heard
+// is whether anyone spoke in it.
+func sendVoiceMessage(ctx context.Context, turns *turnSender, audioData []byte, heard bool) error {
+	msg := createAudioMessage(audioData)
+	msg.TraceParent = shared.InjectTrace(ctx)
+	return turns.send(msg, heard)
 }
 
-func sendVoiceMessages(conn *websocket.Conn) {
+func sendVoiceMessages(turns *turnSender) {
 	fmt.Println("Say something")
 
 	for {
-		audioData, err := recordAudio(3 * time.Second)
+		// Each chunk starts a trace the server's turn joins
+		ctx, span := tracer.Start(context.Background(), "capture")
+
+		// onVoice runs on PortAudio's callback thread
+		var heard atomic.Bool
+		audioData, err := recordAudio(cfg.ChunkLength, func() {
+			if !heard.Swap(true) && visualState() == shared.StateIdle {
+				setState(shared.StateListening)
+			}
+		})
 		if err != nil {
-			log.Printf("Failed to record audio: %v\n", err)
+			shared.EndSpan(span, err)
+			slog.Error("Failed to record audio", "error", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
+		if !heard.Load() && visualState() == shared.StateListening {
+			setState(shared.StateIdle)
+		}
 
-		err = sendVoiceMessage(conn, audioData)
+		span.SetAttributes(attribute.Int("audio.bytes", len(audioData)), attribute.Bool("voice.heard", heard.Load()))
+		err = sendVoiceMessage(ctx, turns, audioData, heard.Load())
+		shared.EndSpan(span, err)
 		if err != nil {
-			log.Println("Failed to send voice message:", err)
+			slog.Error("Failed to send voice message", "error", err)
 			break
 		}
 	}
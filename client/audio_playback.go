@@ -2,30 +2,108 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"time"
 
+	"robot-head/shared"
+
 	"github.com/gopxl/beep"
 	"github.com/gopxl/beep/mp3"
 	"github.com/gopxl/beep/speaker"
 )
 
-func playAudio(audioData []byte) error {
-	// Initialize speaker
-	sr := beep.SampleRate(44100)
-	speaker.Init(sr, sr.N(time.Second))
+// handleAudio plays or saves a spoken reply, depending on audio_output.
+// ctx carries the turn's trace, which the playback span joins.
+func handleAudio(ctx context.Context, audioData shared.AudioData) {
+	switch {
+	case cfg.AudioOutput == "save":
+		path, err := saveAudio(cfg.AudioDir, audioData)
+		if err != nil {
+			slog.Error("Failed to save audio", "error", err)
+			fmt.Printf("\nRobot: %s\n", audioData.Text)
+			return
+		}
+		fmt.Printf("\nRobot: %s\n(saved to %s)\n", audioData.Text, path)
+	case cfg.AudioOutput == "none":
+		fmt.Printf("\nRobot: %s\n", audioData.Text)
+	case audioData.MimeType != "" && audioData.MimeType != "audio/mpeg":
+		fmt.Printf("\nRobot: %s\n(can't play %s audio)\n", audioData.Text, audioData.MimeType)
+	default:
+		fmt.Printf("\nPlaying audio for: %s\n", audioData.Text)
+		showVisemes(audioData.Visemes)
+		go func() {
+			_, span := tracer.Start(ctx, "playback")
+			err := playAudio(audioData.AudioData)
+			shared.EndSpan(span, err)
+			if err != nil {
+				slog.Error("Failed to play audio", "error", err)
+			}
+		}()
+	}
+}
+
+// audioExtensions names saved replies after their MIME type.
+var audioExtensions = map[string]string{
+	"audio/mpeg":  ".mp3",
+	"audio/pcm":   ".pcm",
+	"audio/basic": ".ulaw",
+	"audio/opus":  ".opus",
+}
+
+// saveAudio writes a reply into dir and returns the file's path.
+func saveAudio(dir string, audioData shared.AudioData) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	ext, ok := audioExtensions[audioData.MimeType]
+	if !ok {
+		ext = ".mp3"
+	}
+	path := filepath.Join(dir, fmt.Sprintf("reply-%s%s", time.Now().Format("20060102-150405.000"), ext))
+	return path, os.WriteFile(path, audioData.AudioData, 0o644)
+}
 
+// playbackSampleRate is the rate the speaker runs at; everything is
+// resampled to it.
+const playbackSampleRate = beep.SampleRate(44100)
+
+func playAudio(audioData []byte) error {
 	// create a reader from the MP3 data
 	reader := bytes.NewReader(audioData)
-	streamer, format, err := mp3.Decode(io.NopCloser(reader))
+	return playAudioStream(io.NopCloser(reader))
+}
+
+// playAudioStream plays MP3 audio from rc, starting as soon as the first
+// frames can be decoded. It returns once rc is drained and playback ends.
+func playAudioStream(rc io.ReadCloser) error {
+	// Initialize speaker. The visualizer needs a short buffer so the
+	// frames it draws stay in step with what's actually coming out.
+	sr := playbackSampleRate
+	bufferSize := time.Second
+	if visual != nil {
+		bufferSize = time.Second / 10
+	}
+	speaker.Init(sr, sr.N(bufferSize))
+
+	setState(shared.StateSpeaking)
+	defer setState(shared.StateIdle)
+
+	streamer, format, err := mp3.Decode(rc)
 	if err != nil {
 		return fmt.Errorf("failed to decode MP3: %v", err)
 	}
 	defer streamer.Close()
 
 	// Resample if necessary
-	resampled := beep.Resample(4, format.SampleRate, sr, streamer)
+	var resampled beep.Streamer = beep.Resample(4, format.SampleRate, sr, streamer)
+	if visual != nil {
+		resampled = &visualTap{Streamer: resampled, v: visual}
+	}
 
 	done := make(chan bool)
 	speaker.Play(beep.Seq(resampled, beep.Callback(func() {
@@ -34,4 +112,4 @@ func playAudio(audioData []byte) error {
 
 	<-done
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"robot-head/shared"
+	"sync"
+)
+
+// audioStream buffers the chunks of one streamed reply so the decoder can
+// read them as they arrive. Writes never block, so a slow speaker doesn't
+// hold up reading the WebSocket.
+type audioStream struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	data   []byte
+	closed bool
+}
+
+func newAudioStream() *audioStream {
+	s := &audioStream{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Write appends a chunk of audio.
+func (s *audioStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	s.data = append(s.data, p...)
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+// Read blocks until audio is available or the stream has ended.
+func (s *audioStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.data) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+// Close marks the end of the stream. Buffered audio can still be read.
+func (s *audioStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
+
+// streamReceiver routes audio_chunk messages to a player per stream.
+type streamReceiver struct {
+	streams map[string]*audioStream
+	// play is called in its own goroutine for each new stream
+	play func(io.ReadCloser) error
+}
+
+func newStreamReceiver(play func(io.ReadCloser) error) *streamReceiver {
+	return &streamReceiver{
+		streams: make(map[string]*audioStream),
+		play:    play,
+	}
+}
+
+// handle feeds one chunk to its stream, starting playback on the first.
+// ctx carries the turn's trace, which the playback span joins.
+func (r *streamReceiver) handle(ctx context.Context, chunk shared.AudioChunk) {
+	stream, ok := r.streams[chunk.StreamID]
+	if !ok {
+		if chunk.MimeType != "" && chunk.MimeType != "audio/mpeg" {
+			fmt.Printf("\nRobot: %s\n(can't play %s audio)\n", chunk.Text, chunk.MimeType)
+			return
+		}
+		stream = newAudioStream()
+		r.streams[chunk.StreamID] = stream
+
+		fmt.Printf("\nPlaying audio for: %s\n", chunk.Text)
+		go func() {
+			_, span := tracer.Start(ctx, "playback")
+			err := r.play(stream)
+			shared.EndSpan(span, err)
+			if err != nil {
+				slog.Error("Failed to play audio", "error", err)
+			}
+		}()
+	}
+
+	if len(chunk.AudioData) > 0 {
+		stream.Write(chunk.AudioData)
+	}
+	if chunk.Final {
+		stream.Close()
+		delete(r.streams, chunk.StreamID)
+	}
+}
+
+// closeAll ends every open stream, e.g. when the connection drops.
+func (r *streamReceiver) closeAll() {
+	for id, stream := range r.streams {
+		stream.Close()
+		delete(r.streams, id)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"robot-head/shared"
+	"testing"
+	"time"
+)
+
+func TestAudioStreamReadsWhatWasWritten(t *testing.T) {
+	stream := newAudioStream()
+	stream.Write([]byte("abc"))
+	stream.Write([]byte("def"))
+	stream.Close()
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("Failed to read stream: %v", err)
+	}
+	if string(data) != "abcdef" {
+		t.Errorf("Expected abcdef, got %q", data)
+	}
+}
+
+func TestAudioStreamReadBlocksUntilData(t *testing.T) {
+	stream := newAudioStream()
+	got := make(chan string)
+	go func() {
+		buf := make([]byte, 8)
+		n, _ := stream.Read(buf)
+		got <- string(buf[:n])
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("Read returned before any data was written")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	stream.Write([]byte("hi"))
+	if data := <-got; data != "hi" {
+		t.Errorf("Expected hi, got %q", data)
+	}
+}
+
+func TestAudioStreamWriteAfterClose(t *testing.T) {
+	stream := newAudioStream()
+	stream.Close()
+	if _, err := stream.Write([]byte("late")); err == nil {
+		t.Error("Expected an error writing to a closed stream")
+	}
+}
+
+func TestStreamReceiverPlaysChunksInOrder(t *testing.T) {
+	played := make(chan string, 1)
+	receiver := newStreamReceiver(func(rc io.ReadCloser) error {
+		data, err := io.ReadAll(rc)
+		played <- string(data)
+		return err
+	})
+
+	receiver.handle(context.Background(), shared.AudioChunk{StreamID: "s1", Seq: 0, Text: "hello", AudioData: []byte("one,"), MimeType: "audio/mpeg"})
+	receiver.handle(context.Background(), shared.AudioChunk{StreamID: "s1", Seq: 1, AudioData: []byte("two"), MimeType: "audio/mpeg"})
+	receiver.handle(context.Background(), shared.AudioChunk{StreamID: "s1", Seq: 2, MimeType: "audio/mpeg", Final: true})
+
+	select {
+	case data := <-played:
+		if data != "one,two" {
+			t.Errorf("Expected one,two, got %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stream was never played to the end")
+	}
+	if len(receiver.streams) != 0 {
+		t.Error("Finished stream should be forgotten")
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"robot-head/shared"
+)
+
+// Config holds every client setting. See shared/config.go for how the
+// file, environment and flags are layered.
+type Config struct {
+	ServerURL      string        `yaml:"server_url"`
+	SessionID      string        `yaml:"session_id"`
+	Persona        string        `yaml:"persona"`
+	VoiceID        string        `yaml:"voice_id"`
+	ListVoices     bool          `yaml:"list_voices"`
+	ChunkLength    time.Duration `yaml:"chunk_length"`
+	ConnectRetries int           `yaml:"connect_retries"`
+	// Token is this device's pre-shared token, for servers with auth on.
+	Token string `yaml:"token"`
+	// TLSCAFile trusts a private CA for wss://, and TLSCertFile and
+	// TLSKeyFile are the client certificate for servers that want one.
+	TLSCAFile   string `yaml:"tls_ca_file"`
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+	// Record asks the server to keep this session's turns for debugging.
+	Record bool `yaml:"record"`
+	// Mode is "voice" to talk through the microphone, "text" to type or
+	// "replay" to play recorded WAV files and check the replies.
+	Mode string `yaml:"mode"`
+	// AudioOutput is what happens to spoken replies: "play", "save" them
+	// to AudioDir, or "none" to ask the server for text only.
+	AudioOutput string `yaml:"audio_output"`
+	AudioDir    string `yaml:"audio_dir"`
+	// ErrorSound is an MP3 played when a turn fails and the server didn't
+	// send the error spoken.
+	ErrorSound string `yaml:"error_sound"`
+	// RetryErrors sends a failed turn again once when the server says it
+	// might work.
+	RetryErrors bool `yaml:"retry_errors"`
+	// LogLevel is debug, info, warn or error; LogFormat is text or json.
+	LogLevel  string `yaml:"log_level"`
+	LogFormat string `yaml:"log_format"`
+
+	// ReplayPath is a directory of WAV files or a YAML replay script.
+	ReplayPath     string        `yaml:"replay_path"`
+	ReplayOut      string        `yaml:"replay_out"`
+	ReplayRealtime bool          `yaml:"replay_realtime"`
+	ReplayTimeout  time.Duration `yaml:"replay_timeout"`
+
+	// Visualizer is "none", "terminal", "png" or "device".
+	Visualizer      string `yaml:"visualizer"`
+	VisualizerStyle string `yaml:"visualizer_style"`
+	VisualizerFPS   int    `yaml:"visualizer_fps"`
+	FrameDir        string `yaml:"frame_dir"`
+	MatrixWidth     int    `yaml:"matrix_width"`
+	MatrixHeight    int    `yaml:"matrix_height"`
+	// AnimationsFile holds the idle, listening, thinking... animations.
+	AnimationsFile string `yaml:"animations_file"`
+
+	// LED hardware, used when Visualizer is "device".
+	LEDDevice     string  `yaml:"led_device"`
+	LEDProtocol   string  `yaml:"led_protocol"`
+	LEDBaud       int     `yaml:"led_baud"`
+	LEDBrightness float64 `yaml:"led_brightness"`
+	LEDGamma      float64 `yaml:"led_gamma"`
+	LEDRotate     int     `yaml:"led_rotate"`
+	LEDMirrorX    bool    `yaml:"led_mirror_x"`
+	LEDMirrorY    bool    `yaml:"led_mirror_y"`
+	LEDSerpentine bool    `yaml:"led_serpentine"`
+
+	Tracing shared.TracingConfig `yaml:"tracing"`
+}
+
+// cfg is the active configuration, defaults until main loads the real one.
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		ServerURL:      "ws://localhost:9001/ws",
+		ChunkLength:    3 * time.Second,
+		ConnectRetries: 5,
+		Mode:           "voice",
+		AudioOutput:    "play",
+		AudioDir:       "./replies",
+		RetryErrors:    true,
+		LogLevel:       "info",
+		LogFormat:      "text",
+
+		ReplayOut:      "./replay-results",
+		ReplayRealtime: true,
+		ReplayTimeout:  time.Minute,
+
+		Visualizer:      "none",
+		VisualizerStyle: "spectrum",
+		VisualizerFPS:   30,
+		FrameDir:        "./frames",
+		MatrixWidth:     16,
+		MatrixHeight:    16,
+		AnimationsFile:  "./animations.yaml",
+
+		LEDDevice:     "/dev/ttyUSB0",
+		LEDProtocol:   "serial",
+		LEDBaud:       115200,
+		LEDBrightness: 0.5,
+		LEDGamma:      2.2,
+
+		Tracing: shared.DefaultTracingConfig(),
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// applyEnv overrides settings from environment variables.
+func (c *Config) applyEnv() error {
+	c.ServerURL = getEnv("ROBOT_SERVER_URL", c.ServerURL)
+	c.Token = getEnv("ROBOT_TOKEN", c.Token)
+	c.TLSCAFile = getEnv("ROBOT_TLS_CA_FILE", c.TLSCAFile)
+	c.TLSCertFile = getEnv("ROBOT_TLS_CERT_FILE", c.TLSCertFile)
+	c.TLSKeyFile = getEnv("ROBOT_TLS_KEY_FILE", c.TLSKeyFile)
+	c.SessionID = getEnv("ROBOT_SESSION_ID", c.SessionID)
+	c.Persona = getEnv("ROBOT_PERSONA", c.Persona)
+	c.VoiceID = getEnv("ROBOT_VOICE_ID", c.VoiceID)
+	c.Mode = getEnv("ROBOT_MODE", c.Mode)
+	c.AudioOutput = getEnv("ROBOT_AUDIO_OUTPUT", c.AudioOutput)
+	c.ErrorSound = getEnv("ROBOT_ERROR_SOUND", c.ErrorSound)
+	c.LogLevel = getEnv("ROBOT_LOG_LEVEL", c.LogLevel)
+	c.LogFormat = getEnv("ROBOT_LOG_FORMAT", c.LogFormat)
+	c.ReplayPath = getEnv("ROBOT_REPLAY", c.ReplayPath)
+	c.ReplayOut = getEnv("ROBOT_REPLAY_OUT", c.ReplayOut)
+	c.Visualizer = getEnv("ROBOT_VISUALIZER", c.Visualizer)
+	c.AnimationsFile = getEnv("ROBOT_ANIMATIONS", c.AnimationsFile)
+	c.LEDDevice = getEnv("ROBOT_LED_DEVICE", c.LEDDevice)
+	c.LEDProtocol = getEnv("ROBOT_LED_PROTOCOL", c.LEDProtocol)
+	c.Tracing.Exporter = getEnv("ROBOT_TRACE_EXPORTER", c.Tracing.Exporter)
+	c.Tracing.Endpoint = getEnv("ROBOT_TRACE_ENDPOINT", c.Tracing.Endpoint)
+	c.Tracing.File = getEnv("ROBOT_TRACE_FILE", c.Tracing.File)
+
+	if value := os.Getenv("ROBOT_CHUNK_LENGTH"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid ROBOT_CHUNK_LENGTH: %v", err)
+		}
+		c.ChunkLength = parsed
+	}
+	if value := os.Getenv("ROBOT_CONNECT_RETRIES"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid ROBOT_CONNECT_RETRIES: %v", err)
+		}
+		c.ConnectRetries = parsed
+	}
+	return nil
+}
+
+// bindFlags registers a flag for each setting, using the current value as
+// the default so unset flags leave earlier layers alone.
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ServerURL, "server", c.ServerURL, "WebSocket URL of the robot head server")
+	fs.StringVar(&c.Token, "token", c.Token, "device token for servers that require one (prefer ROBOT_TOKEN)")
+	fs.StringVar(&c.TLSCAFile, "tls-ca", c.TLSCAFile, "CA file to trust for a wss:// server")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", c.TLSCertFile, "client certificate file for servers that require one")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", c.TLSKeyFile, "client certificate private key file")
+	fs.StringVar(&c.SessionID, "session", c.SessionID, "session id to resume (random if empty)")
+	fs.StringVar(&c.Persona, "persona", c.Persona, "persona to ask the server for (server default if empty)")
+	fs.StringVar(&c.VoiceID, "voice", c.VoiceID, "TTS voice id to use instead of the persona's")
+	fs.BoolVar(&c.ListVoices, "list-voices", c.ListVoices, "ask the server for the available TTS voices on connect")
+	fs.DurationVar(&c.ChunkLength, "chunk-length", c.ChunkLength, "length of each recorded audio chunk")
+	fs.IntVar(&c.ConnectRetries, "connect-retries", c.ConnectRetries, "connection attempts before giving up")
+	fs.BoolVar(&c.Record, "record", c.Record, "ask the server to record this session's turns for debugging")
+	fs.StringVar(&c.Mode, "mode", c.Mode, "voice to talk through the microphone, text to type, replay to play WAV files")
+	fs.StringVar(&c.AudioOutput, "audio-output", c.AudioOutput, "what to do with spoken replies: play, save or none")
+	fs.StringVar(&c.AudioDir, "audio-dir", c.AudioDir, "directory for saved replies")
+	fs.StringVar(&c.ErrorSound, "error-sound", c.ErrorSound, "MP3 to play when a turn fails")
+	fs.BoolVar(&c.RetryErrors, "retry-errors", c.RetryErrors, "send a failed turn again once when the server says it might work")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json")
+	fs.StringVar(&c.ReplayPath, "replay", c.ReplayPath, "directory of WAV files or YAML script to replay")
+	fs.StringVar(&c.ReplayOut, "replay-out", c.ReplayOut, "directory for replay results")
+	fs.BoolVar(&c.ReplayRealtime, "replay-realtime", c.ReplayRealtime, "send replayed audio no faster than it was recorded")
+	fs.DurationVar(&c.ReplayTimeout, "replay-timeout", c.ReplayTimeout, "how long to wait for the server to answer each chunk")
+	fs.StringVar(&c.Visualizer, "visualizer", c.Visualizer, "where to draw the LED visualizer: none, terminal, png or device")
+	fs.StringVar(&c.VisualizerStyle, "visualizer-style", c.VisualizerStyle, "visualizer animation: spectrum, mouth or face")
+	fs.IntVar(&c.VisualizerFPS, "visualizer-fps", c.VisualizerFPS, "visualizer frames per second")
+	fs.StringVar(&c.FrameDir, "frame-dir", c.FrameDir, "directory for png visualizer frames")
+	fs.IntVar(&c.MatrixWidth, "matrix-width", c.MatrixWidth, "LED matrix width")
+	fs.IntVar(&c.MatrixHeight, "matrix-height", c.MatrixHeight, "LED matrix height")
+	fs.StringVar(&c.AnimationsFile, "animations", c.AnimationsFile, "YAML file of state animations for the visualizer")
+	fs.StringVar(&c.LEDDevice, "led-device", c.LEDDevice, "LED device file, e.g. /dev/ttyUSB0 or /dev/spidev0.0")
+	fs.StringVar(&c.LEDProtocol, "led-protocol", c.LEDProtocol, "LED protocol: serial, ws2812 or max7219")
+	fs.IntVar(&c.LEDBaud, "led-baud", c.LEDBaud, "serial baud rate for the LED controller, 0 to leave the port alone")
+	fs.Float64Var(&c.LEDBrightness, "led-brightness", c.LEDBrightness, "LED brightness, 0 to 1")
+	fs.Float64Var(&c.LEDGamma, "led-gamma", c.LEDGamma, "LED gamma correction, 1 for none")
+	fs.IntVar(&c.LEDRotate, "led-rotate", c.LEDRotate, "rotate the picture clockwise by 0, 90, 180 or 270 degrees")
+	fs.BoolVar(&c.LEDMirrorX, "led-mirror-x", c.LEDMirrorX, "flip the picture left to right")
+	fs.BoolVar(&c.LEDMirrorY, "led-mirror-y", c.LEDMirrorY, "flip the picture top to bottom")
+	fs.BoolVar(&c.LEDSerpentine, "led-serpentine", c.LEDSerpentine, "WS2812 rows are wired in a zigzag")
+	c.Tracing.BindFlags(fs)
+}
+
+// Validate reports the first setting that can't work.
+func (c Config) Validate() error {
+	u, err := url.Parse(c.ServerURL)
+	if err != nil {
+		return fmt.Errorf("server_url is not a valid URL: %v", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("server_url must use ws:// or wss://, got %q", c.ServerURL)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+	if (c.TLSCAFile != "" || c.TLSCertFile != "") && u.Scheme != "wss" {
+		return fmt.Errorf("TLS settings need a wss:// server_url, got %q", c.ServerURL)
+	}
+	if c.ChunkLength <= 0 {
+		return fmt.Errorf("chunk_length must be positive")
+	}
+	if c.ConnectRetries < 1 {
+		return fmt.Errorf("connect_retries must be at least 1")
+	}
+	switch c.Mode {
+	case "voice", "text":
+	case "replay":
+		if c.ReplayPath == "" {
+			return fmt.Errorf("replay_path is required in replay mode")
+		}
+		if c.ReplayOut == "" {
+			return fmt.Errorf("replay_out is required in replay mode")
+		}
+		if c.ReplayTimeout <= 0 {
+			return fmt.Errorf("replay_timeout must be positive")
+		}
+	default:
+		return fmt.Errorf("mode must be voice, text or replay, got %q", c.Mode)
+	}
+	switch c.AudioOutput {
+	case "play", "none":
+	case "save":
+		if c.AudioDir == "" {
+			return fmt.Errorf("audio_dir is required to save replies")
+		}
+	default:
+		return fmt.Errorf("audio_output must be play, save or none, got %q", c.AudioOutput)
+	}
+	if _, err := shared.NewLogHandler(io.Discard, c.LogLevel, c.LogFormat); err != nil {
+		return err
+	}
+	switch c.Visualizer {
+	case "none", "terminal", "png":
+	case "device":
+		if c.LEDDevice == "" {
+			return fmt.Errorf("led_device is required for the device visualizer")
+		}
+	default:
+		return fmt.Errorf("visualizer must be none, terminal, png or device, got %q", c.Visualizer)
+	}
+	switch c.VisualizerStyle {
+	case "spectrum", "mouth", "face":
+	default:
+		return fmt.Errorf("visualizer_style must be spectrum, mouth or face, got %q", c.VisualizerStyle)
+	}
+	if c.VisualizerFPS < 1 || c.VisualizerFPS > 120 {
+		return fmt.Errorf("visualizer_fps must be between 1 and 120")
+	}
+	if c.MatrixWidth < 1 || c.MatrixHeight < 1 {
+		return fmt.Errorf("matrix_width and matrix_height must be positive")
+	}
+	return c.Tracing.Validate()
+}
+
+// Redacted returns a copy that is safe to print.
+func (c Config) Redacted() Config {
+	c.Token = shared.Redact(c.Token)
+	return c
+}
+
+// loadConfig resolves the configuration from defaults, the optional config
+// file, the environment and command-line flags, in that order. It returns
+// printOnly when --print-config was given.
+func loadConfig(args []string, stderr io.Writer) (config Config, printOnly bool, err error) {
+	// First pass only finds --config and --print-config; the real values are
+	// bound once the lower-precedence layers have been applied.
+	var configPath string
+	scratch := defaultConfig()
+	fs := newFlagSet(&scratch, &configPath, &printOnly, stderr)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+
+	config = defaultConfig()
+	if configPath != "" {
+		if err := shared.LoadConfigFile(configPath, &config); err != nil {
+			return Config{}, false, err
+		}
+	}
+	if err := config.applyEnv(); err != nil {
+		return Config{}, false, err
+	}
+
+	fs = newFlagSet(&config, &configPath, &printOnly, stderr)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, false, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return config, printOnly, nil
+}
+
+func newFlagSet(config *Config, configPath *string, printOnly *bool, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("robot-head-client", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(configPath, "config", getEnv("ROBOT_CLIENT_CONFIG", ""), "path to a YAML config file")
+	fs.BoolVar(printOnly, "print-config", false, "print the resolved configuration and exit")
+	config.bindFlags(fs)
+	return fs
+}
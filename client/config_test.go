@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, printOnly, err := loadConfig(nil, io.Discard)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if printOnly {
+		t.Error("printOnly should default to false")
+	}
+	if config.ServerURL != "ws://localhost:9001/ws" {
+		t.Errorf("Unexpected default server url %v", config.ServerURL)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "server_url: ws://file:9001/ws\nchunk_length: 5s\nconnect_retries: 2\n")
+	t.Setenv("ROBOT_CHUNK_LENGTH", "4s")
+
+	config, _, err := loadConfig([]string{"--config", path, "--connect-retries", "7"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if config.ServerURL != "ws://file:9001/ws" {
+		t.Errorf("File should override default, got %v", config.ServerURL)
+	}
+	if config.ChunkLength != 4*time.Second {
+		t.Errorf("Env should override file, got %v", config.ChunkLength)
+	}
+	if config.ConnectRetries != 7 {
+		t.Errorf("Flag should override file, got %v", config.ConnectRetries)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	_, _, err := loadConfig([]string{"--server", "http://localhost:9001/ws"}, io.Discard)
+	if err == nil {
+		t.Error("Expected an error for a non-websocket server url")
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, "sever_url: ws://typo:9001/ws\n")
+	if _, _, err := loadConfig([]string{"--config", path}, io.Discard); err == nil {
+		t.Error("Expected an error for an unknown config key")
+	}
+}
+
+func TestLoadConfigDeviceVisualizer(t *testing.T) {
+	path := writeConfigFile(t, "visualizer: device\nled_device: /dev/spidev0.0\nled_protocol: ws2812\nled_rotate: 90\n")
+	config, _, err := loadConfig([]string{"--config", path, "--led-serpentine"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if config.LEDProtocol != "ws2812" || config.LEDRotate != 90 || !config.LEDSerpentine {
+		t.Errorf("LED settings not loaded: %+v", config)
+	}
+
+	if _, _, err := loadConfig([]string{"--visualizer", "device", "--led-device", ""}, io.Discard); err == nil {
+		t.Error("Expected an error for a device visualizer without a device")
+	}
+}
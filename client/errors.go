@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"robot-head/shared"
+)
+
+// stateError is shown on the visualizer for a moment after the server
+// reports an error. Only the client uses it; the server never sends it.
+const stateError = "error"
+
+const (
+	// errorShowTime is how long the error animation stays up
+	errorShowTime = 2 * time.Second
+	// errorRetryDelay is the wait before sending a failed turn again
+	errorRetryDelay = 2 * time.Second
+)
+
+// turnSender writes the client's messages to the server one at a time, and
+// keeps the last turn so a failed one can be sent again.
+type turnSender struct {
+	write func(shared.Message) error
+
+	mu sync.Mutex
+	// last is the latest turn, nil once it has been retried
+	last *shared.Message
+	// sent counts turns, and pending those not answered yet
+	sent, pending int
+}
+
+func newTurnSender(write func(shared.Message) error) *turnSender {
+	return &turnSender{write: write}
+}
+
+// send writes msg. turn is set for messages the user waits on an answer
+// to, rather than commands or chunks with nobody speaking.
+func (s *turnSender) send(msg shared.Message, turn bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if turn {
+		s.last = &msg
+		s.sent++
+		s.pending++
+	}
+	return s.write(msg)
+}
+
+// answered notes that the server has finished with the oldest pending
+// turn.
+func (s *turnSender) answered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = max(s.pending-1, 0)
+}
+
+// retry answers a failed turn by sending it again after delay. Only the
+// last turn is sent again, and only once: if other turns are waiting the
+// error might not be for it, so retry gives up and reports false.
+func (s *turnSender) retry(delay time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil || s.pending != 1 {
+		s.pending = max(s.pending-1, 0)
+		return false
+	}
+	msg, sent := *s.last, s.sent
+	s.last = nil
+	time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.sent != sent {
+			// The user has moved on
+			s.pending = max(s.pending-1, 0)
+			return
+		}
+		if err := s.write(msg); err != nil {
+			// No answer is coming for it
+			s.pending = max(s.pending-1, 0)
+			slog.Error("Failed to send turn again", "error", err)
+		}
+	})
+	return true
+}
+
+// observe settles turns from a message from the server, and reports
+// whether the message ended one. Errors are left to handleServerError.
+func (s *turnSender) observe(msg shared.Message) bool {
+	switch {
+	case msg.Type == shared.MessageTypeError:
+	case endsTurn(msg):
+		s.answered()
+		return true
+	case isState(msg, shared.StateIdle):
+		// Nothing was heard in the last chunk
+		s.answered()
+	}
+	return false
+}
+
+// handleServerError shows an error from the server: a red flash on the
+// visualizer, and the message spoken if the server sent audio or else
+// printed with the apology sound. A failed turn that's worth trying again
+// is sent again once; handleServerError reports whether it was, in which
+// case the turn isn't over.
+func handleServerError(ctx context.Context, response shared.Message, turns *turnSender) bool {
+	var serverErr shared.ErrorData
+	if err := response.DecodeData(&serverErr); err != nil {
+		// Older servers send just the message
+		serverErr = shared.ErrorData{Message: fmt.Sprint(response.Data)}
+	}
+	slog.Warn("Server error", "code", serverErr.Code, "stage", serverErr.Stage, "retryable", serverErr.Retryable)
+	showError()
+
+	// Errors answering commands aren't the conversation going wrong
+	if serverErr.Stage == shared.StageProtocol {
+		fmt.Printf("Server: %s\n", serverErr.Message)
+		turns.answered()
+		return false
+	}
+
+	// The server may know how long its limits need
+	delay := max(errorRetryDelay, time.Duration(serverErr.RetryAfterMS)*time.Millisecond)
+	if serverErr.Retryable && cfg.RetryErrors && turns.retry(delay) {
+		fmt.Printf("Server: %s (trying again)\n", serverErr.Message)
+		return true
+	}
+	if len(serverErr.AudioData) > 0 {
+		handleAudio(ctx, shared.AudioData{
+			Text:      serverErr.Message,
+			AudioData: serverErr.AudioData,
+			MimeType:  serverErr.MimeType,
+		})
+		return false
+	}
+	fmt.Printf("\nRobot: %s\n\n", serverErr.Message)
+	playErrorSound()
+	return false
+}
+
+// showError switches the visualizer to the error animation, and back to
+// idle after errorShowTime unless something else has been shown since.
+func showError() {
+	setState(stateError)
+	time.AfterFunc(errorShowTime, func() {
+		if visualState() == stateError {
+			setState(shared.StateIdle)
+		}
+	})
+}
+
+// playErrorSound plays the configured apology sound, if there is one and
+// replies are being played.
+func playErrorSound() {
+	if cfg.ErrorSound == "" || cfg.AudioOutput != "play" {
+		return
+	}
+	go func() {
+		sound, err := os.ReadFile(cfg.ErrorSound)
+		if err == nil {
+			err = playAudio(sound)
+		}
+		if err != nil {
+			slog.Error("Failed to play error sound", "path", cfg.ErrorSound, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+// recordingWriter keeps what a turnSender writes.
+type recordingWriter struct {
+	mu   sync.Mutex
+	sent []shared.Message
+}
+
+func (w *recordingWriter) write(msg shared.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sent = append(w.sent, msg)
+	return nil
+}
+
+func (w *recordingWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.sent)
+}
+
+func TestTurnSenderRetriesOnce(t *testing.T) {
+	w := &recordingWriter{}
+	turns := newTurnSender(w.write)
+	turns.send(createUserMessage("hello"), true)
+
+	if !turns.retry(time.Millisecond) {
+		t.Fatal("Expected the turn to be sent again")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if w.count() != 2 || w.sent[1].Data != "hello" {
+		t.Fatalf("Expected the turn twice, got %+v", w.sent)
+	}
+
+	// The retry failed too
+	if turns.retry(time.Millisecond) {
+		t.Error("Expected only one retry")
+	}
+}
+
+func TestTurnSenderRetryNeedsOnePendingTurn(t *testing.T) {
+	w := &recordingWriter{}
+	turns := newTurnSender(w.write)
+
+	// Answered turns aren't sent again
+	turns.send(createUserMessage("one"), true)
+	turns.answered()
+	if turns.retry(time.Millisecond) {
+		t.Error("Expected no retry of an answered turn")
+	}
+
+	// With two waiting, the error might be for either
+	turns.send(createUserMessage("two"), true)
+	turns.send(createUserMessage("three"), true)
+	if turns.retry(time.Millisecond) {
+		t.Error("Expected no retry with two turns waiting")
+	}
+	// The error answered "two", so an error for "three" can be retried
+	if !turns.retry(time.Millisecond) {
+		t.Error("Expected the last turn to be retried")
+	}
+
+	// Commands aren't turns
+	turns = newTurnSender(w.write)
+	turns.send(createResetMessage(), false)
+	if turns.retry(time.Millisecond) {
+		t.Error("Expected no retry of a command")
+	}
+}
+
+func TestTurnSenderSkipsRetryAfterNewTurn(t *testing.T) {
+	w := &recordingWriter{}
+	turns := newTurnSender(w.write)
+	turns.send(createUserMessage("hello"), true)
+	turns.retry(10 * time.Millisecond)
+	turns.send(createUserMessage("something else"), true)
+	time.Sleep(30 * time.Millisecond)
+	if w.count() != 2 {
+		t.Errorf("Expected no retry once the user moved on, got %+v", w.sent)
+	}
+}
+
+func TestTurnSenderRetryWriteFails(t *testing.T) {
+	writes := 0
+	turns := newTurnSender(func(shared.Message) error {
+		writes++
+		if writes == 2 {
+			return errors.New("connection closed")
+		}
+		return nil
+	})
+	turns.send(createUserMessage("one"), true)
+	turns.retry(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	// The failed resend isn't left waiting for an answer
+	turns.send(createUserMessage("two"), true)
+	if !turns.retry(time.Millisecond) {
+		t.Error("Expected the next turn to be retried")
+	}
+}
+
+func TestBlankChunksKeepRetriesWorking(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.Mode, cfg.AudioOutput, cfg.RetryErrors = "voice", "none", true
+
+	// Without a visualizer the client still asks for states, since blank
+	// chunks are only answered with an idle one
+	hello := createHelloMessage("robot-1").Data.(shared.HelloData)
+	if !slices.Contains(hello.Capabilities, shared.CapabilityStates) {
+		t.Fatalf("Expected states advertised for retries, got %v", hello.Capabilities)
+	}
+
+	w := &recordingWriter{}
+	turns := newTurnSender(w.write)
+	idle := shared.Message{Type: shared.MessageTypeStatus, Data: shared.StatusData{State: shared.StateIdle}}
+	for range 3 {
+		turns.send(createAudioMessage([]byte{0, 0}), true)
+		if turns.observe(idle) {
+			t.Error("Expected a blank chunk not to end a turn")
+		}
+	}
+	turns.send(createAudioMessage([]byte{1, 1}), true)
+	if !turns.retry(time.Millisecond) {
+		t.Error("Expected the failed turn retried after blank chunks")
+	}
+}
+
+func TestHandleServerError(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.AudioOutput = "none"
+
+	cases := []struct {
+		name     string
+		data     any
+		retry    bool
+		retrying bool
+	}{
+		{"retryable", shared.ErrorData{Code: shared.ErrorCodeTimeout, Stage: shared.StageLLM, Retryable: true, Message: "Sorry"}, true, true},
+		{"retries off", shared.ErrorData{Code: shared.ErrorCodeTimeout, Stage: shared.StageLLM, Retryable: true, Message: "Sorry"}, false, false},
+		{"not retryable", shared.ErrorData{Code: shared.ErrorCodeQuotaExceeded, Stage: shared.StageLLM, Message: "Sorry"}, true, false},
+		{"server limits", shared.ErrorData{Code: shared.ErrorCodeRateLimited, Stage: shared.StageLimits, Retryable: true, RetryAfterMS: 1500, Message: "Wait"}, true, true},
+		{"protocol", shared.ErrorData{Code: shared.ErrorCodeBadRequest, Stage: shared.StageProtocol, Retryable: true, Message: "Unknown persona"}, true, false},
+		{"old server", "Sorry, I'm having trouble thinking right now.", true, false},
+	}
+	for _, c := range cases {
+		cfg.RetryErrors = c.retry
+		turns := newTurnSender((&recordingWriter{}).write)
+		turns.send(createUserMessage("hello"), true)
+		msg := shared.Message{Type: shared.MessageTypeError, Data: c.data}
+		if got := handleServerError(context.Background(), msg, turns); got != c.retrying {
+			t.Errorf("%s: expected retrying %v, got %v", c.name, c.retrying, got)
+		}
+	}
+}
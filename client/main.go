@@ -1,23 +1,51 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
-	"net/url"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
 	"robot-head/shared"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
 )
 
+// tracer makes the capture and playback spans that bracket each turn on
+// the server.
+var tracer = otel.Tracer("robot-head/client")
+
 func openWebsocket() (*websocket.Conn, error) {
 	// Websocket server URL
-	serverURL := url.URL{Scheme: "ws", Host: "localhost:9001", Path: "/ws"}
-	fmt.Printf("Connecting to %s\n", serverURL.String())
+	serverURL := cfg.ServerURL
+	fmt.Printf("Connecting to %s\n", serverURL)
+
+	// Certificates are read on every attempt so renewed ones are picked up
+	dialer := *websocket.DefaultDialer
+	tlsConfig, err := tlsClientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dialer.TLSClientConfig = tlsConfig
+
 	// Connect to URL
-	conn, _, err := websocket.DefaultDialer.Dial(serverURL.String(), nil)
+	header := http.Header{}
+	if cfg.Token != "" {
+		header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+	conn, resp, err := dialer.Dial(serverURL, header)
 	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return nil, fmt.Errorf("server refused the connection (%s), check the token", resp.Status)
+		}
 		return nil, err
 	}
 	fmt.Println("Connected to server!")
@@ -25,7 +53,7 @@ func openWebsocket() (*websocket.Conn, error) {
 }
 
 func connectWithRetry() (*websocket.Conn, error) {
-	maxRetries := 5
+	maxRetries := cfg.ConnectRetries
 	baseDelay := 1 * time.Second
 	
 	for attempt := 0; attempt < maxRetries; attempt++ {
@@ -44,6 +72,108 @@ func connectWithRetry() (*websocket.Conn, error) {
 	return nil, fmt.Errorf("failed to connect after %d attempts", maxRetries)
 }
 
+// newSessionID picks the id the server uses to remember this client across
+// reconnects. Setting session_id in the config pins it across restarts too.
+func newSessionID() string {
+	if cfg.SessionID != "" {
+		return cfg.SessionID
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func createHelloMessage(sessionID string) shared.Message {
+	var capabilities []string
+	switch cfg.Mode {
+	case "text":
+		capabilities = append(capabilities, shared.CapabilityTextInput)
+	case "replay":
+		// The replay report checks what the server heard and when it's done
+		capabilities = append(capabilities, shared.CapabilityAudioInput,
+			shared.CapabilityTranscripts, shared.CapabilityStates)
+	default:
+		capabilities = append(capabilities, shared.CapabilityAudioInput)
+		// A chunk with nothing in it is only answered with an idle state,
+		// and retrying failed turns needs to know it was answered
+		if cfg.RetryErrors && visual == nil {
+			capabilities = append(capabilities, shared.CapabilityStates)
+		}
+	}
+	switch cfg.AudioOutput {
+	case "play":
+		capabilities = append(capabilities, shared.CapabilityAudioOutput, shared.CapabilityAudioStream)
+	case "save":
+		// Saved replies are written whole, so there's no point streaming
+		capabilities = append(capabilities, shared.CapabilityAudioOutput)
+	}
+	// Expressions are only worth the extra prompt if there's a face to show them
+	if visual != nil {
+		capabilities = append(capabilities, shared.CapabilityExpressions, shared.CapabilityStates)
+	}
+	return shared.Message{
+		Type:      shared.MessageTypeHello,
+		Timestamp: time.Now().Unix(),
+		Data: shared.HelloData{
+			SessionID:    sessionID,
+			Capabilities: capabilities,
+			Persona:      cfg.Persona,
+		},
+	}
+}
+
+func createVoiceMessage(voiceID string) shared.Message {
+	return shared.Message{
+		Type:      shared.MessageTypeVoice,
+		Timestamp: time.Now().Unix(),
+		Data:      shared.VoiceData{VoiceID: voiceID},
+	}
+}
+
+func createVoicesRequest() shared.Message {
+	return shared.Message{
+		Type:      shared.MessageTypeVoices,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+func createResetMessage() shared.Message {
+	return shared.Message{
+		Type:      shared.MessageTypeReset,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+func createRecordMessage(enabled bool) shared.Message {
+	return shared.Message{
+		Type:      shared.MessageTypeRecord,
+		Timestamp: time.Now().Unix(),
+		Data:      shared.RecordData{Enabled: enabled},
+	}
+}
+
+func createPersonaMessage(name string) shared.Message {
+	return shared.Message{
+		Type:      shared.MessageTypePersona,
+		Timestamp: time.Now().Unix(),
+		Data:      shared.PersonaData{Name: name},
+	}
+}
+
+// createAudioMessage wraps recorded 16kHz mono PCM for the server.
+func createAudioMessage(audioData []byte) shared.Message {
+	return shared.Message{
+		Type:      shared.MessageTypeAudio,
+		Timestamp: time.Now().Unix(),
+		Data: shared.AudioData{
+			AudioData: audioData,
+			MimeType:  "audio/pcm",
+		},
+	}
+}
+
 func createUserMessage(text string) shared.Message {
 	return shared.Message{
 		Type:      shared.MessageTypeUserInput,
@@ -52,71 +182,202 @@ func createUserMessage(text string) shared.Message {
 	}
 }
 
-func listenForMessages(conn *websocket.Conn) {
+func listenForMessages(conn *websocket.Conn, turns *turnSender) {
+	streams := newStreamReceiver(playAudioStream)
+	defer streams.closeAll()
+
 	for {
 		var response shared.Message
 		err := conn.ReadJSON(&response)
 		if err != nil {
-			log.Println("Connection closed", err)
+			slog.Info("Connection closed", "error", err)
 			break
 		}
-	switch  response.Type {
-	case shared.MessageTypeAIResponse:
-			fmt.Printf("\nRobot: %v\n\n", response.Data)
-	case shared.MessageTypeAudio:
-		// Parse audio data
-		audioDataJSON, err := json.Marshal(response.Data)
-		if err != nil {
-			log.Printf("Failed to marshal audio data: %v\n", err)
-			continue
-		}
-
-		var audioData shared.AudioData
-		err = json.Unmarshal(audioDataJSON, &audioData)
-		if err != nil {
-			log.Printf("Failed to unmarshal audio data: %v\n", err)
-			continue
+		if turns.observe(response) {
+			replyReceived()
 		}
+		switch response.Type {
+		case shared.MessageTypeAIResponse:
+			setState(shared.StateIdle)
+			fmt.Printf("\nRobot: %v\n\n", response.Data)
+		case shared.MessageTypeAudio:
+			// Parse audio data
+			audioDataJSON, err := json.Marshal(response.Data)
+			if err != nil {
+				slog.Error("Failed to marshal audio data", "error", err)
+				continue
+			}
 
-		fmt.Printf("\nPlaying audio for: %s\n", audioData.Text)
-		go func() {
-			err := playAudio(audioData.AudioData)
+			var audioData shared.AudioData
+			err = json.Unmarshal(audioDataJSON, &audioData)
 			if err != nil {
-				log.Printf("Failed to play audio: %v\n", err)
+				slog.Error("Failed to unmarshal audio data", "error", err)
+				continue
+			}
+
+			handleAudio(shared.ExtractTrace(context.Background(), response.TraceParent), audioData)
+		case shared.MessageTypeAudioChunk:
+			var chunk shared.AudioChunk
+			if err := response.DecodeData(&chunk); err != nil {
+				slog.Error("Failed to parse audio chunk", "error", err)
+				continue
+			}
+			if chunk.Seq == 0 {
+				showVisemes(chunk.Visemes)
+			}
+			streams.handle(shared.ExtractTrace(context.Background(), response.TraceParent), chunk)
+		case shared.MessageTypeSession:
+			var info shared.SessionInfo
+			if err := response.DecodeData(&info); err != nil {
+				slog.Error("Failed to parse session info", "error", err)
+				continue
+			}
+			if info.Resumed {
+				fmt.Printf("Resumed session %s as %s\n", info.SessionID, info.Persona)
+			} else {
+				fmt.Printf("Started session %s as %s\n", info.SessionID, info.Persona)
+			}
+			if len(info.Personas) > 0 {
+				fmt.Printf("Available personas: %s\n", strings.Join(info.Personas, ", "))
+			}
+		case shared.MessageTypeExpression:
+			var expression shared.ExpressionData
+			if err := response.DecodeData(&expression); err != nil {
+				slog.Error("Failed to parse expression", "error", err)
+				continue
+			}
+			if visual != nil {
+				visual.SetExpression(expression.Name, expression.At)
+			}
+		case shared.MessageTypeVoices:
+			var list shared.VoiceList
+			if err := response.DecodeData(&list); err != nil {
+				slog.Error("Failed to parse voice list", "error", err)
+				continue
+			}
+			fmt.Println("Available voices:")
+			for _, voice := range list.Voices {
+				fmt.Printf("  %s  %s (%s)\n", voice.VoiceID, voice.Name, voice.Category)
+			}
+		case shared.MessageTypeStatus:
+			var status shared.StatusData
+			err := response.DecodeData(&status)
+			if err == nil && status.State != "" {
+				setState(status.State)
+				continue
+			}
+			if err != nil || status.Message == "" {
+				fmt.Printf("Server: %v\n", response.Data)
+				continue
+			}
+			if status.Persona != "" {
+				fmt.Printf("Server [%s]: %s\n", status.Persona, status.Message)
+			} else {
+				fmt.Printf("Server: %s\n", status.Message)
+			}
+		case shared.MessageTypeError:
+			if !handleServerError(shared.ExtractTrace(context.Background(), response.TraceParent), response, turns) {
+				replyReceived()
 			}
-		}()		
 		default:
-			// Other message types (status, error, etc.)
+			// Other message types
+			setState(shared.StateIdle)
 			fmt.Printf("Server: %v\n", response.Data)
-		}	
+		}
 	}
 }
 
-
 func main() {
+	config, printOnly, err := loadConfig(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		shared.Fatal("Failed to load configuration", err)
+	}
+	if printOnly {
+		if err := shared.PrintConfig(os.Stdout, config.Redacted()); err != nil {
+			shared.Fatal("Failed to print configuration", err)
+		}
+		return
+	}
+	cfg = config
+	if err := shared.SetupLogging(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		shared.Fatal("Failed to set up logging", err)
+	}
+	shutdownTracing, err := shared.SetupTracing(context.Background(), "robot-head-client", cfg.Tracing)
+	if err != nil {
+		shared.Fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	fmt.Println("Robot Head Client starting...")
 
-	conn, err := connectWithRetry()
-	if err != nil {
-		log.Fatal("Websocket connection failed:", err)
+	if err := startVisualizer(context.Background(), cfg); err != nil {
+		shared.Fatal("Failed to start visualizer", err)
 	}
-	defer conn.Close()
 
-	// Test server connection
-	testMessage := shared.Message{
-		Type:      shared.MessageTypeStatus,
-		Timestamp: time.Now().Unix(),
-		Data:      "Robot head client connected",
+	sessionID := newSessionID()
+	slog.SetDefault(slog.Default().With("session_id", sessionID))
+
+	if cfg.Mode == "replay" {
+		code := runReplay(sessionID)
+		shutdownTracing(context.Background())
+		os.Exit(code)
 	}
 
-	err = conn.WriteJSON(testMessage)
-	if err != nil {
-		log.Fatal("Failed to send message:", err)
+	// Text mode keeps one REPL across reconnects so nothing typed is lost
+	var repl *textREPL
+	if cfg.Mode == "text" {
+		repl = newTextREPL(os.Stdin, os.Stdout, replies)
 	}
-	log.Println("Client connected and ready to send/recieve messages.")
-	fmt.Println("Sent connection message to server.")
 
-	go listenForMessages(conn)
+	// Reconnect with the same session id whenever the connection drops so
+	// the server can pick the conversation back up.
+	for {
+		conn, err := connectWithRetry()
+		if err != nil {
+			shared.Fatal("Websocket connection failed", err)
+		}
+
+		err = conn.WriteJSON(createHelloMessage(sessionID))
+		if err != nil {
+			shared.Fatal("Failed to send message", err)
+		}
+		if cfg.VoiceID != "" {
+			if err := conn.WriteJSON(createVoiceMessage(cfg.VoiceID)); err != nil {
+				shared.Fatal("Failed to send message", err)
+			}
+		}
+		if cfg.Record {
+			if err := conn.WriteJSON(createRecordMessage(true)); err != nil {
+				shared.Fatal("Failed to send message", err)
+			}
+		}
+		if cfg.ListVoices {
+			if err := conn.WriteJSON(createVoicesRequest()); err != nil {
+				shared.Fatal("Failed to send message", err)
+			}
+		}
+		slog.Info("Client connected", "server", cfg.ServerURL)
+		fmt.Println("Sent connection message to server.")
+
+		turns := newTurnSender(func(msg shared.Message) error { return conn.WriteJSON(msg) })
+		go listenForMessages(conn, turns)
 
-	sendVoiceMessages(conn)
+		if repl != nil {
+			err := repl.run(func(msg shared.Message) error {
+				return turns.send(msg, msg.Type == shared.MessageTypeUserInput)
+			})
+			if err == io.EOF {
+				conn.Close()
+				return
+			}
+			slog.Error("Failed to send message", "error", err)
+		} else {
+			sendVoiceMessages(turns)
+		}
+		conn.Close()
+		fmt.Println("Connection lost, reconnecting...")
+	}
 }
@@ -33,4 +33,45 @@ func TestCreateUserMessageEmptyString(t *testing.T) {
 	if msg.Type != shared.MessageTypeUserInput {
 		t.Error("Type should still be MessageTypeUserInput")
 	}
-}
\ No newline at end of file
+}
+
+func TestCreateHelloMessage(t *testing.T) {
+	msg := createHelloMessage("robot-1")
+
+	if msg.Type != shared.MessageTypeHello {
+		t.Errorf("Expected type %v, got %v", shared.MessageTypeHello, msg.Type)
+	}
+
+	hello, ok := msg.Data.(shared.HelloData)
+	if !ok {
+		t.Fatalf("Expected HelloData, got %T", msg.Data)
+	}
+	if hello.SessionID != "robot-1" {
+		t.Errorf("Expected session id robot-1, got %v", hello.SessionID)
+	}
+	if len(hello.Capabilities) == 0 {
+		t.Error("Expected capabilities to be advertised")
+	}
+}
+
+func TestNewSessionIDFromConfig(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+
+	cfg.SessionID = "pinned"
+	if id := newSessionID(); id != "pinned" {
+		t.Errorf("Expected pinned session id, got %v", id)
+	}
+}
+
+func TestCreateVoiceMessage(t *testing.T) {
+	msg := createVoiceMessage("voice-1")
+
+	if msg.Type != shared.MessageTypeVoice {
+		t.Errorf("Expected type %v, got %v", shared.MessageTypeVoice, msg.Type)
+	}
+	voice, ok := msg.Data.(shared.VoiceData)
+	if !ok || voice.VoiceID != "voice-1" {
+		t.Errorf("Expected voice id voice-1, got %v", msg.Data)
+	}
+}
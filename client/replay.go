@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+
+	"robot-head/shared"
+)
+
+// replayTurn is one recorded utterance and what we expect to come back.
+type replayTurn struct {
+	Name  string `yaml:"name"`
+	Audio string `yaml:"audio"`
+	// Transcript is what the server should hear, compared ignoring case
+	// and punctuation. Empty skips the check.
+	Transcript    string   `yaml:"transcript"`
+	ReplyContains []string `yaml:"reply_contains"`
+}
+
+type replayScript struct {
+	Turns []replayTurn `yaml:"turns"`
+}
+
+// loadReplayScript reads either a YAML script or a directory of WAV files.
+// In a directory, a .txt file next to a WAV holds its expected transcript.
+// Audio paths are relative to the script or directory.
+func loadReplayScript(path string) (replayScript, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return replayScript{}, err
+	}
+	if info.IsDir() {
+		return scanReplayDir(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return replayScript{}, err
+	}
+	defer f.Close()
+
+	var script replayScript
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&script); err != nil {
+		return replayScript{}, fmt.Errorf("could not parse replay script %s: %w", path, err)
+	}
+	base := filepath.Dir(path)
+	for i := range script.Turns {
+		turn := &script.Turns[i]
+		if turn.Audio == "" {
+			return replayScript{}, fmt.Errorf("turn %d of %s has no audio", i+1, path)
+		}
+		if !filepath.IsAbs(turn.Audio) {
+			turn.Audio = filepath.Join(base, turn.Audio)
+		}
+		if turn.Name == "" {
+			turn.Name = strings.TrimSuffix(filepath.Base(turn.Audio), filepath.Ext(turn.Audio))
+		}
+	}
+	return script, nil
+}
+
+func scanReplayDir(dir string) (replayScript, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.wav"))
+	if err != nil {
+		return replayScript{}, err
+	}
+	sort.Strings(paths)
+
+	var script replayScript
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		turn := replayTurn{Name: name, Audio: path}
+		if expected, err := os.ReadFile(strings.TrimSuffix(path, ".wav") + ".txt"); err == nil {
+			turn.Transcript = strings.TrimSpace(string(expected))
+		}
+		script.Turns = append(script.Turns, turn)
+	}
+	return script, nil
+}
+
+// turnResult is what happened in one turn of a replay.
+type turnResult struct {
+	Name       string   `json:"name"`
+	Audio      string   `json:"audio"`
+	Transcript string   `json:"transcript"`
+	Reply      string   `json:"reply"`
+	AudioFiles []string `json:"audio_files,omitempty"`
+	Seconds    float64  `json:"seconds"`
+	Passed     bool     `json:"passed"`
+	Failures   []string `json:"failures,omitempty"`
+}
+
+type replayReport struct {
+	Passed bool         `json:"passed"`
+	Turns  []turnResult `json:"turns"`
+}
+
+// replayer feeds recorded audio to the server as if it came from the
+// microphone and records everything that comes back.
+type replayer struct {
+	send     func(shared.Message) error
+	incoming <-chan shared.Message
+	outDir   string
+	// chunkLength splits each file the way recordAudio would
+	chunkLength time.Duration
+	// realtime paces chunks as if they were being recorded
+	realtime bool
+	timeout  time.Duration
+}
+
+// run plays every turn of the script and writes report.json to outDir.
+// It only returns an error if the replay itself couldn't carry on.
+func (r *replayer) run(script replayScript) (replayReport, error) {
+	report := replayReport{Passed: true}
+	for i, turn := range script.Turns {
+		result, err := r.playTurn(i, turn)
+		report.Turns = append(report.Turns, result)
+		if !result.Passed {
+			report.Passed = false
+		}
+		if err != nil {
+			report.Passed = false
+			return report, err
+		}
+	}
+	return report, writeJSONFile(filepath.Join(r.outDir, "report.json"), report)
+}
+
+func (r *replayer) playTurn(index int, turn replayTurn) (result turnResult, err error) {
+	result = turnResult{Name: turn.Name, Audio: turn.Audio}
+	fail := func(format string, args ...interface{}) {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+	}
+	started := time.Now()
+	defer func() {
+		result.Seconds = time.Since(started).Seconds()
+		result.Passed = len(result.Failures) == 0
+	}()
+
+	audio, err := readWAV(turn.Audio)
+	if err != nil {
+		fail("could not read audio: %v", err)
+		return result, nil
+	}
+
+	turnDir := filepath.Join(r.outDir, fmt.Sprintf("%02d-%s", index+1, turn.Name))
+	if err := os.MkdirAll(turnDir, 0o755); err != nil {
+		return result, err
+	}
+	log, err := os.Create(filepath.Join(turnDir, "messages.jsonl"))
+	if err != nil {
+		return result, err
+	}
+	defer log.Close()
+	recorder := &turnRecorder{dir: turnDir, log: log, result: &result}
+	defer recorder.close()
+
+	chunkBytes := int(r.chunkLength.Seconds()*captureSampleRate) * 2
+	var lastSent time.Time
+	for offset := 0; offset < len(audio); offset += chunkBytes {
+		chunk := audio[offset:min(offset+chunkBytes, len(audio))]
+		if r.realtime && !lastSent.IsZero() {
+			time.Sleep(time.Until(lastSent.Add(r.chunkLength)))
+		}
+		lastSent = time.Now()
+		if err := r.send(createAudioMessage(chunk)); err != nil {
+			return result, err
+		}
+
+		done, err := r.awaitReply(recorder)
+		if err != nil {
+			return result, err
+		}
+		if !done {
+			fail("no reply to chunk %d within %v", offset/chunkBytes+1, r.timeout)
+			break
+		}
+	}
+
+	if turn.Transcript != "" && normalizeText(result.Transcript) != normalizeText(turn.Transcript) {
+		fail("transcript %q, expected %q", result.Transcript, turn.Transcript)
+	}
+	for _, want := range turn.ReplyContains {
+		if !strings.Contains(strings.ToLower(result.Reply), strings.ToLower(want)) {
+			fail("reply %q doesn't mention %q", result.Reply, want)
+		}
+	}
+	return result, nil
+}
+
+// awaitReply records messages until the server has finished with the
+// last chunk: it either answered or heard nothing worth answering.
+func (r *replayer) awaitReply(recorder *turnRecorder) (bool, error) {
+	timeout := time.After(r.timeout)
+	for {
+		select {
+		case msg, ok := <-r.incoming:
+			if !ok {
+				return false, fmt.Errorf("connection closed")
+			}
+			if err := recorder.record(msg); err != nil {
+				return false, err
+			}
+			if endsTurn(msg) || isState(msg, shared.StateIdle) {
+				return true, nil
+			}
+		case <-timeout:
+			return false, nil
+		}
+	}
+}
+
+func isState(msg shared.Message, state string) bool {
+	if msg.Type != shared.MessageTypeStatus {
+		return false
+	}
+	var status shared.StatusData
+	return msg.DecodeData(&status) == nil && status.State == state
+}
+
+// turnRecorder writes one turn's messages and audio to disk.
+type turnRecorder struct {
+	dir     string
+	log     io.Writer
+	result  *turnResult
+	streams map[string]*os.File
+	count   int
+}
+
+func (t *turnRecorder) record(msg shared.Message) error {
+	switch msg.Type {
+	case shared.MessageTypeTranscript:
+		if text, ok := msg.Data.(string); ok {
+			t.result.Transcript = strings.TrimSpace(t.result.Transcript + " " + text)
+		}
+	case shared.MessageTypeAIResponse:
+		t.result.Reply = fmt.Sprint(msg.Data)
+	case shared.MessageTypeAudio:
+		var audio shared.AudioData
+		if err := msg.DecodeData(&audio); err != nil {
+			return err
+		}
+		t.result.Reply = audio.Text
+		if err := t.saveAudio(audio.AudioData, audio.MimeType); err != nil {
+			return err
+		}
+		audio.AudioData = nil
+		msg.Data = audio
+	case shared.MessageTypeAudioChunk:
+		var chunk shared.AudioChunk
+		if err := msg.DecodeData(&chunk); err != nil {
+			return err
+		}
+		if chunk.Text != "" {
+			t.result.Reply = chunk.Text
+		}
+		if err := t.appendStream(chunk); err != nil {
+			return err
+		}
+		chunk.AudioData = nil
+		msg.Data = chunk
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(t.log, "%s\n", line)
+	return err
+}
+
+func (t *turnRecorder) nextAudioPath(mimeType string) string {
+	t.count++
+	ext, ok := audioExtensions[mimeType]
+	if !ok {
+		ext = ".mp3"
+	}
+	name := fmt.Sprintf("reply-%d%s", t.count, ext)
+	t.result.AudioFiles = append(t.result.AudioFiles, name)
+	return filepath.Join(t.dir, name)
+}
+
+func (t *turnRecorder) saveAudio(data []byte, mimeType string) error {
+	return os.WriteFile(t.nextAudioPath(mimeType), data, 0o644)
+}
+
+// appendStream collects a streamed reply into a single file.
+func (t *turnRecorder) appendStream(chunk shared.AudioChunk) error {
+	if t.streams == nil {
+		t.streams = make(map[string]*os.File)
+	}
+	f, ok := t.streams[chunk.StreamID]
+	if !ok {
+		var err error
+		f, err = os.Create(t.nextAudioPath(chunk.MimeType))
+		if err != nil {
+			return err
+		}
+		t.streams[chunk.StreamID] = f
+	}
+	if _, err := f.Write(chunk.AudioData); err != nil {
+		return err
+	}
+	if chunk.Final {
+		delete(t.streams, chunk.StreamID)
+		return f.Close()
+	}
+	return nil
+}
+
+func (t *turnRecorder) close() {
+	for _, f := range t.streams {
+		f.Close()
+	}
+}
+
+// normalizeText lowercases text and drops punctuation so transcripts can
+// be compared without caring how whisper punctuated them.
+func normalizeText(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			b.WriteRune(r)
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// printReport summarises a replay for the terminal.
+func printReport(w io.Writer, report replayReport) {
+	passed := 0
+	for _, turn := range report.Turns {
+		status := "PASS"
+		if turn.Passed {
+			passed++
+		} else {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s  %s (%.1fs)\n", status, turn.Name, turn.Seconds)
+		for _, failure := range turn.Failures {
+			fmt.Fprintf(w, "      %s\n", failure)
+		}
+	}
+	fmt.Fprintf(w, "%d/%d turns passed\n", passed, len(report.Turns))
+}
+
+// runReplay plays cfg.ReplayPath against the server once and returns the
+// process exit code: 0 if every turn passed.
+func runReplay(sessionID string) int {
+	script, err := loadReplayScript(cfg.ReplayPath)
+	if err != nil {
+		slog.Error("Failed to load replay", "error", err)
+		return 2
+	}
+	if len(script.Turns) == 0 {
+		slog.Error("Nothing to replay", "path", cfg.ReplayPath)
+		return 2
+	}
+	if err := os.MkdirAll(cfg.ReplayOut, 0o755); err != nil {
+		slog.Error("Failed to create replay output directory", "dir", cfg.ReplayOut, "error", err)
+		return 2
+	}
+
+	conn, err := connectWithRetry()
+	if err != nil {
+		slog.Error("Websocket connection failed", "error", err)
+		return 2
+	}
+	defer conn.Close()
+
+	incoming := make(chan shared.Message)
+	go func() {
+		defer close(incoming)
+		for {
+			var msg shared.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			incoming <- msg
+		}
+	}()
+
+	send := func(msg shared.Message) error { return conn.WriteJSON(msg) }
+	if err := send(createHelloMessage(sessionID)); err != nil {
+		slog.Error("Failed to send message", "error", err)
+		return 2
+	}
+	if cfg.VoiceID != "" {
+		if err := send(createVoiceMessage(cfg.VoiceID)); err != nil {
+			slog.Error("Failed to send message", "error", err)
+			return 2
+		}
+	}
+	if cfg.Record {
+		if err := send(createRecordMessage(true)); err != nil {
+			slog.Error("Failed to send message", "error", err)
+			return 2
+		}
+	}
+
+	r := &replayer{
+		send:        send,
+		incoming:    incoming,
+		outDir:      cfg.ReplayOut,
+		chunkLength: cfg.ChunkLength,
+		realtime:    cfg.ReplayRealtime,
+		timeout:     cfg.ReplayTimeout,
+	}
+	report, err := r.run(script)
+	printReport(os.Stdout, report)
+	if err != nil {
+		slog.Error("Replay stopped", "error", err)
+		return 2
+	}
+	fmt.Printf("Results written to %s\n", cfg.ReplayOut)
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+// writeTestWAV writes a 16-bit PCM WAV of the given samples, interleaved
+// if there's more than one channel.
+func writeTestWAV(t *testing.T, path string, rate, channels int, samples []int16) {
+	t.Helper()
+	pcm := encodePCM(samples)
+	data := []byte("RIFF\x00\x00\x00\x00WAVE")
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], 1)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:], uint32(rate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:], uint32(rate*channels*2))
+	binary.LittleEndian.PutUint16(fmtChunk[12:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+	data = appendChunk(data, "fmt ", fmtChunk)
+	data = appendChunk(data, "data", pcm)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendChunk(data []byte, id string, body []byte) []byte {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(body)))
+	data = append(data, id...)
+	data = append(data, size...)
+	return append(data, body...)
+}
+
+func TestReadWAVMixesAndResamples(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stereo.wav")
+	// One second of 32kHz stereo, left and right averaging to 1000
+	samples := make([]int16, 32000*2)
+	for i := 0; i < len(samples); i += 2 {
+		samples[i], samples[i+1] = 500, 1500
+	}
+	writeTestWAV(t, path, 32000, 2, samples)
+
+	pcm, err := readWAV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pcm) != captureSampleRate*2 {
+		t.Fatalf("Expected one second at 16kHz, got %d bytes", len(pcm))
+	}
+	if got := int16(binary.LittleEndian.Uint16(pcm[100:])); got != 1000 {
+		t.Errorf("Expected channels mixed to 1000, got %d", got)
+	}
+}
+
+func TestReadWAVRejectsOtherFormats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.wav")
+	if err := os.WriteFile(path, []byte("ID3 not a wav at all"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readWAV(path); err == nil {
+		t.Error("Expected an error for a file that isn't a WAV")
+	}
+}
+
+func TestLoadReplayScript(t *testing.T) {
+	dir := t.TempDir()
+	writeTestWAV(t, filepath.Join(dir, "02-weather.wav"), 16000, 1, make([]int16, 100))
+	writeTestWAV(t, filepath.Join(dir, "01-hello.wav"), 16000, 1, make([]int16, 100))
+	if err := os.WriteFile(filepath.Join(dir, "01-hello.txt"), []byte("Hello robot\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := loadReplayScript(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(script.Turns) != 2 || script.Turns[0].Name != "01-hello" || script.Turns[1].Name != "02-weather" {
+		t.Fatalf("Expected both files in name order, got %+v", script.Turns)
+	}
+	if script.Turns[0].Transcript != "Hello robot" || script.Turns[1].Transcript != "" {
+		t.Errorf("Expected the .txt transcript for the first file only, got %+v", script.Turns)
+	}
+
+	scriptPath := filepath.Join(dir, "script.yaml")
+	yaml := "turns:\n  - audio: 01-hello.wav\n    reply_contains: [hi]\n"
+	if err := os.WriteFile(scriptPath, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script, err = loadReplayScript(scriptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(script.Turns) != 1 || script.Turns[0].Audio != filepath.Join(dir, "01-hello.wav") || script.Turns[0].Name != "01-hello" {
+		t.Errorf("Expected audio relative to the script, got %+v", script.Turns)
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	if got := normalizeText("  Hello,   Robot! How's it going?"); got != "hello robot hows it going" {
+		t.Errorf("Unexpected normalized text %q", got)
+	}
+}
+
+// fakeServer answers each audio message with the messages reply returns.
+func fakeServer(reply func(chunk int) []shared.Message) (func(shared.Message) error, <-chan shared.Message) {
+	incoming := make(chan shared.Message, 16)
+	chunk := 0
+	send := func(msg shared.Message) error {
+		if msg.Type == shared.MessageTypeAudio {
+			chunk++
+			for _, m := range reply(chunk) {
+				incoming <- m
+			}
+		}
+		return nil
+	}
+	return send, incoming
+}
+
+func TestReplayerRecordsTurns(t *testing.T) {
+	dir := t.TempDir()
+	audioPath := filepath.Join(dir, "hello.wav")
+	// Two and a half chunks of audio
+	writeTestWAV(t, audioPath, 16000, 1, make([]int16, 16000*5/2))
+
+	send, incoming := fakeServer(func(chunk int) []shared.Message {
+		if chunk < 3 {
+			return []shared.Message{{Type: shared.MessageTypeStatus, Data: map[string]interface{}{
+				"message": "No speech detected", "state": shared.StateIdle,
+			}}}
+		}
+		return []shared.Message{
+			{Type: shared.MessageTypeTranscript, Data: "Hello, robot."},
+			{Type: shared.MessageTypeAudio, Data: shared.AudioData{
+				AudioData: []byte("mp3 bytes"), MimeType: "audio/mpeg", Text: "Hi there!",
+			}},
+		}
+	})
+
+	out := filepath.Join(dir, "results")
+	r := &replayer{send: send, incoming: incoming, outDir: out, chunkLength: time.Second, timeout: time.Second}
+	report, err := r.run(replayScript{Turns: []replayTurn{
+		{Name: "hello", Audio: audioPath, Transcript: "hello robot", ReplyContains: []string{"hi"}},
+		{Name: "fails", Audio: audioPath, Transcript: "goodbye", ReplyContains: []string{"bye"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Passed || !report.Turns[0].Passed || report.Turns[1].Passed {
+		t.Fatalf("Expected only the first turn to pass, got %+v", report)
+	}
+	if len(report.Turns[1].Failures) != 2 {
+		t.Errorf("Expected transcript and reply failures, got %v", report.Turns[1].Failures)
+	}
+
+	saved, err := os.ReadFile(filepath.Join(out, "01-hello", "reply-1.mp3"))
+	if err != nil || string(saved) != "mp3 bytes" {
+		t.Errorf("Expected the reply audio to be saved, got %q (%v)", saved, err)
+	}
+
+	f, err := os.Open(filepath.Join(out, "01-hello", "messages.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 4 {
+		t.Fatalf("Expected every message logged, got %d lines", len(lines))
+	}
+	if !strings.Contains(lines[3], `"audio_data":null`) {
+		t.Errorf("Expected audio left out of the log, got %s", lines[3])
+	}
+
+	var written replayReport
+	data, err := os.ReadFile(filepath.Join(out, "report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &written); err != nil || len(written.Turns) != 2 {
+		t.Errorf("Expected report.json with both turns, got %s", data)
+	}
+}
+
+func TestReplayerTimesOut(t *testing.T) {
+	dir := t.TempDir()
+	audioPath := filepath.Join(dir, "silence.wav")
+	writeTestWAV(t, audioPath, 16000, 1, make([]int16, 1600))
+
+	send, incoming := fakeServer(func(int) []shared.Message { return nil })
+	r := &replayer{send: send, incoming: incoming, outDir: dir, chunkLength: time.Second, timeout: 10 * time.Millisecond}
+	report, err := r.run(replayScript{Turns: []replayTurn{{Name: "silence", Audio: audioPath}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Passed || len(report.Turns[0].Failures) != 1 {
+		t.Errorf("Expected a timeout failure, got %+v", report)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"robot-head/shared"
+)
+
+// replyTimeout is how long the REPL waits for the server to answer before
+// prompting again anyway.
+const replyTimeout = 90 * time.Second
+
+// replies is signalled by listenForMessages whenever a message arrives
+// that finishes a turn.
+var replies = make(chan struct{}, 1)
+
+func replyReceived() {
+	select {
+	case replies <- struct{}{}:
+	default:
+	}
+}
+
+// endsTurn reports whether msg is the server's answer to something we
+// sent, as opposed to a progress update or part of a stream.
+func endsTurn(msg shared.Message) bool {
+	switch msg.Type {
+	case shared.MessageTypeSession, shared.MessageTypeExpression, shared.MessageTypeTranscript:
+		return false
+	case shared.MessageTypeAudioChunk:
+		var chunk shared.AudioChunk
+		return msg.DecodeData(&chunk) == nil && chunk.Final
+	case shared.MessageTypeStatus:
+		var status shared.StatusData
+		return msg.DecodeData(&status) != nil || status.State == ""
+	default:
+		return true
+	}
+}
+
+const textHelp = `Type a message to talk to the robot, or:
+  /reset            start the conversation over
+  /persona <name>   switch persona
+  /voice <id>       use another TTS voice
+  /voice            go back to the persona's voice
+  /voices           list the available voices
+  /record on|off    let the server keep this session's turns for debugging
+  /quit             exit`
+
+// textREPL reads chat turns and slash commands, for working on prompts
+// without a microphone.
+type textREPL struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+	replies <-chan struct{}
+	timeout time.Duration
+}
+
+func newTextREPL(in io.Reader, out io.Writer, replies <-chan struct{}) *textREPL {
+	return &textREPL{
+		scanner: bufio.NewScanner(in),
+		out:     out,
+		replies: replies,
+		timeout: replyTimeout,
+	}
+}
+
+// run sends what's typed, waiting for each reply, until the input ends or
+// /quit (io.EOF) or send fails.
+func (r *textREPL) run(send func(shared.Message) error) error {
+	fmt.Fprintln(r.out, "Type /help for commands.")
+	for {
+		fmt.Fprint(r.out, "> ")
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				return err
+			}
+			return io.EOF
+		}
+
+		line := strings.TrimSpace(r.scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "/help" {
+			fmt.Fprintln(r.out, textHelp)
+			continue
+		}
+
+		msg, quit, err := parseTextCommand(line)
+		if err != nil {
+			fmt.Fprintln(r.out, err)
+			continue
+		}
+		if quit {
+			return io.EOF
+		}
+
+		// Forget replies to anything sent before this turn
+		select {
+		case <-r.replies:
+		default:
+		}
+		if err := send(msg); err != nil {
+			return err
+		}
+		select {
+		case <-r.replies:
+		case <-time.After(r.timeout):
+			fmt.Fprintln(r.out, "(no reply yet)")
+		}
+	}
+}
+
+// parseTextCommand turns a line of input into the message to send. quit
+// is set for /quit and /exit.
+func parseTextCommand(line string) (msg shared.Message, quit bool, err error) {
+	if !strings.HasPrefix(line, "/") {
+		return createUserMessage(line), false, nil
+	}
+
+	command, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch command {
+	case "/quit", "/exit":
+		return shared.Message{}, true, nil
+	case "/reset":
+		return createResetMessage(), false, nil
+	case "/persona":
+		if arg == "" {
+			return shared.Message{}, false, fmt.Errorf("usage: /persona <name>")
+		}
+		return createPersonaMessage(arg), false, nil
+	case "/voice":
+		if arg == "" {
+			return shared.Message{
+				Type:      shared.MessageTypeVoice,
+				Timestamp: time.Now().Unix(),
+				Data:      shared.VoiceData{Reset: true},
+			}, false, nil
+		}
+		return createVoiceMessage(arg), false, nil
+	case "/voices":
+		return createVoicesRequest(), false, nil
+	case "/record":
+		switch arg {
+		case "on":
+			return createRecordMessage(true), false, nil
+		case "off":
+			return createRecordMessage(false), false, nil
+		default:
+			return shared.Message{}, false, fmt.Errorf("usage: /record on|off")
+		}
+	default:
+		return shared.Message{}, false, fmt.Errorf("unknown command %s, try /help", command)
+	}
+}
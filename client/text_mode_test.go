@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+func TestParseTextCommand(t *testing.T) {
+	cases := []struct {
+		line     string
+		wantType shared.MessageType
+	}{
+		{"hello robot", shared.MessageTypeUserInput},
+		{"/reset", shared.MessageTypeReset},
+		{"/persona pirate", shared.MessageTypePersona},
+		{"/voice abc123", shared.MessageTypeVoice},
+		{"/voices", shared.MessageTypeVoices},
+		{"/record on", shared.MessageTypeRecord},
+	}
+	for _, c := range cases {
+		msg, quit, err := parseTextCommand(c.line)
+		if err != nil || quit {
+			t.Errorf("%q: unexpected quit=%v err=%v", c.line, quit, err)
+			continue
+		}
+		if msg.Type != c.wantType {
+			t.Errorf("%q: expected %v, got %v", c.line, c.wantType, msg.Type)
+		}
+	}
+
+	msg, _, _ := parseTextCommand("/persona  Pirate ")
+	if msg.Data.(shared.PersonaData).Name != "Pirate" {
+		t.Errorf("Expected the persona name to be trimmed, got %+v", msg.Data)
+	}
+	msg, _, _ = parseTextCommand("/voice")
+	if !msg.Data.(shared.VoiceData).Reset {
+		t.Error("Expected /voice on its own to reset the voice")
+	}
+	if _, quit, _ := parseTextCommand("/quit"); !quit {
+		t.Error("Expected /quit to quit")
+	}
+	for _, bad := range []string{"/persona", "/dance", "/record maybe"} {
+		if _, _, err := parseTextCommand(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestEndsTurn(t *testing.T) {
+	cases := []struct {
+		msg  shared.Message
+		want bool
+	}{
+		{shared.Message{Type: shared.MessageTypeAIResponse, Data: "hi"}, true},
+		{shared.Message{Type: shared.MessageTypeError, Data: "oops"}, true},
+		{shared.Message{Type: shared.MessageTypeStatus, Data: shared.StatusData{Message: "Conversation reset"}}, true},
+		{shared.Message{Type: shared.MessageTypeStatus, Data: shared.StatusData{State: shared.StateThinking}}, false},
+		{shared.Message{Type: shared.MessageTypeAudioChunk, Data: shared.AudioChunk{Seq: 0}}, false},
+		{shared.Message{Type: shared.MessageTypeAudioChunk, Data: shared.AudioChunk{Seq: 3, Final: true}}, true},
+		{shared.Message{Type: shared.MessageTypeExpression, Data: shared.ExpressionData{Name: "happy"}}, false},
+	}
+	for _, c := range cases {
+		if got := endsTurn(c.msg); got != c.want {
+			t.Errorf("%v %+v: expected %v, got %v", c.msg.Type, c.msg.Data, c.want, got)
+		}
+	}
+}
+
+func TestTextREPLWaitsForReplies(t *testing.T) {
+	in := strings.NewReader("hello\n/help\n\n/dance\n/reset\n")
+	var out bytes.Buffer
+	replies := make(chan struct{}, 1)
+	repl := newTextREPL(in, &out, replies)
+
+	var sent []shared.MessageType
+	err := repl.run(func(msg shared.Message) error {
+		sent = append(sent, msg.Type)
+		replies <- struct{}{} // the server answers straight away
+		return nil
+	})
+
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of input, got %v", err)
+	}
+	if len(sent) != 2 || sent[0] != shared.MessageTypeUserInput || sent[1] != shared.MessageTypeReset {
+		t.Errorf("Unexpected messages sent: %v", sent)
+	}
+	if !strings.Contains(out.String(), "/persona <name>") || !strings.Contains(out.String(), "unknown command /dance") {
+		t.Errorf("Expected help and an error in the output, got %q", out.String())
+	}
+}
+
+func TestTextREPLTimesOut(t *testing.T) {
+	var out bytes.Buffer
+	repl := newTextREPL(strings.NewReader("hello\n"), &out, make(chan struct{}))
+	repl.timeout = 10 * time.Millisecond
+
+	repl.run(func(shared.Message) error { return nil })
+	if !strings.Contains(out.String(), "(no reply yet)") {
+		t.Errorf("Expected a timeout notice, got %q", out.String())
+	}
+}
+
+func TestSaveAudio(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "replies")
+	path, err := saveAudio(dir, shared.AudioData{AudioData: []byte("mp3 bytes"), MimeType: "audio/mpeg"})
+	if err != nil {
+		t.Fatalf("saveAudio failed: %v", err)
+	}
+	if filepath.Ext(path) != ".mp3" || filepath.Dir(path) != dir {
+		t.Errorf("Unexpected path %v", path)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "mp3 bytes" {
+		t.Errorf("Unexpected file contents %q", data)
+	}
+}
+
+func TestTextModeHello(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+
+	cfg.Mode, cfg.AudioOutput = "text", "none"
+	hello := createHelloMessage("robot-1").Data.(shared.HelloData)
+	if len(hello.Capabilities) != 1 || hello.Capabilities[0] != shared.CapabilityTextInput {
+		t.Errorf("Text-only client should only ask for text, got %v", hello.Capabilities)
+	}
+}
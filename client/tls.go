@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"robot-head/shared"
+)
+
+// tlsClientConfig sets up wss:// for a server with a private CA or one that
+// wants a client certificate. It returns nil, meaning the system roots and
+// no certificate, when neither is configured.
+func tlsClientConfig(c Config) (*tls.Config, error) {
+	if c.TLSCAFile == "" && c.TLSCertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSCAFile != "" {
+		pool, err := shared.LoadCertPool(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if c.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"robot-head/shared"
+)
+
+// writeTestCert creates a certificate signed by parent, or self-signed as a
+// CA when parent is nil, and writes it and its key to dir as name.pem and
+// name-key.pem.
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{
+		name + ".pem":     {Type: "CERTIFICATE", Bytes: der},
+		name + "-key.pem": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestOpenWebsocketWithClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "server", ca, caKey)
+	writeTestCert(t, dir, "client", ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs, err := shared.LoadCertPool(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upgrader websocket.Upgrader
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			conn.Close()
+		}
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.ServerURL = strings.Replace(server.URL, "https://", "wss://", 1)
+	cfg.TLSCAFile = filepath.Join(dir, "ca.pem")
+
+	if conn, err := openWebsocket(); err == nil {
+		conn.Close()
+		t.Error("Expected the server to refuse a client without a certificate")
+	}
+
+	cfg.TLSCertFile = filepath.Join(dir, "client.pem")
+	cfg.TLSKeyFile = filepath.Join(dir, "client-key.pem")
+	conn, err := openWebsocket()
+	if err != nil {
+		t.Fatalf("Expected to connect with the client certificate: %v", err)
+	}
+	conn.Close()
+}
+
+func TestLoadConfigTLSValidation(t *testing.T) {
+	for name, args := range map[string][]string{
+		"plain ws":    {"--server", "ws://localhost:9001/ws", "--tls-ca", "ca.pem"},
+		"cert no key": {"--server", "wss://localhost:9001/ws", "--tls-cert", "client.pem"},
+	} {
+		if _, _, err := loadConfig(args, io.Discard); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, _, err := loadConfig([]string{"--server", "wss://localhost:9001/ws", "--tls-ca", "ca.pem"}, io.Discard); err != nil {
+		t.Errorf("Expected a CA file with wss:// to be accepted: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+
+	"github.com/gopxl/beep"
+
+	"robot-head/client/visualizer"
+	"robot-head/shared"
+)
+
+// visual is the running visualizer, nil when it's turned off.
+var visual *visualizer.Visualizer
+
+// newDisplay builds the display named in the config.
+func newDisplay(config Config) (visualizer.Display, error) {
+	switch config.Visualizer {
+	case "terminal":
+		return visualizer.NewTerminalDisplay(os.Stdout, config.MatrixWidth, config.MatrixHeight), nil
+	case "png":
+		return visualizer.NewPNGDisplay(config.FrameDir, config.MatrixWidth, config.MatrixHeight, 8)
+	case "device":
+		return visualizer.OpenDevice(config.LEDDevice, config.MatrixWidth, config.MatrixHeight, visualizer.DeviceOptions{
+			Protocol:   config.LEDProtocol,
+			Brightness: config.LEDBrightness,
+			Gamma:      config.LEDGamma,
+			Rotate:     config.LEDRotate,
+			MirrorX:    config.LEDMirrorX,
+			MirrorY:    config.LEDMirrorY,
+			Serpentine: config.LEDSerpentine,
+			Baud:       config.LEDBaud,
+		})
+	default:
+		return nil, fmt.Errorf("unknown visualizer %q", config.Visualizer)
+	}
+}
+
+// startVisualizer sets up the configured visualizer and runs it until ctx
+// is cancelled. It does nothing when the visualizer is off.
+func startVisualizer(ctx context.Context, config Config) error {
+	if config.Visualizer == "" || config.Visualizer == "none" {
+		return nil
+	}
+
+	display, err := newDisplay(config)
+	if err != nil {
+		return err
+	}
+
+	render := visualizer.SpectrumBars
+	switch config.VisualizerStyle {
+	case "mouth":
+		render = visualizer.Mouth
+	case "face":
+		render = visualizer.Face
+	}
+
+	animations, err := visualizer.LoadAnimations(config.AnimationsFile, config.MatrixWidth, config.MatrixHeight)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("No animations file, showing a blank face between replies", "path", config.AnimationsFile)
+	} else if err != nil {
+		display.Close()
+		return err
+	}
+
+	visual = visualizer.New(display, visualizer.Options{
+		SampleRate: int(playbackSampleRate),
+		FPS:        config.VisualizerFPS,
+		Render:     render,
+		Animations: animations,
+	})
+	visual.SetState(shared.StateIdle)
+	go func() {
+		visual.Run(ctx)
+		visual.Close()
+	}()
+	return nil
+}
+
+// setState shows what the robot is doing on the visualizer, if there is
+// one running.
+func setState(state string) {
+	if visual != nil {
+		visual.SetState(state)
+	}
+}
+
+// visualState returns the visualizer's state, idle when there's no
+// visualizer.
+func visualState() string {
+	if visual == nil {
+		return shared.StateIdle
+	}
+	return visual.State()
+}
+
+// showVisemes hands the viseme timeline for the next reply to the
+// visualizer, if there is one running.
+func showVisemes(cues []shared.VisemeCue) {
+	if visual == nil {
+		return
+	}
+	timeline := make([]visualizer.Cue, len(cues))
+	for i, cue := range cues {
+		timeline[i] = visualizer.Cue{Viseme: cue.Viseme, Start: cue.Start, End: cue.End}
+	}
+	visual.SetVisemes(timeline)
+}
+
+// visualTap passes audio through to the speaker while feeding a mono copy
+// to the visualizer.
+type visualTap struct {
+	beep.Streamer
+	v    *visualizer.Visualizer
+	mono []float64
+}
+
+func (t *visualTap) Stream(samples [][2]float64) (int, bool) {
+	n, ok := t.Streamer.Stream(samples)
+	if n > 0 {
+		t.mono = t.mono[:0]
+		for _, s := range samples[:n] {
+			t.mono = append(t.mono, (s[0]+s[1])/2)
+		}
+		t.v.Push(t.mono)
+	}
+	return n, ok
+}
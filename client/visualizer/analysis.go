@@ -0,0 +1,123 @@
+package visualizer
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// Levels is the analysis of one frame's worth of audio.
+type Levels struct {
+	// RMS is the loudness of the window, 0 (silence) to 1 (full scale).
+	RMS float64
+	// Bands are the energies of log-spaced frequency bands, low to high,
+	// each scaled to 0..1.
+	Bands []float64
+	// Viseme is the mouth shape being spoken, empty when there's no
+	// timeline for the audio.
+	Viseme string
+	// Expression is the face the robot is pulling, empty for neutral.
+	Expression string
+}
+
+const (
+	fftSize     = 1024
+	minBandFreq = 60.0
+	maxBandFreq = 8000.0
+	// Band energies below floorDB show as 0.
+	floorDB = -60.0
+)
+
+// Analyze computes the loudness and frequency bands of mono samples in the
+// range -1..1.
+func Analyze(samples []float64, sampleRate, bands int) Levels {
+	return Levels{
+		RMS:   rms(samples),
+		Bands: spectrumBands(samples, sampleRate, bands),
+	}
+}
+
+func rms(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, s := range samples {
+		sum += s * s
+	}
+	return math.Min(1, math.Sqrt(sum/float64(len(samples))))
+}
+
+// spectrumBands runs an FFT over the last fftSize samples and sums the bins
+// into bands spaced evenly on a log scale, which is roughly how we hear.
+func spectrumBands(samples []float64, sampleRate, bands int) []float64 {
+	levels := make([]float64, bands)
+	if bands == 0 || len(samples) == 0 || sampleRate == 0 {
+		return levels
+	}
+
+	if len(samples) > fftSize {
+		samples = samples[len(samples)-fftSize:]
+	}
+	// Hann window to stop the edges of the window smearing into every bin
+	buf := make([]complex128, fftSize)
+	for i, s := range samples {
+		w := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(len(samples)-1))
+		buf[i] = complex(s*w, 0)
+	}
+	fft(buf)
+
+	binHz := float64(sampleRate) / fftSize
+	maxFreq := math.Min(maxBandFreq, float64(sampleRate)/2)
+	ratio := math.Pow(maxFreq/minBandFreq, 1/float64(bands))
+	for b := 0; b < bands; b++ {
+		lo := minBandFreq * math.Pow(ratio, float64(b))
+		hi := lo * ratio
+		loBin := int(lo / binHz)
+		hiBin := int(math.Ceil(hi / binHz))
+		if hiBin <= loBin {
+			hiBin = loBin + 1
+		}
+
+		peak := 0.0
+		for i := loBin; i < hiBin && i < fftSize/2; i++ {
+			// Scale so a full-scale sine lands near 0 dB
+			mag := cmplx.Abs(buf[i]) / (fftSize / 4)
+			peak = math.Max(peak, mag)
+		}
+		if peak <= 0 {
+			continue
+		}
+		db := 20 * math.Log10(peak)
+		levels[b] = math.Max(0, math.Min(1, (db-floorDB)/-floorDB))
+	}
+	return levels
+}
+
+// fft is an in-place radix-2 Cooley-Tukey transform. len(a) must be a power
+// of two.
+func fft(a []complex128) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := a[start+k]
+				odd := a[start+k+size/2] * w
+				a[start+k] = even + odd
+				a[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package visualizer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Animation is a canned sequence of frames, such as the idle or thinking
+// loops shown between replies.
+type Animation struct {
+	FPS    int
+	Loop   bool
+	Frames []Frame
+}
+
+// index returns which frame to show after elapsed. Animations that don't
+// loop hold their last frame.
+func (a Animation) index(elapsed time.Duration) int {
+	i := int(elapsed * time.Duration(a.FPS) / time.Second)
+	if a.Loop {
+		return i % len(a.Frames)
+	}
+	if i >= len(a.Frames) {
+		return len(a.Frames) - 1
+	}
+	return i
+}
+
+// animationFile is the layout of the animations YAML file. Frames are
+// drawn as rows of characters, each looked up in the palette; '.' and ' '
+// are off. Frames smaller than the matrix are centred on it.
+type animationFile struct {
+	Palette    map[string]string        `yaml:"palette"`
+	Animations map[string]animationSpec `yaml:"animations"`
+}
+
+type animationSpec struct {
+	FPS     int               `yaml:"fps"`
+	Loop    bool              `yaml:"loop"`
+	Palette map[string]string `yaml:"palette"`
+	Frames  []string          `yaml:"frames"`
+}
+
+// LoadAnimations reads an animations file and draws its frames for a
+// width x height matrix.
+func LoadAnimations(path string, width, height int) (map[string]Animation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read animations file: %w", err)
+	}
+	animations, err := ParseAnimations(data, width, height)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return animations, nil
+}
+
+// ParseAnimations is LoadAnimations for data already in memory.
+func ParseAnimations(data []byte, width, height int) (map[string]Animation, error) {
+	var file animationFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("could not parse animations: %w", err)
+	}
+
+	base, err := parsePalette(file.Palette)
+	if err != nil {
+		return nil, err
+	}
+
+	animations := make(map[string]Animation, len(file.Animations))
+	for name, spec := range file.Animations {
+		if len(spec.Frames) == 0 {
+			return nil, fmt.Errorf("animation %q has no frames", name)
+		}
+		if spec.FPS <= 0 {
+			return nil, fmt.Errorf("animation %q needs a positive fps", name)
+		}
+
+		palette, err := parsePalette(spec.Palette)
+		if err != nil {
+			return nil, fmt.Errorf("animation %q: %w", name, err)
+		}
+		for key, c := range base {
+			if _, ok := palette[key]; !ok {
+				palette[key] = c
+			}
+		}
+
+		animation := Animation{FPS: spec.FPS, Loop: spec.Loop}
+		for i, drawing := range spec.Frames {
+			frame, err := drawFrame(drawing, palette, width, height)
+			if err != nil {
+				return nil, fmt.Errorf("animation %q frame %d: %w", name, i+1, err)
+			}
+			animation.Frames = append(animation.Frames, frame)
+		}
+		animations[name] = animation
+	}
+	return animations, nil
+}
+
+func parsePalette(spec map[string]string) (map[rune]Color, error) {
+	palette := make(map[rune]Color, len(spec))
+	for key, value := range spec {
+		runes := []rune(key)
+		if len(runes) != 1 {
+			return nil, fmt.Errorf("palette key %q must be a single character", key)
+		}
+		c, err := parseColor(value)
+		if err != nil {
+			return nil, fmt.Errorf("palette %q: %w", key, err)
+		}
+		palette[runes[0]] = c
+	}
+	return palette, nil
+}
+
+// parseColor reads a "#rrggbb" colour.
+func parseColor(s string) (Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return Color{}, fmt.Errorf("colour %q must look like #rrggbb", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return Color{}, fmt.Errorf("colour %q must look like #rrggbb", s)
+	}
+	return Color{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v)}, nil
+}
+
+func drawFrame(drawing string, palette map[rune]Color, width, height int) (Frame, error) {
+	rows := strings.Split(strings.Trim(drawing, "\n"), "\n")
+	columns := 0
+	for _, row := range rows {
+		if n := len([]rune(row)); n > columns {
+			columns = n
+		}
+	}
+	if len(rows) > height || columns > width {
+		return Frame{}, fmt.Errorf("%dx%d drawing doesn't fit a %dx%d matrix", columns, len(rows), width, height)
+	}
+
+	frame := NewFrame(width, height)
+	left, top := (width-columns)/2, (height-len(rows))/2
+	for y, row := range rows {
+		for x, ch := range []rune(row) {
+			if ch == '.' || ch == ' ' {
+				continue
+			}
+			c, ok := palette[ch]
+			if !ok {
+				return Frame{}, fmt.Errorf("%q is not in the palette", ch)
+			}
+			frame.Set(left+x, top+y, c)
+		}
+	}
+	return frame, nil
+}
@@ -0,0 +1,112 @@
+package visualizer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAnimations = `
+palette:
+  r: "#ff0000"
+animations:
+  blink:
+    fps: 2
+    loop: true
+    palette:
+      g: "#00ff00"
+    frames:
+      - |
+        r.g
+      - "..."
+  once:
+    fps: 10
+    frames: ["r", "rr"]
+`
+
+func TestParseAnimations(t *testing.T) {
+	animations, err := ParseAnimations([]byte(testAnimations), 5, 3)
+	if err != nil {
+		t.Fatalf("ParseAnimations failed: %v", err)
+	}
+
+	blink := animations["blink"]
+	if blink.FPS != 2 || !blink.Loop || len(blink.Frames) != 2 {
+		t.Fatalf("Unexpected animation %+v", blink)
+	}
+	// The 3x1 drawing is centred on the 5x3 matrix
+	first := blink.Frames[0]
+	if first.At(1, 1) != (Color{R: 255}) || first.At(3, 1) != (Color{G: 255}) {
+		t.Errorf("Drawing wasn't placed or coloured as expected")
+	}
+	if first.At(2, 1) != Black || first.At(0, 0) != Black {
+		t.Errorf("Off pixels should be black")
+	}
+}
+
+func TestAnimationIndex(t *testing.T) {
+	animations, err := ParseAnimations([]byte(testAnimations), 5, 3)
+	if err != nil {
+		t.Fatalf("ParseAnimations failed: %v", err)
+	}
+
+	blink := animations["blink"]
+	if got := blink.index(1500 * time.Millisecond); got != 1 {
+		t.Errorf("Expected frame 1 after 1.5s at 2fps, got %d", got)
+	}
+	if got := blink.index(2 * time.Second); got != 0 {
+		t.Errorf("Looping animation should wrap, got frame %d", got)
+	}
+	if got := animations["once"].index(time.Second); got != 1 {
+		t.Errorf("Animation that doesn't loop should hold its last frame, got %d", got)
+	}
+}
+
+func TestParseAnimationsErrors(t *testing.T) {
+	cases := map[string]string{
+		"palette":          "animations:\n  a:\n    fps: 1\n    frames: [\"x\"]\n",
+		"fps":              "palette: {r: \"#ff0000\"}\nanimations:\n  a:\n    frames: [\"r\"]\n",
+		"frames":           "animations:\n  a:\n    fps: 1\n",
+		"fit":              "palette: {r: \"#ff0000\"}\nanimations:\n  a:\n    fps: 1\n    frames: [\"rrrrrr\"]\n",
+		"#rrggbb":          "palette: {r: \"red\"}\n",
+		"single character": "palette: {rr: \"#ff0000\"}\n",
+	}
+	for want, data := range cases {
+		_, err := ParseAnimations([]byte(data), 5, 3)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error mentioning %q, got %v", want, err)
+		}
+	}
+}
+
+func TestShippedAnimationsLoad(t *testing.T) {
+	animations, err := LoadAnimations("../../animations.yaml", 16, 16)
+	if err != nil {
+		t.Fatalf("Shipped animations don't load: %v", err)
+	}
+	for _, state := range []string{"idle", "listening", "transcribing", "thinking", "speaking", "error"} {
+		if _, ok := animations[state]; !ok {
+			t.Errorf("No animation for %q", state)
+		}
+	}
+}
+
+func TestIdleShowsStateAnimation(t *testing.T) {
+	animations, err := ParseAnimations([]byte(testAnimations), 5, 3)
+	if err != nil {
+		t.Fatalf("ParseAnimations failed: %v", err)
+	}
+	v := New(NewTerminalDisplay(&bytes.Buffer{}, 5, 3), Options{Animations: animations, Render: Mouth})
+
+	v.SetState("blink")
+	if frame := v.idleFrame(v.idleView(time.Now())); !sameFrame(frame, animations["blink"].Frames[0]) {
+		t.Error("Expected the first frame of the state's animation")
+	}
+
+	v.SetState("unknown")
+	view := v.idleView(time.Now())
+	if view.index != -1 {
+		t.Errorf("States without an animation should fall back to the renderer, got %+v", view)
+	}
+}
@@ -0,0 +1,297 @@
+package visualizer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Protocols a DeviceDisplay can speak.
+const (
+	// ProtocolSerial sends whole frames to a microcontroller, framed as
+	//
+	//	0xAA 0x55 width height R G B ... checksum
+	//
+	// with pixels row by row from the top left and checksum the XOR of the
+	// pixel bytes.
+	ProtocolSerial = "serial"
+	// ProtocolWS2812 drives a WS2812 (NeoPixel) chain from an SPI bus, three
+	// SPI bits per LED bit at 2.4MHz.
+	ProtocolWS2812 = "ws2812"
+	// ProtocolMAX7219 drives a chain of MAX7219 8x8 modules side by side.
+	// LEDs are on or off, lit when the pixel is at least half bright.
+	ProtocolMAX7219 = "max7219"
+)
+
+// DeviceOptions describe how the LED hardware is wired.
+type DeviceOptions struct {
+	Protocol string
+	// Brightness scales every pixel, 0 to 1.
+	Brightness float64
+	// Gamma corrects for LEDs looking too bright at low values. 1 leaves
+	// values alone; 2.2 suits most RGB LEDs.
+	Gamma float64
+	// Rotate turns the picture clockwise by 0, 90, 180 or 270 degrees.
+	Rotate int
+	// MirrorX and MirrorY flip the picture after rotating it.
+	MirrorX, MirrorY bool
+	// Serpentine is for WS2812 matrices wired in a zigzag, every other row
+	// running right to left.
+	Serpentine bool
+	// Baud is the serial line speed. Zero leaves the port as it is.
+	Baud int
+}
+
+// DeviceDisplay shows frames on real LEDs by writing to a device file such
+// as /dev/ttyUSB0 or /dev/spidev0.0.
+type DeviceDisplay struct {
+	w io.WriteCloser
+	// width and height are the panel as wired, before rotation
+	width, height int
+	opts          DeviceOptions
+	levels        [256]byte
+}
+
+// OpenDevice opens the device at path for a width x height panel and
+// sets it up for the protocol where the OS allows it.
+func OpenDevice(path string, width, height int, opts DeviceOptions) (*DeviceDisplay, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open LED device: %w", err)
+	}
+	if err := configureDevice(f, opts); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not set up %s: %w", path, err)
+	}
+	d, err := NewDeviceDisplay(f, width, height, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewDeviceDisplay writes frames for a width x height panel to w.
+func NewDeviceDisplay(w io.WriteCloser, width, height int, opts DeviceOptions) (*DeviceDisplay, error) {
+	switch opts.Protocol {
+	case ProtocolSerial, ProtocolWS2812:
+		if width > 255 || height > 255 {
+			return nil, fmt.Errorf("%s panels are limited to 255x255", opts.Protocol)
+		}
+	case ProtocolMAX7219:
+		if width%8 != 0 || height != 8 {
+			return nil, fmt.Errorf("max7219 panels must be 8 high and a multiple of 8 wide, got %dx%d", width, height)
+		}
+	default:
+		return nil, fmt.Errorf("unknown LED protocol %q", opts.Protocol)
+	}
+	switch opts.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		return nil, fmt.Errorf("rotation must be 0, 90, 180 or 270, got %d", opts.Rotate)
+	}
+	if opts.Brightness < 0 || opts.Brightness > 1 {
+		return nil, fmt.Errorf("brightness must be between 0 and 1")
+	}
+	if opts.Gamma <= 0 {
+		return nil, fmt.Errorf("gamma must be positive")
+	}
+
+	d := &DeviceDisplay{w: w, width: width, height: height, opts: opts}
+	// MAX7219s set their brightness in hardware, see initMAX7219
+	scale := opts.Brightness
+	if opts.Protocol == ProtocolMAX7219 {
+		scale = 1
+	}
+	for i := range d.levels {
+		d.levels[i] = byte(math.Round(255 * scale * math.Pow(float64(i)/255, opts.Gamma)))
+	}
+
+	if opts.Protocol == ProtocolMAX7219 {
+		if err := d.initMAX7219(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Size is the picture size, which is the panel turned on its side for 90
+// and 270 degree rotations.
+func (d *DeviceDisplay) Size() (int, int) {
+	if d.opts.Rotate == 90 || d.opts.Rotate == 270 {
+		return d.height, d.width
+	}
+	return d.width, d.height
+}
+
+func (d *DeviceDisplay) Show(frame Frame) error {
+	panel := d.toPanel(frame)
+	switch d.opts.Protocol {
+	case ProtocolSerial:
+		return d.write(d.encodeSerial(panel))
+	case ProtocolWS2812:
+		return d.write(d.encodeWS2812(panel))
+	default:
+		// Each row is its own SPI transfer so the modules latch it
+		for _, row := range d.encodeMAX7219(panel) {
+			if err := d.write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Close blanks the LEDs and closes the device.
+func (d *DeviceDisplay) Close() error {
+	blank := d.Show(NewFrame(d.Size()))
+	if err := d.w.Close(); err != nil {
+		return err
+	}
+	return blank
+}
+
+func (d *DeviceDisplay) write(data []byte) error {
+	_, err := d.w.Write(data)
+	return err
+}
+
+// toPanel rotates and mirrors the picture onto the panel and applies
+// brightness and gamma.
+func (d *DeviceDisplay) toPanel(frame Frame) Frame {
+	panel := NewFrame(d.width, d.height)
+	for y := 0; y < frame.Height; y++ {
+		for x := 0; x < frame.Width; x++ {
+			var px, py int
+			switch d.opts.Rotate {
+			case 90:
+				px, py = d.width-1-y, x
+			case 180:
+				px, py = d.width-1-x, d.height-1-y
+			case 270:
+				px, py = y, d.height-1-x
+			default:
+				px, py = x, y
+			}
+			if d.opts.MirrorX {
+				px = d.width - 1 - px
+			}
+			if d.opts.MirrorY {
+				py = d.height - 1 - py
+			}
+			c := frame.At(x, y)
+			panel.Set(px, py, Color{R: d.levels[c.R], G: d.levels[c.G], B: d.levels[c.B]})
+		}
+	}
+	return panel
+}
+
+func (d *DeviceDisplay) encodeSerial(panel Frame) []byte {
+	data := make([]byte, 0, 5+len(panel.Pixels)*3)
+	data = append(data, 0xAA, 0x55, byte(panel.Width), byte(panel.Height))
+	var checksum byte
+	for _, c := range panel.Pixels {
+		data = append(data, c.R, c.G, c.B)
+		checksum ^= c.R ^ c.G ^ c.B
+	}
+	return append(data, checksum)
+}
+
+// ws2812ResetBytes of zeros hold the line low long enough (>50us at
+// 2.4MHz) for the LEDs to latch.
+const ws2812ResetBytes = 24
+
+func (d *DeviceDisplay) encodeWS2812(panel Frame) []byte {
+	data := make([]byte, 0, len(panel.Pixels)*9+ws2812ResetBytes)
+	for y := 0; y < panel.Height; y++ {
+		for i := 0; i < panel.Width; i++ {
+			x := i
+			if d.opts.Serpentine && y%2 == 1 {
+				x = panel.Width - 1 - i
+			}
+			c := panel.At(x, y)
+			// WS2812s want green first
+			for _, v := range []byte{c.G, c.R, c.B} {
+				data = append(data, ws2812Bits(v)...)
+			}
+		}
+	}
+	return append(data, make([]byte, ws2812ResetBytes)...)
+}
+
+// ws2812Bits spreads a byte over three SPI bytes: a 1 is sent as 110 and a
+// 0 as 100, which at 2.4MHz gives the LED's pulse timings.
+func ws2812Bits(v byte) []byte {
+	var bits uint32
+	for i := 7; i >= 0; i-- {
+		bits <<= 3
+		if v&(1<<i) != 0 {
+			bits |= 0b110
+		} else {
+			bits |= 0b100
+		}
+	}
+	return []byte{byte(bits >> 16), byte(bits >> 8), byte(bits)}
+}
+
+// MAX7219 registers.
+const (
+	max7219DecodeMode  = 0x09
+	max7219Intensity   = 0x0A
+	max7219ScanLimit   = 0x0B
+	max7219Shutdown    = 0x0C
+	max7219DisplayTest = 0x0F
+)
+
+// initMAX7219 wakes the modules up and sets their brightness.
+func (d *DeviceDisplay) initMAX7219() error {
+	intensity := byte(math.Round(d.opts.Brightness * 15))
+	settings := [][2]byte{
+		{max7219DisplayTest, 0},
+		{max7219DecodeMode, 0},
+		{max7219ScanLimit, 7},
+		{max7219Intensity, intensity},
+		{max7219Shutdown, 1},
+	}
+	for _, s := range settings {
+		if err := d.write(d.max7219All(s[0], s[1])); err != nil {
+			return fmt.Errorf("could not set up max7219: %w", err)
+		}
+	}
+	return nil
+}
+
+// max7219All sends the same register write to every module.
+func (d *DeviceDisplay) max7219All(register, value byte) []byte {
+	modules := d.width / 8
+	data := make([]byte, 0, modules*2)
+	for i := 0; i < modules; i++ {
+		data = append(data, register, value)
+	}
+	return data
+}
+
+// encodeMAX7219 returns one transfer per row. Data shifts through the
+// chain, so the rightmost module's bytes go first.
+func (d *DeviceDisplay) encodeMAX7219(panel Frame) [][]byte {
+	modules := d.width / 8
+	threshold := max(d.levels[128], 1)
+	rows := make([][]byte, 0, 8)
+	for y := 0; y < 8; y++ {
+		row := make([]byte, 0, modules*2)
+		for m := modules - 1; m >= 0; m-- {
+			var bits byte
+			for i := 0; i < 8; i++ {
+				c := panel.At(m*8+i, y)
+				if max(c.R, c.G, c.B) >= threshold {
+					bits |= 0x80 >> i
+				}
+			}
+			// Digit registers 1-8 hold the rows
+			row = append(row, byte(y+1), bits)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
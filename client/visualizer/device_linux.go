@@ -0,0 +1,76 @@
+package visualizer
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// spiMaxSpeed is SPI_IOC_WR_MAX_SPEED_HZ from linux/spi/spidev.h.
+const spiMaxSpeed = 0x40046b04
+
+// ws2812SPIHz gives WS2812 timings with three SPI bits per LED bit.
+const ws2812SPIHz = 2400000
+
+var baudRates = map[int]uint32{
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	2000000: unix.B2000000,
+}
+
+// configureDevice puts serial ports into raw mode, so frame bytes aren't
+// mangled by the terminal driver, and sets the SPI clock for WS2812s.
+// Regular files are left alone, which is what tests rely on.
+func configureDevice(f *os.File, opts DeviceOptions) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+
+	fd := int(f.Fd())
+	switch opts.Protocol {
+	case ProtocolSerial:
+		return configureSerial(fd, opts.Baud)
+	case ProtocolWS2812:
+		if err := unix.IoctlSetPointerInt(fd, spiMaxSpeed, ws2812SPIHz); err != nil {
+			return fmt.Errorf("could not set SPI speed: %w", err)
+		}
+	}
+	return nil
+}
+
+func configureSerial(fd int, baud int) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return fmt.Errorf("not a serial port: %w", err)
+	}
+
+	// The same as cfmakeraw(3)
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+
+	if baud != 0 {
+		rate, ok := baudRates[baud]
+		if !ok {
+			return fmt.Errorf("unsupported baud rate %d", baud)
+		}
+		t.Cflag &^= unix.CBAUD
+		t.Cflag |= rate
+		t.Ispeed, t.Ospeed = rate, rate
+	}
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
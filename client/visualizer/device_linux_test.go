@@ -0,0 +1,58 @@
+package visualizer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY returns the master side and the path of the slave.
+func openPTY(t *testing.T) (*os.File, string) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("No pseudo-terminals here: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Skipf("Couldn't unlock pty: %v", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Skipf("Couldn't find pty number: %v", err)
+	}
+	return master, "/dev/pts/" + strconv.Itoa(n)
+}
+
+func TestSerialFrameOnPTY(t *testing.T) {
+	master, slave := openPTY(t)
+
+	d, err := OpenDevice(slave, 4, 1, DeviceOptions{Protocol: ProtocolSerial, Brightness: 1, Gamma: 1, Baud: 115200})
+	if err != nil {
+		t.Fatalf("OpenDevice failed: %v", err)
+	}
+	defer d.Close()
+
+	// Bytes that a terminal in cooked mode would translate
+	frame := NewFrame(4, 1)
+	frame.Set(0, 0, Color{R: '\n', G: '\r', B: 0x03})
+	frame.Set(1, 0, Color{R: 0x7f, G: 0x11, B: 0x13})
+	if err := d.Show(frame); err != nil {
+		t.Fatalf("Show failed: %v", err)
+	}
+
+	want := d.encodeSerial(d.toPanel(frame))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(master, got); err != nil {
+		t.Fatalf("Reading the pty failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected raw frame % x, got % x", want, got)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package visualizer
+
+import "os"
+
+// configureDevice does nothing outside Linux; set the port up with stty
+// before starting the client.
+func configureDevice(f *os.File, opts DeviceOptions) error {
+	return nil
+}
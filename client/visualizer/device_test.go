@@ -0,0 +1,187 @@
+package visualizer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeRecorder records writes to a buffer, one entry per Write call.
+type writeRecorder struct {
+	writes [][]byte
+	closed bool
+}
+
+func (r *writeRecorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (r *writeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func plain(protocol string) DeviceOptions {
+	return DeviceOptions{Protocol: protocol, Brightness: 1, Gamma: 1}
+}
+
+func TestSerialFrameOnRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leds")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := OpenDevice(path, 2, 1, plain(ProtocolSerial))
+	if err != nil {
+		t.Fatalf("OpenDevice failed: %v", err)
+	}
+	frame := NewFrame(2, 1)
+	frame.Set(0, 0, Color{R: 1, G: 2, B: 3})
+	frame.Set(1, 0, Color{R: 4, G: 5, B: 6})
+	if err := d.Show(frame); err != nil {
+		t.Fatalf("Show failed: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0xAA, 0x55, 2, 1, 1, 2, 3, 4, 5, 6, 1 ^ 2 ^ 3 ^ 4 ^ 5 ^ 6}
+	if !bytes.HasPrefix(written, want) {
+		t.Errorf("Expected frame % x, got % x", want, written)
+	}
+	blank := []byte{0xAA, 0x55, 2, 1, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(written[len(want):], blank) {
+		t.Errorf("Expected Close to blank the LEDs, got % x", written[len(want):])
+	}
+}
+
+func TestRotationAndMirroring(t *testing.T) {
+	// A 3x2 panel with the top left pixel of the picture lit
+	cases := []struct {
+		opts       DeviceOptions
+		x, y, w, h int
+	}{
+		{DeviceOptions{}, 0, 0, 3, 2},
+		{DeviceOptions{Rotate: 90}, 2, 0, 2, 3},
+		{DeviceOptions{Rotate: 180}, 2, 1, 3, 2},
+		{DeviceOptions{Rotate: 270}, 0, 1, 2, 3},
+		{DeviceOptions{MirrorX: true}, 2, 0, 3, 2},
+		{DeviceOptions{MirrorY: true}, 0, 1, 3, 2},
+	}
+	for _, c := range cases {
+		opts := c.opts
+		opts.Protocol, opts.Brightness, opts.Gamma = ProtocolSerial, 1, 1
+		d, err := NewDeviceDisplay(&writeRecorder{}, 3, 2, opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", c.opts, err)
+		}
+		if w, h := d.Size(); w != c.w || h != c.h {
+			t.Errorf("%+v: expected a %dx%d picture, got %dx%d", c.opts, c.w, c.h, w, h)
+		}
+
+		frame := NewFrame(d.Size())
+		frame.Set(0, 0, Color{R: 255})
+		panel := d.toPanel(frame)
+		if panel.At(c.x, c.y) != (Color{R: 255}) {
+			t.Errorf("%+v: expected the pixel at %d,%d on the panel", c.opts, c.x, c.y)
+		}
+	}
+}
+
+func TestBrightnessAndGamma(t *testing.T) {
+	d, err := NewDeviceDisplay(&writeRecorder{}, 1, 1, DeviceOptions{Protocol: ProtocolSerial, Brightness: 0.5, Gamma: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := NewFrame(1, 1)
+	frame.Set(0, 0, Color{R: 255, G: 128})
+	got := d.toPanel(frame).At(0, 0)
+	// 255 -> 0.5*255, 128 -> 0.5*255*(128/255)^2
+	if got.R != 128 || got.G != 32 || got.B != 0 {
+		t.Errorf("Unexpected corrected colour %+v", got)
+	}
+}
+
+func TestWS2812Encoding(t *testing.T) {
+	if got := ws2812Bits(0x80); !bytes.Equal(got, []byte{0b11010010, 0b01001001, 0b00100100}) {
+		t.Errorf("Unexpected bits for 0x80: %08b", got)
+	}
+
+	opts := plain(ProtocolWS2812)
+	opts.Serpentine = true
+	recorder := &writeRecorder{}
+	d, err := NewDeviceDisplay(recorder, 2, 2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := NewFrame(2, 2)
+	frame.Set(1, 1, Color{G: 255})
+	if err := d.Show(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	data := recorder.writes[0]
+	if len(data) != 4*9+ws2812ResetBytes {
+		t.Fatalf("Unexpected length %d", len(data))
+	}
+	// The zigzag makes the bottom right pixel the third LED, green first
+	if !bytes.Equal(data[2*9:2*9+3], ws2812Bits(255)) {
+		t.Errorf("Expected the third LED to be green, got % x", data[2*9:3*9])
+	}
+}
+
+func TestMAX7219Encoding(t *testing.T) {
+	recorder := &writeRecorder{}
+	opts := plain(ProtocolMAX7219)
+	opts.Brightness = 0.2
+	d, err := NewDeviceDisplay(recorder, 16, 8, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.writes) != 5 {
+		t.Fatalf("Expected 5 setup writes, got %d", len(recorder.writes))
+	}
+	if !bytes.Equal(recorder.writes[3], []byte{max7219Intensity, 3, max7219Intensity, 3}) {
+		t.Errorf("Unexpected intensity setup % x", recorder.writes[3])
+	}
+
+	recorder.writes = nil
+	frame := NewFrame(16, 8)
+	frame.Set(0, 0, Color{R: 255})  // first module, first LED
+	frame.Set(15, 0, Color{B: 200}) // second module, last LED
+	frame.Set(1, 0, Color{G: 50})   // too dim to light
+	if err := d.Show(frame); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.writes) != 8 {
+		t.Fatalf("Expected a write per row, got %d", len(recorder.writes))
+	}
+	// The far module's data goes first
+	if !bytes.Equal(recorder.writes[0], []byte{1, 0x01, 1, 0x80}) {
+		t.Errorf("Unexpected first row % x", recorder.writes[0])
+	}
+}
+
+func TestNewDeviceDisplayValidates(t *testing.T) {
+	bad := []struct {
+		width, height int
+		opts          DeviceOptions
+	}{
+		{8, 8, DeviceOptions{Protocol: "hdmi", Brightness: 1, Gamma: 1}},
+		{12, 8, plain(ProtocolMAX7219)},
+		{8, 8, DeviceOptions{Protocol: ProtocolSerial, Brightness: 2, Gamma: 1}},
+		{8, 8, DeviceOptions{Protocol: ProtocolSerial, Brightness: 1}},
+		{8, 8, DeviceOptions{Protocol: ProtocolSerial, Brightness: 1, Gamma: 1, Rotate: 45}},
+	}
+	for _, b := range bad {
+		if _, err := NewDeviceDisplay(&writeRecorder{}, b.width, b.height, b.opts); err == nil {
+			t.Errorf("Expected an error for %dx%d %+v", b.width, b.height, b.opts)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package visualizer
+
+import (
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Display shows frames. Implementations should be cheap enough to call at
+// the visualizer's frame rate.
+type Display interface {
+	// Size reports the LED grid the display expects.
+	Size() (width, height int)
+	Show(frame Frame) error
+	Close() error
+}
+
+// TerminalDisplay draws frames in the terminal with 24-bit ANSI colours,
+// two characters per LED so the grid looks square.
+type TerminalDisplay struct {
+	w             io.Writer
+	width, height int
+	drawn         bool
+}
+
+func NewTerminalDisplay(w io.Writer, width, height int) *TerminalDisplay {
+	return &TerminalDisplay{w: w, width: width, height: height}
+}
+
+func (d *TerminalDisplay) Size() (int, int) { return d.width, d.height }
+
+func (d *TerminalDisplay) Show(frame Frame) error {
+	var b strings.Builder
+	if d.drawn {
+		// Move back up over the previous frame instead of scrolling
+		fmt.Fprintf(&b, "\x1b[%dA", frame.Height)
+	}
+	for y := 0; y < frame.Height; y++ {
+		for x := 0; x < frame.Width; x++ {
+			c := frame.At(x, y)
+			fmt.Fprintf(&b, "\x1b[38;2;%d;%d;%dm██", c.R, c.G, c.B)
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	d.drawn = true
+	_, err := io.WriteString(d.w, b.String())
+	return err
+}
+
+func (d *TerminalDisplay) Close() error { return nil }
+
+// PNGDisplay writes each frame to a numbered PNG file, handy for checking
+// animations frame by frame and for tests.
+type PNGDisplay struct {
+	dir           string
+	width, height int
+	scale         int
+	count         int
+}
+
+// NewPNGDisplay writes frames into dir, scale pixels per LED.
+func NewPNGDisplay(dir string, width, height, scale int) (*PNGDisplay, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create frame directory: %w", err)
+	}
+	return &PNGDisplay{dir: dir, width: width, height: height, scale: scale}, nil
+}
+
+func (d *PNGDisplay) Size() (int, int) { return d.width, d.height }
+
+func (d *PNGDisplay) Show(frame Frame) error {
+	path := filepath.Join(d.dir, fmt.Sprintf("frame-%05d.png", d.count))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, frame.Image(d.scale)); err != nil {
+		return fmt.Errorf("could not encode %s: %w", path, err)
+	}
+	d.count++
+	return nil
+}
+
+// Frames returns how many frames have been written.
+func (d *PNGDisplay) Frames() int { return d.count }
+
+func (d *PNGDisplay) Close() error { return nil }
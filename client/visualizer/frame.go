@@ -0,0 +1,77 @@
+// Package visualizer turns audio into frames for the robot's LED matrix.
+//
+// Audio is pushed in as it plays, analysed into loudness and frequency
+// bands, drawn into a Frame by a Renderer and handed to a Display. Displays
+// range from the terminal (for development) to PNG files (for tests) and,
+// eventually, the LED hardware itself.
+package visualizer
+
+import (
+	"image"
+	"image/color"
+)
+
+// Color is one RGB LED.
+type Color struct {
+	R, G, B uint8
+}
+
+var Black = Color{}
+
+// Frame is a width x height grid of LEDs, row-major from the top left.
+type Frame struct {
+	Width, Height int
+	Pixels        []Color
+}
+
+func NewFrame(width, height int) Frame {
+	return Frame{
+		Width:  width,
+		Height: height,
+		Pixels: make([]Color, width*height),
+	}
+}
+
+// Set colours the LED at x, y. Points outside the frame are ignored so
+// renderers don't have to clip.
+func (f Frame) Set(x, y int, c Color) {
+	if x < 0 || y < 0 || x >= f.Width || y >= f.Height {
+		return
+	}
+	f.Pixels[y*f.Width+x] = c
+}
+
+// At returns the colour of the LED at x, y.
+func (f Frame) At(x, y int) Color {
+	if x < 0 || y < 0 || x >= f.Width || y >= f.Height {
+		return Black
+	}
+	return f.Pixels[y*f.Width+x]
+}
+
+// Clear turns every LED off.
+func (f Frame) Clear() {
+	for i := range f.Pixels {
+		f.Pixels[i] = Black
+	}
+}
+
+// Image converts the frame to an image, scale pixels per LED.
+func (f Frame) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	img := image.NewRGBA(image.Rect(0, 0, f.Width*scale, f.Height*scale))
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			c := f.At(x, y)
+			rgba := color.RGBA{R: c.R, G: c.G, B: c.B, A: 255}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetRGBA(x*scale+dx, y*scale+dy, rgba)
+				}
+			}
+		}
+	}
+	return img
+}
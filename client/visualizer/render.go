@@ -0,0 +1,157 @@
+package visualizer
+
+import "math"
+
+// Renderer draws one frame from the audio levels.
+type Renderer func(levels Levels, frame Frame)
+
+// SpectrumBars draws a bar per column, low frequencies on the left, rising
+// from the bottom and shading from green to red.
+func SpectrumBars(levels Levels, frame Frame) {
+	frame.Clear()
+	if len(levels.Bands) == 0 {
+		return
+	}
+	for x := 0; x < frame.Width; x++ {
+		band := levels.Bands[x*len(levels.Bands)/frame.Width]
+		height := int(math.Round(band * float64(frame.Height)))
+		for i := 0; i < height; i++ {
+			frame.Set(x, frame.Height-1-i, barColor(float64(i+1)/float64(frame.Height)))
+		}
+	}
+}
+
+// mouthShape is how far open and how wide the mouth is, both 0..1.
+type mouthShape struct {
+	open, width float64
+}
+
+// visemeShapes gives each viseme's mouth shape.
+var visemeShapes = map[string]mouthShape{
+	"rest": {0, 0.6},
+	"MBP":  {0, 0.5},
+	"FV":   {0.1, 0.6},
+	"TH":   {0.2, 0.6},
+	"L":    {0.35, 0.6},
+	"WQ":   {0.3, 0.3},
+	"U":    {0.35, 0.35},
+	"O":    {0.6, 0.45},
+	"AI":   {0.8, 0.75},
+	"E":    {0.3, 0.85},
+	"etc":  {0.35, 0.6},
+}
+
+// Mouth draws a simple mouth for the robot's face. With a viseme timeline
+// it takes the viseme's shape; otherwise its height follows the loudness.
+func Mouth(levels Levels, frame Frame) {
+	frame.Clear()
+	drawMouth(levels, frame, 0, frame.Height)
+}
+
+// Face draws eyes showing the expression above the mouth.
+func Face(levels Levels, frame Frame) {
+	frame.Clear()
+	top := frame.Height / 3
+	drawEyes(levels.Expression, frame, top)
+	drawMouth(levels, frame, top, frame.Height-top)
+}
+
+// drawMouth draws the mouth in the rows from top to top+height.
+func drawMouth(levels Levels, frame Frame, top, height int) {
+	shape, ok := visemeShapes[levels.Viseme]
+	if !ok {
+		// Speech rarely gets near full scale, so boost before mapping to rows
+		shape = mouthShape{open: math.Min(1, levels.RMS*4), width: 0.75}
+	}
+	// Keep a row for each lip inside the area
+	half := int(math.Round(shape.open * float64(height-2) / 2))
+	mid := top + height/2
+	lips := Color{R: 255, G: 80, B: 40}
+	margin := int(math.Round(float64(frame.Width) * (1 - shape.width) / 2))
+	for x := margin; x < frame.Width-margin; x++ {
+		frame.Set(x, mid-half-1, lips)
+		frame.Set(x, mid+half, lips)
+	}
+	for y := mid - half; y < mid+half; y++ {
+		frame.Set(margin, y, lips)
+		frame.Set(frame.Width-margin-1, y, lips)
+	}
+}
+
+// eyes is how one expression looks: a pattern per eye, '#' lit, and the
+// colour. A nil right eye mirrors the left.
+type eyes struct {
+	left, right []string
+	color       Color
+}
+
+var expressionEyes = map[string]eyes{
+	"neutral":   {left: []string{".##.", "####", ".##."}, color: Color{R: 200, G: 220, B: 255}},
+	"happy":     {left: []string{".##.", "#..#", "...."}, color: Color{R: 255, G: 220, B: 0}},
+	"sad":       {left: []string{"....", "####", "##.."}, color: Color{R: 60, G: 120, B: 255}},
+	"surprised": {left: []string{"####", "#..#", "####"}, color: Color{R: 255, G: 255, B: 255}},
+	"thinking":  {left: []string{"..##", "..##", "...."}, color: Color{R: 160, G: 100, B: 255}},
+	"wink":      {left: []string{".##.", "####", ".##."}, right: []string{"....", "####", "...."}, color: Color{R: 200, G: 220, B: 255}},
+	"angry":     {left: []string{"#...", ".##.", "..##"}, color: Color{R: 255, G: 30, B: 0}},
+	"confused":  {left: []string{".##.", "####", ".##."}, right: []string{"....", "####", "...."}, color: Color{R: 0, G: 220, B: 180}},
+}
+
+// drawEyes draws the expression's eyes in the rows above bottom. Unknown
+// expressions get the neutral eyes.
+func drawEyes(expression string, frame Frame, bottom int) {
+	style, ok := expressionEyes[expression]
+	if !ok {
+		style = expressionEyes["neutral"]
+	}
+	right := style.right
+	if right == nil {
+		right = mirror(style.left)
+	}
+
+	// Scale the 4x3 patterns up on bigger matrices
+	cell := frame.Width / 16
+	if cell < 1 {
+		cell = 1
+	}
+	y := (bottom - 3*cell) / 2
+	drawPattern(style.left, frame, frame.Width/4-2*cell, y, cell, style.color)
+	drawPattern(right, frame, frame.Width*3/4-2*cell, y, cell, style.color)
+}
+
+func drawPattern(pattern []string, frame Frame, left, top, cell int, c Color) {
+	for row, line := range pattern {
+		for col, ch := range line {
+			if ch != '#' {
+				continue
+			}
+			for dy := 0; dy < cell; dy++ {
+				for dx := 0; dx < cell; dx++ {
+					frame.Set(left+col*cell+dx, top+row*cell+dy, c)
+				}
+			}
+		}
+	}
+}
+
+func mirror(pattern []string) []string {
+	mirrored := make([]string, len(pattern))
+	for i, line := range pattern {
+		runes := []rune(line)
+		for l, r := 0, len(runes)-1; l < r; l, r = l+1, r-1 {
+			runes[l], runes[r] = runes[r], runes[l]
+		}
+		mirrored[i] = string(runes)
+	}
+	return mirrored
+}
+
+func barColor(level float64) Color {
+	switch {
+	case level > 0.85:
+		return Color{R: 255, G: 40, B: 0}
+	case level > 0.6:
+		return Color{R: 255, G: 200, B: 0}
+	default:
+		return Color{R: 0, G: 220, B: 60}
+	}
+}
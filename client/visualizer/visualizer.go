@@ -0,0 +1,257 @@
+package visualizer
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Options tune the visualizer. Zero values pick sensible defaults.
+type Options struct {
+	SampleRate int
+	FPS        int
+	Bands      int
+	Render     Renderer
+	// Animations are shown between replies, keyed by state name.
+	Animations map[string]Animation
+}
+
+// Visualizer buffers the audio being played, analyses it a frame at a time
+// and shows the result on a Display at a steady frame rate.
+type Visualizer struct {
+	display    Display
+	sampleRate int
+	fps        int
+	bands      int
+	render     Renderer
+	animations map[string]Animation
+
+	mu      sync.Mutex
+	pending []float64
+	frames  chan Frame
+	// visemes is the timeline for the audio being played and played is how
+	// many samples of that audio have been pushed.
+	visemes []Cue
+	played  int
+	// expression is the current expression and expressions those waiting
+	// for their time in the audio.
+	expression  string
+	expressions []Cue
+	// state is what the robot is doing, such as "thinking", and since is
+	// when it started.
+	state string
+	since time.Time
+}
+
+// Cue holds a mouth shape from Start to End, in seconds from the start of
+// the audio.
+type Cue struct {
+	Viseme     string
+	Start, End float64
+}
+
+// SetVisemes starts a viseme timeline for the audio about to be pushed.
+// Passing nil clears it.
+func (v *Visualizer) SetVisemes(cues []Cue) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.visemes = cues
+	v.played = 0
+}
+
+// SetExpression changes the robot's expression at seconds into the audio
+// about to be pushed, or straight away if at is zero.
+func (v *Visualizer) SetExpression(name string, at float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if at <= 0 {
+		v.expression = name
+		return
+	}
+	v.expressions = append(v.expressions, Cue{Viseme: name, Start: at})
+}
+
+// SetState switches the animation shown while no audio is playing.
+// Setting the current state again doesn't restart its animation.
+func (v *Visualizer) SetState(state string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if state != v.state {
+		v.state = state
+		v.since = time.Now()
+	}
+}
+
+// State returns the current state.
+func (v *Visualizer) State() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.state
+}
+
+// Expression returns the current expression.
+func (v *Visualizer) Expression() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.expression
+}
+
+// advanceExpressions applies the expressions due by seconds. It must be
+// called with v.mu held.
+func (v *Visualizer) advanceExpressions(seconds float64) {
+	remaining := v.expressions[:0]
+	for _, cue := range v.expressions {
+		if cue.Start <= seconds {
+			v.expression = cue.Viseme
+		} else {
+			remaining = append(remaining, cue)
+		}
+	}
+	v.expressions = remaining
+}
+
+// visemeAt must be called with v.mu held.
+func (v *Visualizer) visemeAt(seconds float64) string {
+	if len(v.visemes) == 0 {
+		return ""
+	}
+	for _, cue := range v.visemes {
+		if seconds < cue.End {
+			if seconds < cue.Start {
+				break
+			}
+			return cue.Viseme
+		}
+	}
+	return "rest"
+}
+
+func New(display Display, opts Options) *Visualizer {
+	if opts.SampleRate == 0 {
+		opts.SampleRate = 44100
+	}
+	if opts.FPS == 0 {
+		opts.FPS = 30
+	}
+	if opts.Bands == 0 {
+		opts.Bands, _ = display.Size()
+	}
+	if opts.Render == nil {
+		opts.Render = SpectrumBars
+	}
+	return &Visualizer{
+		display:    display,
+		sampleRate: opts.SampleRate,
+		fps:        opts.FPS,
+		bands:      opts.Bands,
+		render:     opts.Render,
+		animations: opts.Animations,
+		since:      time.Now(),
+		// A couple of seconds of frames covers the speaker's lookahead
+		frames: make(chan Frame, opts.FPS*2),
+	}
+}
+
+// Push hands the visualizer mono samples as they go to the speaker. It
+// never blocks; if the display falls behind, frames are dropped.
+func (v *Visualizer) Push(samples []float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.pending = append(v.pending, samples...)
+	hop := v.sampleRate / v.fps
+	for len(v.pending) >= hop {
+		window := v.pending[:hop]
+		v.pending = v.pending[hop:]
+
+		levels := Analyze(window, v.sampleRate, v.bands)
+		// Take the viseme from the middle of the window
+		middle := float64(v.played+hop/2) / float64(v.sampleRate)
+		levels.Viseme = v.visemeAt(middle)
+		v.advanceExpressions(middle)
+		levels.Expression = v.expression
+		v.played += hop
+
+		width, height := v.display.Size()
+		frame := NewFrame(width, height)
+		v.render(levels, frame)
+
+		select {
+		case v.frames <- frame:
+		default:
+		}
+	}
+}
+
+// idleView identifies what's on the display between replies, so Run only
+// redraws when it changes.
+type idleView struct {
+	state, expression string
+	// index is the animation frame, -1 when the state has no animation
+	index int
+}
+
+// idleView works out what to show when no audio is playing.
+func (v *Visualizer) idleView(now time.Time) idleView {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	view := idleView{state: v.state, expression: v.expression, index: -1}
+	if animation, ok := v.animations[v.state]; ok {
+		view.index = animation.index(now.Sub(v.since))
+	}
+	return view
+}
+
+// idleFrame draws the view: the state's animation if it has one, otherwise
+// a silent frame from the renderer showing the expression.
+func (v *Visualizer) idleFrame(view idleView) Frame {
+	if view.index >= 0 {
+		return v.animations[view.state].Frames[view.index]
+	}
+	width, height := v.display.Size()
+	frame := NewFrame(width, height)
+	v.render(Levels{Expression: view.expression}, frame)
+	return frame
+}
+
+// Run shows queued frames at the configured frame rate until ctx is done.
+// When no audio is playing it shows the animation for the current state,
+// or a silent frame if there isn't one.
+func (v *Visualizer) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second / time.Duration(v.fps))
+	defer ticker.Stop()
+
+	idle := false
+	var shown idleView
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		select {
+		case frame := <-v.frames:
+			v.show(frame)
+			idle = false
+		default:
+			view := v.idleView(time.Now())
+			if !idle || view != shown {
+				v.show(v.idleFrame(view))
+				idle, shown = true, view
+			}
+		}
+	}
+}
+
+func (v *Visualizer) show(frame Frame) {
+	if err := v.display.Show(frame); err != nil {
+		slog.Error("Visualizer display error", "error", err)
+	}
+}
+
+// Close releases the display.
+func (v *Visualizer) Close() error {
+	return v.display.Close()
+}
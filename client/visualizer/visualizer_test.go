@@ -0,0 +1,190 @@
+package visualizer
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sine(freq float64, sampleRate, n int, amplitude float64) []float64 {
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate))
+	}
+	return samples
+}
+
+func TestRMS(t *testing.T) {
+	if got := rms(make([]float64, 100)); got != 0 {
+		t.Errorf("Expected silence to be 0, got %v", got)
+	}
+	got := rms(sine(440, 44100, 44100, 1))
+	if math.Abs(got-1/math.Sqrt2) > 0.01 {
+		t.Errorf("Expected full scale sine RMS ~0.707, got %v", got)
+	}
+}
+
+func TestSpectrumPeaksInTheRightBand(t *testing.T) {
+	const sampleRate, bands = 44100, 16
+	low := Analyze(sine(100, sampleRate, 2048, 0.8), sampleRate, bands)
+	high := Analyze(sine(5000, sampleRate, 2048, 0.8), sampleRate, bands)
+
+	if peak(low.Bands) >= bands/2 {
+		t.Errorf("100Hz should peak in the lower bands, got band %d of %v", peak(low.Bands), low.Bands)
+	}
+	if peak(high.Bands) < bands/2 {
+		t.Errorf("5kHz should peak in the upper bands, got band %d of %v", peak(high.Bands), high.Bands)
+	}
+}
+
+func peak(bands []float64) int {
+	best := 0
+	for i, b := range bands {
+		if b > bands[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+func TestSpectrumBarsHeightFollowsLevel(t *testing.T) {
+	frame := NewFrame(4, 8)
+	SpectrumBars(Levels{Bands: []float64{0, 0.5, 1, 0}}, frame)
+
+	lit := func(x int) int {
+		n := 0
+		for y := 0; y < frame.Height; y++ {
+			if frame.At(x, y) != Black {
+				n++
+			}
+		}
+		return n
+	}
+	if lit(0) != 0 || lit(1) != 4 || lit(2) != 8 {
+		t.Errorf("Unexpected bar heights %d %d %d", lit(0), lit(1), lit(2))
+	}
+}
+
+func TestPushProducesFramesPerHop(t *testing.T) {
+	dir := t.TempDir()
+	display, err := NewPNGDisplay(dir, 8, 8, 2)
+	if err != nil {
+		t.Fatalf("Failed to create display: %v", err)
+	}
+	v := New(display, Options{SampleRate: 1000, FPS: 10})
+
+	v.Push(sine(100, 1000, 250, 0.5))
+	if got := len(v.frames); got != 2 {
+		t.Errorf("Expected 2 frames from 250 samples at 100 samples/frame, got %d", got)
+	}
+
+	for len(v.frames) > 0 {
+		v.show(<-v.frames)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "frame-*.png"))
+	if len(files) != 2 || display.Frames() != 2 {
+		t.Errorf("Expected 2 PNG files, got %v", files)
+	}
+	info, err := os.Stat(files[0])
+	if err != nil || info.Size() == 0 {
+		t.Errorf("Expected a non-empty PNG, got %v %v", info, err)
+	}
+}
+
+func TestTerminalDisplay(t *testing.T) {
+	var out bytes.Buffer
+	display := NewTerminalDisplay(&out, 2, 2)
+	frame := NewFrame(2, 2)
+	frame.Set(0, 0, Color{R: 255})
+
+	display.Show(frame)
+	if !strings.Contains(out.String(), "\x1b[38;2;255;0;0m") {
+		t.Errorf("Expected a red pixel escape, got %q", out.String())
+	}
+
+	out.Reset()
+	display.Show(frame)
+	if !strings.HasPrefix(out.String(), "\x1b[2A") {
+		t.Errorf("Second frame should redraw in place, got %q", out.String())
+	}
+}
+
+func TestPushFollowsVisemeTimeline(t *testing.T) {
+	var visemes []string
+	record := func(levels Levels, frame Frame) { visemes = append(visemes, levels.Viseme) }
+
+	v := New(NewTerminalDisplay(&bytes.Buffer{}, 4, 4), Options{SampleRate: 1000, FPS: 10, Render: record})
+	v.SetVisemes([]Cue{
+		{Viseme: "MBP", Start: 0, End: 0.2},
+		{Viseme: "AI", Start: 0.2, End: 0.3},
+	})
+	v.Push(make([]float64, 400))
+
+	want := []string{"MBP", "MBP", "AI", "rest"}
+	if strings.Join(visemes, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %v, got %v", want, visemes)
+	}
+}
+
+func TestMouthShapesFromVisemes(t *testing.T) {
+	closed, open := NewFrame(16, 16), NewFrame(16, 16)
+	Mouth(Levels{Viseme: "MBP", RMS: 1}, closed)
+	Mouth(Levels{Viseme: "AI"}, open)
+	if litRows(open) <= litRows(closed) {
+		t.Errorf("AI should open the mouth wider than MBP: %d vs %d rows", litRows(open), litRows(closed))
+	}
+}
+
+func litRows(frame Frame) int {
+	rows := 0
+	for y := 0; y < frame.Height; y++ {
+		for x := 0; x < frame.Width; x++ {
+			if frame.At(x, y) != Black {
+				rows++
+				break
+			}
+		}
+	}
+	return rows
+}
+
+func TestExpressionsFollowTheAudio(t *testing.T) {
+	var expressions []string
+	record := func(levels Levels, frame Frame) { expressions = append(expressions, levels.Expression) }
+
+	v := New(NewTerminalDisplay(&bytes.Buffer{}, 4, 4), Options{SampleRate: 1000, FPS: 10, Render: record})
+	v.SetExpression("happy", 0)
+	v.SetExpression("surprised", 0.2)
+	v.Push(make([]float64, 300))
+
+	want := []string{"happy", "happy", "surprised"}
+	if strings.Join(expressions, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %v, got %v", want, expressions)
+	}
+}
+
+func TestFaceUnknownExpressionIsNeutral(t *testing.T) {
+	neutral, unknown, happy := NewFrame(16, 16), NewFrame(16, 16), NewFrame(16, 16)
+	Face(Levels{Expression: "neutral"}, neutral)
+	Face(Levels{Expression: "smug"}, unknown)
+	Face(Levels{Expression: "happy"}, happy)
+
+	if !sameFrame(neutral, unknown) {
+		t.Error("Unknown expressions should look neutral")
+	}
+	if sameFrame(neutral, happy) {
+		t.Error("Happy should look different from neutral")
+	}
+}
+
+func sameFrame(a, b Frame) bool {
+	for i := range a.Pixels {
+		if a.Pixels[i] != b.Pixels[i] {
+			return false
+		}
+	}
+	return true
+}
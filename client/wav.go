@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// captureSampleRate is the rate recordAudio captures at and the server's
+// speech recogniser expects.
+const captureSampleRate = 16000
+
+// readWAV loads a 16-bit PCM WAV file and converts it to what recordAudio
+// produces: 16kHz mono little-endian PCM.
+func readWAV(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	samples, rate, err := decodeWAV(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return encodePCM(resample(samples, rate, captureSampleRate)), nil
+}
+
+// decodeWAV returns the samples, mixed down to mono, and the sample rate.
+func decodeWAV(data []byte) ([]int16, int, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, fmt.Errorf("not a WAV file")
+	}
+
+	var channels, bits, format int
+	var rate int
+	var pcm []byte
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		body := data[offset+8:]
+		if size > len(body) {
+			size = len(body)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, 0, fmt.Errorf("short fmt chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:2]))
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			rate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bits = int(binary.LittleEndian.Uint16(body[14:16]))
+		case "data":
+			pcm = body
+		}
+		// Chunks are padded to an even length
+		offset += 8 + size + size%2
+	}
+
+	if format != 1 || bits != 16 {
+		return nil, 0, fmt.Errorf("only 16-bit PCM is supported (format %d, %d bits)", format, bits)
+	}
+	if channels < 1 || rate <= 0 {
+		return nil, 0, fmt.Errorf("missing or invalid fmt chunk")
+	}
+	if pcm == nil {
+		return nil, 0, fmt.Errorf("no data chunk")
+	}
+
+	frames := len(pcm) / (2 * channels)
+	samples := make([]int16, frames)
+	for i := range samples {
+		sum := 0
+		for c := 0; c < channels; c++ {
+			at := (i*channels + c) * 2
+			sum += int(int16(binary.LittleEndian.Uint16(pcm[at:])))
+		}
+		samples[i] = int16(sum / channels)
+	}
+	return samples, rate, nil
+}
+
+// resample converts between sample rates by linear interpolation, which is
+// plenty for speech recognition.
+func resample(samples []int16, from, to int) []int16 {
+	if from == to || len(samples) == 0 {
+		return samples
+	}
+	out := make([]int16, len(samples)*to/from)
+	for i := range out {
+		pos := float64(i) * float64(from) / float64(to)
+		j := int(pos)
+		if j+1 >= len(samples) {
+			out[i] = samples[len(samples)-1]
+			continue
+		}
+		frac := pos - float64(j)
+		out[i] = int16(float64(samples[j])*(1-frac) + float64(samples[j+1])*frac)
+	}
+	return out
+}
+
+func encodePCM(samples []int16) []byte {
+	data := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(s))
+	}
+	return data
+}
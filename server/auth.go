@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"robot-head/shared"
+)
+
+// minTokenLength keeps device tokens long enough not to be guessed.
+const minTokenLength = 16
+
+// DeviceTokens maps each device's pre-shared token to its identity. The
+// tokens file is YAML, one device per line:
+//
+//	devices:
+//	  kitchen: 3f9a6c1e0b7d4a28c5e1f09b
+//	  lounge: 77b1d2e4f6a8c0e2d4f6a8c0
+//
+// Only hashes of the tokens are kept, and looking one up is a map access on
+// the hash rather than a string comparison that could leak timing.
+type DeviceTokens struct {
+	devices map[[sha256.Size]byte]string
+}
+
+// deviceTokens is nil when auth is off and anyone may connect.
+var deviceTokens *DeviceTokens
+
+func LoadDeviceTokens(path string) (*DeviceTokens, error) {
+	var file struct {
+		Devices map[string]string `yaml:"devices"`
+	}
+	if err := shared.LoadConfigFile(path, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Devices) == 0 {
+		return nil, fmt.Errorf("%s lists no devices", path)
+	}
+
+	tokens := &DeviceTokens{devices: map[[sha256.Size]byte]string{}}
+	for device, token := range file.Devices {
+		if len(token) < minTokenLength {
+			return nil, fmt.Errorf("token for %s must be at least %d characters", device, minTokenLength)
+		}
+		hash := sha256.Sum256([]byte(token))
+		if other, ok := tokens.devices[hash]; ok {
+			return nil, fmt.Errorf("%s and %s share a token", other, device)
+		}
+		tokens.devices[hash] = device
+	}
+	return tokens, nil
+}
+
+// Device returns the device a token belongs to.
+func (t *DeviceTokens) Device(token string) (string, bool) {
+	device, ok := t.devices[sha256.Sum256([]byte(token))]
+	return device, ok
+}
+
+// requestToken finds the token in an "Authorization: Bearer" header or,
+// for clients that can't set headers, a ?token= query parameter.
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, _ := strings.Cut(header, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authFailure is why a request was turned away.
+type authFailure struct {
+	status int
+	// reason labels the auth failures metric and the log line
+	reason string
+}
+
+// authenticate checks a request's origin and token. It returns the device
+// the token belongs to, or "" when auth is off.
+func authenticate(r *http.Request) (string, *authFailure) {
+	if !allowedOrigin(r) {
+		return "", &authFailure{http.StatusForbidden, "origin"}
+	}
+	if deviceTokens == nil {
+		return "", nil
+	}
+	token := requestToken(r)
+	if token == "" {
+		return "", &authFailure{http.StatusUnauthorized, "missing_token"}
+	}
+	device, ok := deviceTokens.Device(token)
+	if !ok {
+		return "", &authFailure{http.StatusUnauthorized, "invalid_token"}
+	}
+	return device, nil
+}
+
+// rejectRequest logs, counts and answers a failed authentication.
+func rejectRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, failure *authFailure) {
+	authFailuresTotal.inc(failure.reason)
+	slog.WarnContext(ctx, "Rejected request", "path", r.URL.Path, "reason", failure.reason,
+		"origin", r.Header.Get("Origin"))
+	if failure.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="robot-head"`)
+	}
+	http.Error(w, http.StatusText(failure.status), failure.status)
+}
+
+// deviceKey holds the authenticated device in a request's context.
+type deviceKey struct{}
+
+// requireAuth wraps an HTTP endpoint so it needs a device token too. The
+// endpoint finds the device with requestDevice.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device, failure := authenticate(r)
+		if failure != nil {
+			ctx := shared.WithLogAttrs(r.Context(), slog.String("remote_addr", r.RemoteAddr))
+			rejectRequest(ctx, w, r, failure)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), deviceKey{}, device)))
+	}
+}
+
+// requestDevice is the device requireAuth let through, "" without one.
+func requestDevice(r *http.Request) string {
+	device, _ := r.Context().Value(deviceKey{}).(string)
+	return device
+}
+
+// requireAdmin wraps an operator endpoint so it needs auth.admin_token
+// rather than a device token: robots shouldn't see what the others spend.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	want := sha256.Sum256([]byte(cfg.Auth.AdminToken))
+	return func(w http.ResponseWriter, r *http.Request) {
+		var failure *authFailure
+		token := requestToken(r)
+		got := sha256.Sum256([]byte(token))
+		switch {
+		case token == "":
+			failure = &authFailure{http.StatusUnauthorized, "missing_token"}
+		case subtle.ConstantTimeCompare(got[:], want[:]) != 1:
+			failure = &authFailure{http.StatusUnauthorized, "invalid_admin_token"}
+		}
+		if failure != nil {
+			ctx := shared.WithLogAttrs(r.Context(), slog.String("remote_addr", r.RemoteAddr))
+			rejectRequest(ctx, w, r, failure)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowedOrigin checks a browser's Origin header against auth.origins.
+// Robot clients send no Origin and are always let through to the token
+// check. With no origins configured only same-host pages are allowed, and
+// "*" allows any.
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range cfg.Auth.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"robot-head/shared"
+)
+
+// Config holds every server setting. See shared/config.go for how the
+// file, environment and flags are layered.
+type Config struct {
+	Host            string        `yaml:"host"`
+	Port            string        `yaml:"port"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	SessionTTL      time.Duration `yaml:"session_ttl"`
+	// TurnTimeout bounds the LLM and TTS calls of one turn, retries and all.
+	TurnTimeout    time.Duration `yaml:"turn_timeout"`
+	PersonasDir    string        `yaml:"personas_dir"`
+	DefaultPersona string        `yaml:"default_persona"`
+	// Expressions lets the LLM tag its replies with facial expressions for
+	// clients that can show them.
+	Expressions bool `yaml:"expressions"`
+	// SpeakErrors sends failed turns' error messages as speech too, for
+	// clients that play audio.
+	SpeakErrors bool `yaml:"speak_errors"`
+	// LogLevel is debug, info, warn or error; LogFormat is text or json.
+	LogLevel  string `yaml:"log_level"`
+	LogFormat string `yaml:"log_format"`
+
+	Whisper     WhisperConfig        `yaml:"whisper"`
+	OpenAI      OpenAIConfig         `yaml:"openai"`
+	ElevenLabs  ElevenLabsConfig     `yaml:"elevenlabs"`
+	Recorder    RecorderConfig       `yaml:"recorder"`
+	Transcripts TranscriptsConfig    `yaml:"transcripts"`
+	Health      HealthConfig         `yaml:"health"`
+	Auth        AuthConfig           `yaml:"auth"`
+	TLS         TLSConfig            `yaml:"tls"`
+	Upstream    UpstreamConfig       `yaml:"upstream"`
+	Limits      LimitsConfig         `yaml:"limits"`
+	Prices      PricesConfig         `yaml:"prices"`
+	Tracing     shared.TracingConfig `yaml:"tracing"`
+}
+
+type WhisperConfig struct {
+	ModelPath string `yaml:"model_path"`
+}
+
+type OpenAIConfig struct {
+	APIKey  string        `yaml:"api_key"`
+	URL     string        `yaml:"url"`
+	Model   string        `yaml:"model"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type ElevenLabsConfig struct {
+	APIKey                   string `yaml:"api_key"`
+	BaseURL                  string `yaml:"base_url"`
+	VoiceID                  string `yaml:"voice_id"`
+	ModelID                  string `yaml:"model_id"`
+	OutputFormat             string `yaml:"output_format"`
+	OptimizeStreamingLatency int    `yaml:"optimize_streaming_latency"`
+	// Stream uses the streaming endpoint for clients that support it.
+	Stream bool `yaml:"stream"`
+	// Timestamps asks for character timing to drive the mouth animation.
+	// Without it the viseme timeline is estimated from the text.
+	Timestamps bool          `yaml:"timestamps"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+// RecorderConfig controls the debug recorder. It's off unless enabled, and
+// even then only records sessions that opt in, unless AllSessions is set.
+type RecorderConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Dir         string        `yaml:"dir"`
+	AllSessions bool          `yaml:"all_sessions"`
+	Retention   time.Duration `yaml:"retention"`
+	MaxMB       int           `yaml:"max_mb"`
+}
+
+// TranscriptsConfig controls the conversation transcript store.
+type TranscriptsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	// Reload picks a returning session's conversation back up from its
+	// transcript after the server restarts.
+	Reload bool `yaml:"reload"`
+}
+
+// HealthConfig controls what /readyz checks beyond the local ones.
+type HealthConfig struct {
+	// Probe calls the LLM and TTS APIs to check they answer, at most once
+	// per ProbeInterval. Off by default since the calls aren't free.
+	Probe         bool          `yaml:"probe"`
+	ProbeInterval time.Duration `yaml:"probe_interval"`
+	ProbeTimeout  time.Duration `yaml:"probe_timeout"`
+	// MaxSessions marks the server not ready once it holds this many
+	// sessions, so a load balancer sends new clients elsewhere. 0 means
+	// no limit.
+	MaxSessions int `yaml:"max_sessions"`
+}
+
+// AuthConfig controls who may connect. Auth is off until a tokens file is
+// given; see DeviceTokens for its format.
+type AuthConfig struct {
+	TokensFile string `yaml:"tokens_file"`
+	// AdminToken guards the /admin endpoints, which are off without one.
+	AdminToken string `yaml:"admin_token"`
+	// Origins are the web pages allowed to open /ws from a browser, or
+	// "*" for any. Same-host pages are always allowed.
+	Origins []string `yaml:"origins"`
+}
+
+// TLSConfig turns on HTTPS and wss://. It's off unless a certificate is
+// given, and the certificate is reloaded when its files change. With a
+// ClientCAFile, clients must also present a certificate signed by it.
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// UpstreamConfig controls how calls to OpenAI and ElevenLabs are retried
+// and when they're given up on. See upstream.Do.
+type UpstreamConfig struct {
+	// MaxAttempts is how many tries a request gets, 1 for no retries.
+	MaxAttempts int `yaml:"max_attempts"`
+	// Retries wait a random time up to BaseDelay, doubling each attempt up
+	// to MaxDelay, unless the upstream sends Retry-After.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+	// After BreakerFailures failures in a row an upstream isn't called for
+	// BreakerCooldown. 0 turns the breaker off.
+	BreakerFailures int           `yaml:"breaker_failures"`
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+}
+
+// LimitsConfig caps how much each robot, and all of them together, can
+// spend. Every limit is off at 0.
+type LimitsConfig struct {
+	// Turns that reach the LLM, per device (or per session without auth)
+	// and across the server, in any minute.
+	DeviceTurnsPerMinute int `yaml:"device_turns_per_minute"`
+	GlobalTurnsPerMinute int `yaml:"global_turns_per_minute"`
+	// Daily budgets, reset at midnight UTC. LLM tokens are counted from
+	// the API's usage figures, TTS characters from the text sent.
+	DailyLLMTokens     int `yaml:"daily_llm_tokens"`
+	DailyTTSCharacters int `yaml:"daily_tts_characters"`
+	// FallbackModel answers once the LLM budget is spent. Without one the
+	// robot gives OfflineMessage instead. Past the TTS budget replies are
+	// sent as text.
+	FallbackModel  string `yaml:"fallback_model"`
+	OfflineMessage string `yaml:"offline_message"`
+	// StateFile keeps the day's usage across restarts.
+	StateFile string `yaml:"state_file"`
+}
+
+// PricesConfig estimates what turns cost, in US dollars. The defaults are
+// list prices when they were written; set your own plan's.
+type PricesConfig struct {
+	// LLM is the price per million tokens of each chat model.
+	LLM map[string]LLMPrice `yaml:"llm"`
+	// TTSPer1KCharacters is the ElevenLabs price per thousand characters.
+	TTSPer1KCharacters float64 `yaml:"tts_per_1k_characters"`
+	// STTPerMinute is for transcription, free with the local whisper model.
+	STTPerMinute float64 `yaml:"stt_per_minute"`
+}
+
+type LLMPrice struct {
+	Prompt     float64 `yaml:"prompt"`
+	Completion float64 `yaml:"completion"`
+}
+
+// defaultVoice is the voice personas and sessions build on.
+func (c ElevenLabsConfig) defaultVoice() VoiceConfig {
+	stability, similarity := 0.5, 0.5
+	return VoiceConfig{
+		VoiceID:                  c.VoiceID,
+		ModelID:                  c.ModelID,
+		OutputFormat:             c.OutputFormat,
+		OptimizeStreamingLatency: c.OptimizeStreamingLatency,
+		Settings: VoiceSettings{
+			Stability:       &stability,
+			SimilarityBoost: &similarity,
+		},
+	}
+}
+
+// cfg is the active configuration. It starts out as the defaults so code
+// paths exercised by tests don't need main to have run.
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Host:            "0.0.0.0",
+		Port:            "9001",
+		ShutdownTimeout: 30 * time.Second,
+		SessionTTL:      5 * time.Minute,
+		TurnTimeout:     time.Minute,
+		PersonasDir:     "./personas",
+		DefaultPersona:  defaultPersonaName,
+		Expressions:     true,
+		SpeakErrors:     true,
+		LogLevel:        "info",
+		LogFormat:       "text",
+		Whisper: WhisperConfig{
+			ModelPath: "./models/ggml-base.en.bin",
+		},
+		OpenAI: OpenAIConfig{
+			URL:     "https://api.openai.com/v1/chat/completions",
+			Model:   "gpt-4o",
+			Timeout: 30 * time.Second,
+		},
+		ElevenLabs: ElevenLabsConfig{
+			BaseURL:      "https://api.elevenlabs.io",
+			VoiceID:      "Oe8Lhg3t63j9BsrTQBjx", // Yowz - South London Bloke
+			ModelID:      "eleven_turbo_v2",
+			OutputFormat: "mp3_44100_128",
+			Stream:       true,
+			Timestamps:   true,
+			Timeout:      30 * time.Second,
+		},
+		Recorder: RecorderConfig{
+			Dir:       "./recordings",
+			Retention: 7 * 24 * time.Hour,
+			MaxMB:     500,
+		},
+		Transcripts: TranscriptsConfig{
+			Enabled: true,
+			Dir:     "./transcripts",
+			Reload:  true,
+		},
+		Health: HealthConfig{
+			ProbeInterval: time.Minute,
+			ProbeTimeout:  5 * time.Second,
+		},
+		Upstream: UpstreamConfig{
+			MaxAttempts:     3,
+			BaseDelay:       250 * time.Millisecond,
+			MaxDelay:        4 * time.Second,
+			BreakerFailures: 5,
+			BreakerCooldown: 30 * time.Second,
+		},
+		Limits: LimitsConfig{
+			OfflineMessage: "I've done a lot of talking today. Let's chat again tomorrow.",
+			StateFile:      "./budget.json",
+		},
+		Prices: PricesConfig{
+			LLM: map[string]LLMPrice{
+				"gpt-4o":      {Prompt: 2.50, Completion: 10.00},
+				"gpt-4o-mini": {Prompt: 0.15, Completion: 0.60},
+			},
+			TTSPer1KCharacters: 0.30,
+		},
+		Tracing: shared.DefaultTracingConfig(),
+	}
+}
+
+// applyEnv overrides settings from environment variables.
+func (c *Config) applyEnv() error {
+	c.Host = getEnv("HOST", c.Host)
+	c.Port = getEnv("PORT", c.Port)
+	c.PersonasDir = getEnv("PERSONAS_DIR", c.PersonasDir)
+	c.DefaultPersona = getEnv("DEFAULT_PERSONA", c.DefaultPersona)
+	c.LogLevel = getEnv("LOG_LEVEL", c.LogLevel)
+	c.LogFormat = getEnv("LOG_FORMAT", c.LogFormat)
+	c.Whisper.ModelPath = getEnv("WHISPER_MODEL", c.Whisper.ModelPath)
+	c.OpenAI.APIKey = getEnv("OPENAI_API_KEY", c.OpenAI.APIKey)
+	c.OpenAI.Model = getEnv("OPENAI_MODEL", c.OpenAI.Model)
+	c.ElevenLabs.APIKey = getEnv("ELEVENLABS_API_KEY", c.ElevenLabs.APIKey)
+	c.ElevenLabs.VoiceID = getEnv("ELEVENLABS_VOICE_ID", c.ElevenLabs.VoiceID)
+	c.Recorder.Dir = getEnv("RECORDER_DIR", c.Recorder.Dir)
+	c.Transcripts.Dir = getEnv("TRANSCRIPTS_DIR", c.Transcripts.Dir)
+	c.Auth.TokensFile = getEnv("AUTH_TOKENS_FILE", c.Auth.TokensFile)
+	c.Auth.AdminToken = getEnv("ADMIN_TOKEN", c.Auth.AdminToken)
+	c.TLS.CertFile = getEnv("TLS_CERT_FILE", c.TLS.CertFile)
+	c.TLS.KeyFile = getEnv("TLS_KEY_FILE", c.TLS.KeyFile)
+	c.TLS.ClientCAFile = getEnv("TLS_CLIENT_CA_FILE", c.TLS.ClientCAFile)
+	c.Limits.StateFile = getEnv("BUDGET_STATE_FILE", c.Limits.StateFile)
+	c.Tracing.Exporter = getEnv("TRACE_EXPORTER", c.Tracing.Exporter)
+	c.Tracing.Endpoint = getEnv("TRACE_ENDPOINT", c.Tracing.Endpoint)
+	c.Tracing.File = getEnv("TRACE_FILE", c.Tracing.File)
+
+	durations := []struct {
+		key   string
+		field *time.Duration
+	}{
+		{"SESSION_TTL", &c.SessionTTL},
+		{"SHUTDOWN_TIMEOUT", &c.ShutdownTimeout},
+		{"TURN_TIMEOUT", &c.TurnTimeout},
+		{"OPENAI_TIMEOUT", &c.OpenAI.Timeout},
+		{"ELEVENLABS_TIMEOUT", &c.ElevenLabs.Timeout},
+	}
+	for _, d := range durations {
+		value := os.Getenv(d.key)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", d.key, err)
+		}
+		*d.field = parsed
+	}
+	return nil
+}
+
+// bindFlags registers a flag for each setting, using the current value as
+// the default so unset flags leave earlier layers alone.
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Host, "host", c.Host, "address to listen on")
+	fs.StringVar(&c.Port, "port", c.Port, "port to listen on")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "graceful shutdown timeout")
+	fs.DurationVar(&c.SessionTTL, "session-ttl", c.SessionTTL, "how long disconnected sessions are kept")
+	fs.DurationVar(&c.TurnTimeout, "turn-timeout", c.TurnTimeout, "time limit for the LLM and TTS calls of a turn, including retries")
+	fs.StringVar(&c.PersonasDir, "personas-dir", c.PersonasDir, "directory of persona YAML files")
+	fs.StringVar(&c.DefaultPersona, "default-persona", c.DefaultPersona, "persona new sessions start with")
+	fs.BoolVar(&c.Expressions, "expressions", c.Expressions, "let the LLM drive the robot's facial expressions")
+	fs.BoolVar(&c.SpeakErrors, "speak-errors", c.SpeakErrors, "speak error messages to clients that play audio")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json")
+	fs.StringVar(&c.Whisper.ModelPath, "whisper-model", c.Whisper.ModelPath, "path to the whisper.cpp model")
+	fs.StringVar(&c.OpenAI.Model, "openai-model", c.OpenAI.Model, "OpenAI chat model")
+	fs.DurationVar(&c.OpenAI.Timeout, "openai-timeout", c.OpenAI.Timeout, "OpenAI request timeout")
+	fs.StringVar(&c.ElevenLabs.VoiceID, "voice-id", c.ElevenLabs.VoiceID, "ElevenLabs voice id")
+	fs.StringVar(&c.ElevenLabs.ModelID, "tts-model", c.ElevenLabs.ModelID, "ElevenLabs model id")
+	fs.StringVar(&c.ElevenLabs.OutputFormat, "tts-output-format", c.ElevenLabs.OutputFormat, "ElevenLabs output_format, e.g. mp3_44100_128")
+	fs.IntVar(&c.ElevenLabs.OptimizeStreamingLatency, "tts-optimize-latency", c.ElevenLabs.OptimizeStreamingLatency, "ElevenLabs optimize_streaming_latency (0-4)")
+	fs.BoolVar(&c.ElevenLabs.Stream, "tts-stream", c.ElevenLabs.Stream, "stream TTS audio to clients that support it")
+	fs.BoolVar(&c.ElevenLabs.Timestamps, "tts-timestamps", c.ElevenLabs.Timestamps, "request character timestamps for the viseme timeline")
+	fs.DurationVar(&c.ElevenLabs.Timeout, "elevenlabs-timeout", c.ElevenLabs.Timeout, "ElevenLabs request timeout")
+	fs.BoolVar(&c.Recorder.Enabled, "record", c.Recorder.Enabled, "let sessions record their turns to disk for debugging")
+	fs.StringVar(&c.Recorder.Dir, "record-dir", c.Recorder.Dir, "directory for debug recordings")
+	fs.BoolVar(&c.Recorder.AllSessions, "record-all", c.Recorder.AllSessions, "record sessions that haven't opted in")
+	fs.DurationVar(&c.Recorder.Retention, "record-retention", c.Recorder.Retention, "how long recordings are kept")
+	fs.IntVar(&c.Recorder.MaxMB, "record-max-mb", c.Recorder.MaxMB, "size cap for all recordings, in megabytes")
+	fs.BoolVar(&c.Transcripts.Enabled, "transcripts", c.Transcripts.Enabled, "keep conversation transcripts on disk")
+	fs.StringVar(&c.Transcripts.Dir, "transcripts-dir", c.Transcripts.Dir, "directory for conversation transcripts")
+	fs.BoolVar(&c.Transcripts.Reload, "transcripts-reload", c.Transcripts.Reload, "restore a returning session's conversation from its transcript")
+	fs.BoolVar(&c.Health.Probe, "health-probe", c.Health.Probe, "check the LLM and TTS APIs answer in /readyz")
+	fs.DurationVar(&c.Health.ProbeInterval, "health-probe-interval", c.Health.ProbeInterval, "how long a probe result is reused")
+	fs.IntVar(&c.Health.MaxSessions, "max-sessions", c.Health.MaxSessions, "sessions held before /readyz reports not ready, 0 for no limit")
+	fs.StringVar(&c.Auth.TokensFile, "auth-tokens", c.Auth.TokensFile, "YAML file of device tokens; clients need one to connect")
+	fs.StringVar(&c.Auth.AdminToken, "admin-token", c.Auth.AdminToken, "token for the /admin endpoints; they're off without one")
+	fs.Func("auth-origins", "comma-separated web origins allowed to connect, * for any", func(value string) error {
+		c.Auth.Origins = strings.Split(value, ",")
+		return nil
+	})
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "TLS certificate file; serves https and wss when set")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "TLS private key file")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca", c.TLS.ClientCAFile, "CA file that client certificates must be signed by")
+	fs.IntVar(&c.Upstream.MaxAttempts, "upstream-attempts", c.Upstream.MaxAttempts, "tries per OpenAI or ElevenLabs request, 1 for no retries")
+	fs.IntVar(&c.Upstream.BreakerFailures, "breaker-failures", c.Upstream.BreakerFailures, "failures in a row before an upstream is given a rest, 0 for never")
+	fs.DurationVar(&c.Upstream.BreakerCooldown, "breaker-cooldown", c.Upstream.BreakerCooldown, "how long a failing upstream is left alone")
+	fs.IntVar(&c.Limits.DeviceTurnsPerMinute, "device-turns-per-minute", c.Limits.DeviceTurnsPerMinute, "turns each device may take a minute, 0 for no limit")
+	fs.IntVar(&c.Limits.GlobalTurnsPerMinute, "global-turns-per-minute", c.Limits.GlobalTurnsPerMinute, "turns all devices together may take a minute, 0 for no limit")
+	fs.IntVar(&c.Limits.DailyLLMTokens, "daily-llm-tokens", c.Limits.DailyLLMTokens, "LLM tokens a day before falling back, 0 for no limit")
+	fs.IntVar(&c.Limits.DailyTTSCharacters, "daily-tts-characters", c.Limits.DailyTTSCharacters, "TTS characters a day before replying in text, 0 for no limit")
+	fs.StringVar(&c.Limits.FallbackModel, "fallback-model", c.Limits.FallbackModel, "chat model to use once the LLM budget is spent")
+	fs.StringVar(&c.Limits.StateFile, "budget-state", c.Limits.StateFile, "file the day's budget usage is kept in")
+	c.Tracing.BindFlags(fs)
+}
+
+// Validate reports the first setting that can't work.
+func (c Config) Validate() error {
+	port, err := strconv.Atoi(c.Port)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("port must be a number between 1 and 65535, got %q", c.Port)
+	}
+	if c.SessionTTL <= 0 {
+		return fmt.Errorf("session_ttl must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown_timeout must be positive")
+	}
+	if c.TurnTimeout <= 0 {
+		return fmt.Errorf("turn_timeout must be positive")
+	}
+	if _, err := shared.NewLogHandler(io.Discard, c.LogLevel, c.LogFormat); err != nil {
+		return err
+	}
+	if c.Whisper.ModelPath == "" {
+		return fmt.Errorf("whisper.model_path is required")
+	}
+	if c.OpenAI.Model == "" || c.OpenAI.URL == "" {
+		return fmt.Errorf("openai.model and openai.url are required")
+	}
+	if c.OpenAI.Timeout <= 0 {
+		return fmt.Errorf("openai.timeout must be positive")
+	}
+	if c.ElevenLabs.VoiceID == "" || c.ElevenLabs.ModelID == "" || c.ElevenLabs.BaseURL == "" {
+		return fmt.Errorf("elevenlabs.voice_id, elevenlabs.model_id and elevenlabs.base_url are required")
+	}
+	if err := c.ElevenLabs.defaultVoice().validate(); err != nil {
+		return fmt.Errorf("elevenlabs: %w", err)
+	}
+	if c.ElevenLabs.Timeout <= 0 {
+		return fmt.Errorf("elevenlabs.timeout must be positive")
+	}
+	if c.Recorder.Enabled {
+		if c.Recorder.Dir == "" {
+			return fmt.Errorf("recorder.dir is required when the recorder is enabled")
+		}
+		if c.Recorder.Retention <= 0 || c.Recorder.MaxMB <= 0 {
+			return fmt.Errorf("recorder.retention and recorder.max_mb must be positive")
+		}
+	}
+	if c.Transcripts.Enabled && c.Transcripts.Dir == "" {
+		return fmt.Errorf("transcripts.dir is required when transcripts are enabled")
+	}
+	if c.Health.Probe && (c.Health.ProbeInterval <= 0 || c.Health.ProbeTimeout <= 0) {
+		return fmt.Errorf("health.probe_interval and health.probe_timeout must be positive")
+	}
+	if c.Health.MaxSessions < 0 {
+		return fmt.Errorf("health.max_sessions can't be negative")
+	}
+	if c.Auth.AdminToken != "" && len(c.Auth.AdminToken) < minTokenLength {
+		return fmt.Errorf("auth.admin_token must be at least %d characters", minTokenLength)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		return fmt.Errorf("tls.client_ca_file needs tls.cert_file and tls.key_file")
+	}
+	if c.Upstream.MaxAttempts < 1 {
+		return fmt.Errorf("upstream.max_attempts must be at least 1")
+	}
+	if c.Upstream.BaseDelay <= 0 || c.Upstream.MaxDelay < c.Upstream.BaseDelay {
+		return fmt.Errorf("upstream.base_delay must be positive and no more than upstream.max_delay")
+	}
+	if c.Upstream.BreakerFailures < 0 || (c.Upstream.BreakerFailures > 0 && c.Upstream.BreakerCooldown <= 0) {
+		return fmt.Errorf("upstream.breaker_failures can't be negative and needs a positive upstream.breaker_cooldown")
+	}
+	if c.Limits.DeviceTurnsPerMinute < 0 || c.Limits.GlobalTurnsPerMinute < 0 ||
+		c.Limits.DailyLLMTokens < 0 || c.Limits.DailyTTSCharacters < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	if c.Limits.DailyLLMTokens > 0 && c.Limits.FallbackModel == "" && c.Limits.OfflineMessage == "" {
+		return fmt.Errorf("limits.daily_llm_tokens needs a limits.fallback_model or limits.offline_message")
+	}
+	if c.Prices.TTSPer1KCharacters < 0 || c.Prices.STTPerMinute < 0 {
+		return fmt.Errorf("prices can't be negative")
+	}
+	for model, price := range c.Prices.LLM {
+		if price.Prompt < 0 || price.Completion < 0 {
+			return fmt.Errorf("prices.llm.%s can't be negative", model)
+		}
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Redacted returns a copy that is safe to print.
+func (c Config) Redacted() Config {
+	c.OpenAI.APIKey = shared.Redact(c.OpenAI.APIKey)
+	c.ElevenLabs.APIKey = shared.Redact(c.ElevenLabs.APIKey)
+	c.Auth.AdminToken = shared.Redact(c.Auth.AdminToken)
+	return c
+}
+
+// loadConfig resolves the configuration from defaults, the optional config
+// file, the environment and command-line flags, in that order. It returns
+// printOnly when --print-config was given.
+func loadConfig(args []string, stderr io.Writer) (config Config, printOnly bool, err error) {
+	// First pass only finds --config and --print-config; the real values are
+	// bound once the lower-precedence layers have been applied.
+	var configPath string
+	scratch := defaultConfig()
+	fs := newFlagSet(&scratch, &configPath, &printOnly, stderr)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+
+	config, err = baseConfig(configPath)
+	if err != nil {
+		return Config{}, false, err
+	}
+
+	fs = newFlagSet(&config, &configPath, &printOnly, stderr)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, false, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return config, printOnly, nil
+}
+
+// baseConfig is the configuration before flags: the defaults, then the
+// config file at path if there is one, then the environment.
+func baseConfig(path string) (Config, error) {
+	config := defaultConfig()
+	if path != "" {
+		if err := shared.LoadConfigFile(path, &config); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := config.applyEnv(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+func newFlagSet(config *Config, configPath *string, printOnly *bool, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("robot-head-server", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(configPath, "config", getEnv("ROBOT_SERVER_CONFIG", ""), "path to a YAML config file")
+	fs.BoolVar(printOnly, "print-config", false, "print the resolved configuration (secrets redacted) and exit")
+	config.bindFlags(fs)
+	return fs
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	contents := "port: \"9100\"\nsession_ttl: 1m\nopenai:\n  model: gpt-4o-mini\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	t.Setenv("PORT", "9200")
+
+	config, _, err := loadConfig([]string{"--config", path, "--session-ttl", "2m"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if config.OpenAI.Model != "gpt-4o-mini" {
+		t.Errorf("File should override default, got %v", config.OpenAI.Model)
+	}
+	if config.Port != "9200" {
+		t.Errorf("Env should override file, got %v", config.Port)
+	}
+	if config.SessionTTL != 2*time.Minute {
+		t.Errorf("Flag should override file, got %v", config.SessionTTL)
+	}
+	if config.ElevenLabs.ModelID != "eleven_turbo_v2" {
+		t.Errorf("Unset values should keep their defaults, got %v", config.ElevenLabs.ModelID)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	if _, _, err := loadConfig([]string{"--port", "99999"}, io.Discard); err == nil {
+		t.Error("Expected an error for an out of range port")
+	}
+	if _, _, err := loadConfig([]string{"--openai-timeout", "0s"}, io.Discard); err == nil {
+		t.Error("Expected an error for a zero timeout")
+	}
+	if _, _, err := loadConfig([]string{"--daily-llm-tokens", "-1"}, io.Discard); err == nil {
+		t.Error("Expected an error for a negative budget")
+	}
+	if _, _, err := loadConfig([]string{"--admin-token", "short"}, io.Discard); err == nil {
+		t.Error("Expected an error for a short admin token")
+	}
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-secret")
+	t.Setenv("ADMIN_TOKEN", "admin-secret-0123456789")
+
+	config, _, err := loadConfig([]string{"--print-config"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := shared.PrintConfig(&out, config.Redacted()); err != nil {
+		t.Fatalf("Failed to print config: %v", err)
+	}
+	if strings.Contains(out.String(), "sk-secret") {
+		t.Error("API key leaked into printed config")
+	}
+	if strings.Contains(out.String(), "admin-secret") {
+		t.Error("Admin token leaked into printed config")
+	}
+	if !strings.Contains(out.String(), "REDACTED") {
+		t.Error("Expected redacted marker in printed config")
+	}
+}
@@ -2,65 +2,177 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
-)
 
-const (
-	ElevenlabsAPIURL = "https://api.elevenlabs.io/v1/text-to-speech"
-	Model = "eleven_turbo_v2"
-	VoiceID   = "Oe8Lhg3t63j9BsrTQBjx" // Yowz - South London Bloke
+	"robot-head/shared"
 )
 
 type TTSRequest struct {
-	Text	string		`json:"text"`
-	ModelID	string		`json:"model_id"`
+	Text          string        `json:"text"`
+	ModelID       string        `json:"model_id"`
 	VoiceSettings VoiceSettings `json:"voice_settings"`
 }
 
+// VoiceSettings mirrors ElevenLabs' voice_settings object. Unset fields are
+// left out of the request so the voice's own defaults apply.
 type VoiceSettings struct {
-	Stability 		float64 `json:"stability"`
-	SimilarityBoost float64 `json:"similarity_boost"`
+	Stability       *float64 `json:"stability,omitempty" yaml:"stability,omitempty"`
+	SimilarityBoost *float64 `json:"similarity_boost,omitempty" yaml:"similarity_boost,omitempty"`
+	Style           *float64 `json:"style,omitempty" yaml:"style,omitempty"`
+	UseSpeakerBoost *bool    `json:"use_speaker_boost,omitempty" yaml:"use_speaker_boost,omitempty"`
+	Speed           *float64 `json:"speed,omitempty" yaml:"speed,omitempty"`
+}
+
+// merge returns s with every field set in override replaced.
+func (s VoiceSettings) merge(override VoiceSettings) VoiceSettings {
+	if override.Stability != nil {
+		s.Stability = override.Stability
+	}
+	if override.SimilarityBoost != nil {
+		s.SimilarityBoost = override.SimilarityBoost
+	}
+	if override.Style != nil {
+		s.Style = override.Style
+	}
+	if override.UseSpeakerBoost != nil {
+		s.UseSpeakerBoost = override.UseSpeakerBoost
+	}
+	if override.Speed != nil {
+		s.Speed = override.Speed
+	}
+	return s
+}
+
+// VoiceConfig selects the TTS voice and how it's rendered. Empty fields
+// fall back to the persona and then the server config.
+type VoiceConfig struct {
+	VoiceID      string `yaml:"voice_id,omitempty"`
+	ModelID      string `yaml:"model_id,omitempty"`
+	OutputFormat string `yaml:"output_format,omitempty"`
+	// OptimizeStreamingLatency trades quality for speed, 0 (off) to 4.
+	OptimizeStreamingLatency int           `yaml:"optimize_streaming_latency,omitempty"`
+	Settings                 VoiceSettings `yaml:"settings,omitempty"`
+}
+
+// merge returns v with every field set in override replaced.
+func (v VoiceConfig) merge(override VoiceConfig) VoiceConfig {
+	if override.VoiceID != "" {
+		v.VoiceID = override.VoiceID
+	}
+	if override.ModelID != "" {
+		v.ModelID = override.ModelID
+	}
+	if override.OutputFormat != "" {
+		v.OutputFormat = override.OutputFormat
+	}
+	if override.OptimizeStreamingLatency != 0 {
+		v.OptimizeStreamingLatency = override.OptimizeStreamingLatency
+	}
+	v.Settings = v.Settings.merge(override.Settings)
+	return v
+}
+
+func (v VoiceConfig) validate() error {
+	if v.OptimizeStreamingLatency < 0 || v.OptimizeStreamingLatency > 4 {
+		return fmt.Errorf("optimize_streaming_latency must be between 0 and 4")
+	}
+	settings := []struct {
+		name     string
+		value    *float64
+		min, max float64
+	}{
+		{"stability", v.Settings.Stability, 0, 1},
+		{"similarity_boost", v.Settings.SimilarityBoost, 0, 1},
+		{"style", v.Settings.Style, 0, 1},
+		{"speed", v.Settings.Speed, 0.7, 1.2},
+	}
+	for _, s := range settings {
+		if s.value != nil && (*s.value < s.min || *s.value > s.max) {
+			return fmt.Errorf("%s must be between %v and %v", s.name, s.min, s.max)
+		}
+	}
+	return nil
+}
+
+// MimeType maps an ElevenLabs output_format such as "mp3_44100_128" to the
+// MIME type we tag the audio with.
+func (v VoiceConfig) MimeType() string {
+	switch {
+	case strings.HasPrefix(v.OutputFormat, "pcm_"):
+		return "audio/pcm"
+	case strings.HasPrefix(v.OutputFormat, "ulaw_"):
+		return "audio/basic"
+	case strings.HasPrefix(v.OutputFormat, "opus_"):
+		return "audio/opus"
+	default:
+		return "audio/mpeg"
+	}
+}
+
+// voiceConfigFromMessage converts a client's voice selection into an
+// override for the session.
+func voiceConfigFromMessage(data shared.VoiceData) VoiceConfig {
+	return VoiceConfig{
+		VoiceID:                  data.VoiceID,
+		ModelID:                  data.ModelID,
+		OutputFormat:             data.OutputFormat,
+		OptimizeStreamingLatency: data.OptimizeStreamingLatency,
+		Settings: VoiceSettings{
+			Stability:       data.Stability,
+			SimilarityBoost: data.SimilarityBoost,
+			Style:           data.Style,
+			UseSpeakerBoost: data.UseSpeakerBoost,
+			Speed:           data.Speed,
+		},
+	}
 }
 
 func getElevenLabsAPIKey() (string, error) {
-	if key := os.Getenv("ELEVENLABS_API_KEY"); key != "" {
-		return key, nil
+	if cfg.ElevenLabs.APIKey != "" {
+		return cfg.ElevenLabs.APIKey, nil
 	}
 
-	  	homeDir, err := os.UserHomeDir()
-  	if err != nil {
-  		return "", fmt.Errorf("could not get home directory: %v", err)
-  	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not get home directory: %v", err)
+	}
 
-  	keyPath := filepath.Join(homeDir, ".api_keys", "elevenlabs_key")
-  	keyBytes, err := os.ReadFile(keyPath)
-  	if err != nil {
-  		return "", fmt.Errorf("could not read ElevenLabs API key: %v", err)
-  	}
+	keyPath := filepath.Join(homeDir, ".api_keys", "elevenlabs_key")
+	keyBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return "", fmt.Errorf("could not read ElevenLabs API key: %v", err)
+	}
 
-  	return strings.TrimSpace(string(keyBytes)), nil
+	return strings.TrimSpace(string(keyBytes)), nil
 }
 
-func generateSpeech(text string) ([]byte, error) {
+// newTTSRequest builds a text-to-speech request. path is appended to the
+// voice endpoint, e.g. "/stream".
+func newTTSRequest(text string, voice VoiceConfig, path string) (*http.Request, error) {
 	apiKey, err := getElevenLabsAPIKey()
 	if err != nil {
 		return nil, err
 	}
 
-	request := TTSRequest {
-		Text : text,
-		ModelID: Model,
-		VoiceSettings : VoiceSettings{
-			Stability: 0.5,
-			SimilarityBoost: 0.5,
-		},
+	modelID := voice.ModelID
+	if modelID == "" {
+		modelID = cfg.ElevenLabs.ModelID
+	}
+
+	request := TTSRequest{
+		Text:          text,
+		ModelID:       modelID,
+		VoiceSettings: voice.Settings,
 	}
 
 	requestJson, err := json.Marshal(request)
@@ -68,32 +180,214 @@ func generateSpeech(text string) ([]byte, error) {
 		return nil, err
 	}
 
-	url := fmt.Sprintf("%s/%s", ElevenlabsAPIURL, VoiceID)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestJson))
+	query := url.Values{}
+	if voice.OutputFormat != "" {
+		query.Set("output_format", voice.OutputFormat)
+	}
+	if voice.OptimizeStreamingLatency > 0 {
+		query.Set("optimize_streaming_latency", strconv.Itoa(voice.OptimizeStreamingLatency))
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/text-to-speech/%s%s", cfg.ElevenLabs.BaseURL, url.PathEscape(voice.VoiceID), path)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(requestJson))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Accept", "audio/mpeg")
-  	req.Header.Set("Content-Type", "application/json")
-  	req.Header.Set("xi-api-key", apiKey)
+	req.Header.Set("Accept", voice.MimeType())
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("xi-api-key", apiKey)
+	return req, nil
+}
 
-  	client := &http.Client{Timeout: 30 * time.Second}
-  	resp, err := client.Do(req)
-  	if err != nil {
-  		return nil, err
-  	}
-  	defer resp.Body.Close()
+// doTTSRequest sends the request and turns non-200 responses into
+// *UpstreamErrors.
+// The caller must close the response body.
+func doTTSRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := elevenLabsUpstream.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
 
-  	if resp.StatusCode != http.StatusOK {
-  	body, err := io.ReadAll(resp.Body)
-  	if err != nil {
-  		return nil, fmt.Errorf("TTS API error %d, couldn't read error response", resp.StatusCode)
-  	}
-  	return nil, fmt.Errorf("TTS API error %d: %s", resp.StatusCode, string(body))
-  }
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, newUpstreamError(&UpstreamError{Upstream: "elevenlabs", Kind: statusKind(resp.StatusCode), Status: resp.StatusCode, Err: err})
+		}
+		return nil, parseElevenLabsError(resp.StatusCode, body)
+	}
+	return resp, nil
+}
 
+func generateSpeech(ctx context.Context, text string, voice VoiceConfig) ([]byte, error) {
+	req, err := newTTSRequest(text, voice, "")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doTTSRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-  	return io.ReadAll(resp.Body)
+	return io.ReadAll(resp.Body)
+}
 
+type timestampsResponse struct {
+	AudioBase64         string     `json:"audio_base64"`
+	Alignment           *Alignment `json:"alignment"`
+	NormalizedAlignment *Alignment `json:"normalized_alignment"`
 }
 
+// generateSpeechWithTimestamps uses the with-timestamps endpoint, which
+// returns the audio along with when each character is spoken. The alignment
+// is nil if ElevenLabs didn't send one.
+func generateSpeechWithTimestamps(ctx context.Context, text string, voice VoiceConfig) ([]byte, *Alignment, error) {
+	req, err := newTTSRequest(text, voice, "/with-timestamps")
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := doTTSRequest(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var parsed timestampsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse TTS response: %w", err)
+	}
+	audio, err := base64.StdEncoding.DecodeString(parsed.AudioBase64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode TTS audio: %w", err)
+	}
+
+	// The plain alignment matches the text we sent; the normalised one
+	// spells out numbers and such, which is still better than nothing.
+	alignment := parsed.Alignment
+	if alignment == nil {
+		alignment = parsed.NormalizedAlignment
+	}
+	return audio, alignment, nil
+}
+
+// synthesize renders text to speech along with its character timing, using
+// ElevenLabs' timestamps when enabled and estimating otherwise.
+func synthesize(ctx context.Context, text string, voice VoiceConfig) ([]byte, Alignment, error) {
+	if !cfg.ElevenLabs.Timestamps {
+		audio, err := generateSpeech(ctx, text, voice)
+		if err != nil {
+			return nil, Alignment{}, err
+		}
+		return audio, estimateSpeech(text, voice), nil
+	}
+
+	audio, alignment, err := generateSpeechWithTimestamps(ctx, text, voice)
+	if err != nil {
+		return nil, Alignment{}, err
+	}
+	if alignment == nil {
+		return audio, estimateSpeech(text, voice), nil
+	}
+	return audio, *alignment, nil
+}
+
+// streamChunkSize bounds how much audio goes into one WebSocket message.
+const streamChunkSize = 16 * 1024
+
+// streamSpeech uses the streaming endpoint and hands audio to onChunk as it
+// arrives rather than waiting for the whole file. It returns the number of
+// bytes streamed; if that is zero the caller can still fall back to text.
+func streamSpeech(ctx context.Context, text string, voice VoiceConfig, onChunk func([]byte) error) (int, error) {
+	req, err := newTTSRequest(text, voice, "/stream")
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := doTTSRequest(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	total := 0
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			// onChunk may hold on to the slice, so hand it a copy
+			chunk := append([]byte(nil), buf[:n]...)
+			if err := onChunk(chunk); err != nil {
+				return total, err
+			}
+			total += n
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, fmt.Errorf("TTS stream interrupted: %w", err)
+		}
+	}
+}
+
+type voicesResponse struct {
+	Voices []struct {
+		VoiceID  string            `json:"voice_id"`
+		Name     string            `json:"name"`
+		Category string            `json:"category"`
+		Labels   map[string]string `json:"labels"`
+	} `json:"voices"`
+}
+
+// listVoices fetches the voices available to our ElevenLabs account.
+func listVoices(ctx context.Context) ([]shared.VoiceInfo, error) {
+	apiKey, err := getElevenLabsAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", cfg.ElevenLabs.BaseURL+"/v1/voices", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("xi-api-key", apiKey)
+
+	resp, err := elevenLabsUpstream.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read voices response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseElevenLabsError(resp.StatusCode, body)
+	}
+
+	var parsed voicesResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse voices response: %w", err)
+	}
+
+	voices := make([]shared.VoiceInfo, 0, len(parsed.Voices))
+	for _, v := range parsed.Voices {
+		voices = append(voices, shared.VoiceInfo{
+			VoiceID:  v.VoiceID,
+			Name:     v.Name,
+			Category: v.Category,
+			Labels:   v.Labels,
+		})
+	}
+	return voices, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+// fakeElevenLabs points the config at a local stand-in for the ElevenLabs
+// API for the duration of the test.
+func fakeElevenLabs(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.ElevenLabs.BaseURL = server.URL
+	cfg.ElevenLabs.APIKey = "test-key"
+	fastRetries(t, &elevenLabsUpstream)
+	return server
+}
+
+func floatPtr(f float64) *float64 { return &f }
+func boolPtr(b bool) *bool        { return &b }
+
+func TestGenerateSpeechSendsVoiceSettings(t *testing.T) {
+	var gotPath, gotQuery, gotKey string
+	var gotRequest map[string]interface{}
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotQuery = r.URL.RawQuery
+		gotKey = r.Header.Get("xi-api-key")
+		json.NewDecoder(r.Body).Decode(&gotRequest)
+		w.Write([]byte("mp3 bytes"))
+	})
+
+	voice := VoiceConfig{
+		VoiceID:                  "voice-1",
+		ModelID:                  "eleven_multilingual_v2",
+		OutputFormat:             "mp3_22050_32",
+		OptimizeStreamingLatency: 3,
+		Settings: VoiceSettings{
+			Stability:       floatPtr(0.3),
+			Style:           floatPtr(0.6),
+			UseSpeakerBoost: boolPtr(true),
+			Speed:           floatPtr(1.1),
+		},
+	}
+
+	audio, err := generateSpeech(context.Background(), "hello", voice)
+	if err != nil {
+		t.Fatalf("generateSpeech failed: %v", err)
+	}
+	if string(audio) != "mp3 bytes" {
+		t.Errorf("Unexpected audio %q", audio)
+	}
+
+	if gotPath != "/v1/text-to-speech/voice-1" {
+		t.Errorf("Unexpected path %v", gotPath)
+	}
+	if gotQuery != "optimize_streaming_latency=3&output_format=mp3_22050_32" {
+		t.Errorf("Unexpected query %v", gotQuery)
+	}
+	if gotKey != "test-key" {
+		t.Errorf("Expected API key header, got %q", gotKey)
+	}
+	if gotRequest["model_id"] != "eleven_multilingual_v2" {
+		t.Errorf("Unexpected model id %v", gotRequest["model_id"])
+	}
+
+	settings, _ := gotRequest["voice_settings"].(map[string]interface{})
+	if settings["style"] != 0.6 || settings["use_speaker_boost"] != true || settings["speed"] != 1.1 {
+		t.Errorf("Voice settings not sent: %v", settings)
+	}
+	if _, ok := settings["similarity_boost"]; ok {
+		t.Error("Unset settings should be left out of the request")
+	}
+}
+
+func TestGenerateSpeechDefaultsModel(t *testing.T) {
+	var gotRequest map[string]interface{}
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&gotRequest)
+		w.Write([]byte("mp3 bytes"))
+	})
+
+	if _, err := generateSpeech(context.Background(), "hello", VoiceConfig{VoiceID: "voice-1"}); err != nil {
+		t.Fatalf("generateSpeech failed: %v", err)
+	}
+	if gotRequest["model_id"] != cfg.ElevenLabs.ModelID {
+		t.Errorf("Expected configured model, got %v", gotRequest["model_id"])
+	}
+}
+
+func TestGenerateSpeechAPIError(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"detail":"invalid api key"}`))
+	})
+
+	if _, err := generateSpeech(context.Background(), "hello", VoiceConfig{VoiceID: "voice-1"}); err == nil {
+		t.Error("Expected an error for a 401 response")
+	}
+}
+
+func TestListVoices(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/voices" {
+			t.Errorf("Unexpected path %v", r.URL.Path)
+		}
+		w.Write([]byte(`{"voices":[
+			{"voice_id":"a1","name":"Yowz","category":"cloned","labels":{"accent":"british"}},
+			{"voice_id":"b2","name":"Rachel","category":"premade"}
+		]}`))
+	})
+
+	voices, err := listVoices(context.Background())
+	if err != nil {
+		t.Fatalf("listVoices failed: %v", err)
+	}
+	if len(voices) != 2 {
+		t.Fatalf("Expected 2 voices, got %d", len(voices))
+	}
+	if voices[0].Name != "Yowz" || voices[0].Labels["accent"] != "british" {
+		t.Errorf("Unexpected first voice %+v", voices[0])
+	}
+}
+
+func TestVoiceConfigMerge(t *testing.T) {
+	base := cfg.ElevenLabs.defaultVoice()
+	merged := base.merge(VoiceConfig{VoiceID: "other", Settings: VoiceSettings{Speed: floatPtr(0.9)}})
+
+	if merged.VoiceID != "other" {
+		t.Errorf("Expected overridden voice id, got %v", merged.VoiceID)
+	}
+	if merged.ModelID != base.ModelID {
+		t.Errorf("Expected model id to be kept, got %v", merged.ModelID)
+	}
+	if merged.Settings.Stability == nil || *merged.Settings.Stability != 0.5 {
+		t.Error("Expected base stability to be kept")
+	}
+	if merged.Settings.Speed == nil || *merged.Settings.Speed != 0.9 {
+		t.Error("Expected speed override")
+	}
+}
+
+func TestVoiceConfigValidate(t *testing.T) {
+	if err := (VoiceConfig{Settings: VoiceSettings{Stability: floatPtr(1.5)}}).validate(); err == nil {
+		t.Error("Expected an error for stability above 1")
+	}
+	if err := (VoiceConfig{OptimizeStreamingLatency: 5}).validate(); err == nil {
+		t.Error("Expected an error for latency optimisation above 4")
+	}
+	if err := cfg.ElevenLabs.defaultVoice().validate(); err != nil {
+		t.Errorf("Default voice should be valid: %v", err)
+	}
+}
+
+func TestVoiceMimeType(t *testing.T) {
+	cases := map[string]string{
+		"":              "audio/mpeg",
+		"mp3_44100_128": "audio/mpeg",
+		"pcm_16000":     "audio/pcm",
+		"ulaw_8000":     "audio/basic",
+	}
+	for format, want := range cases {
+		if got := (VoiceConfig{OutputFormat: format}).MimeType(); got != want {
+			t.Errorf("%q: expected %v, got %v", format, want, got)
+		}
+	}
+}
+
+func TestStreamSpeechForwardsChunks(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/text-to-speech/voice-1/stream" {
+			t.Errorf("Unexpected path %v", r.URL.Path)
+		}
+		flusher := w.(http.Flusher)
+		for _, part := range []string{"first", "second", "third"} {
+			w.Write([]byte(part))
+			flusher.Flush()
+		}
+	})
+
+	var received string
+	total, err := streamSpeech(context.Background(), "hello", VoiceConfig{VoiceID: "voice-1"}, func(chunk []byte) error {
+		received += string(chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamSpeech failed: %v", err)
+	}
+	if received != "firstsecondthird" || total != len(received) {
+		t.Errorf("Unexpected stream %q (%d bytes)", received, total)
+	}
+}
+
+func TestStreamSpeechOutlastsTheTimeout(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		for _, part := range []string{"slow", "ly", "spoken"} {
+			w.Write([]byte(part))
+			flusher.Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+	})
+	cfg.ElevenLabs.Timeout = 50 * time.Millisecond
+
+	var received string
+	_, err := streamSpeech(context.Background(), "hello", VoiceConfig{VoiceID: "voice-1"}, func(chunk []byte) error {
+		received += string(chunk)
+		return nil
+	})
+	if err != nil || received != "slowlyspoken" {
+		t.Errorf("Expected the whole stream despite the timeout, got %q (%v)", received, err)
+	}
+}
+
+func TestStreamResponseMessages(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("audio"))
+	})
+
+	var sent []shared.Message
+	send := func(m shared.Message) error {
+		sent = append(sent, m)
+		return nil
+	}
+
+	if _, err := streamResponse(context.Background(), "hi there", VoiceConfig{VoiceID: "voice-1"}, send); err != nil {
+		t.Fatalf("streamResponse failed: %v", err)
+	}
+	if len(sent) < 2 {
+		t.Fatalf("Expected audio and final chunks, got %d messages", len(sent))
+	}
+
+	first := sent[0].Data.(shared.AudioChunk)
+	last := sent[len(sent)-1].Data.(shared.AudioChunk)
+	if first.Text != "hi there" || first.Seq != 0 {
+		t.Errorf("First chunk should carry the text, got %+v", first)
+	}
+	if !last.Final || last.StreamID != first.StreamID {
+		t.Errorf("Last chunk should close the stream, got %+v", last)
+	}
+}
+
+func TestStreamResponseNothingSentOnError(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	sent := 0
+	streamed, err := streamResponse(context.Background(), "hi", VoiceConfig{VoiceID: "voice-1"}, func(shared.Message) error {
+		sent++
+		return nil
+	})
+	if err == nil || streamed != 0 || sent != 0 {
+		t.Errorf("Expected an error and no messages, got err=%v streamed=%d sent=%d", err, streamed, sent)
+	}
+}
+
+func TestSynthesizeUsesTimestamps(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/text-to-speech/voice-1/with-timestamps" {
+			t.Errorf("Unexpected path %v", r.URL.Path)
+		}
+		w.Write([]byte(`{
+			"audio_base64": "bXAzIGJ5dGVz",
+			"alignment": {
+				"characters": ["h", "i"],
+				"character_start_times_seconds": [0, 0.1],
+				"character_end_times_seconds": [0.1, 0.25]
+			}
+		}`))
+	})
+	cfg.ElevenLabs.Timestamps = true
+
+	audio, alignment, err := synthesize(context.Background(), "hi", VoiceConfig{VoiceID: "voice-1"})
+	if err != nil {
+		t.Fatalf("synthesize failed: %v", err)
+	}
+	visemes := alignment.Visemes()
+	if string(audio) != "mp3 bytes" {
+		t.Errorf("Unexpected audio %q", audio)
+	}
+	if len(visemes) != 2 || visemes[1].Viseme != shared.VisemeAI || visemes[1].End != 0.25 {
+		t.Errorf("Expected visemes from the alignment, got %+v", visemes)
+	}
+}
+
+func TestSynthesizeEstimatesWithoutTimestamps(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("mp3 bytes"))
+	})
+	cfg.ElevenLabs.Timestamps = false
+
+	_, alignment, err := synthesize(context.Background(), "hi", VoiceConfig{VoiceID: "voice-1"})
+	if err != nil {
+		t.Fatalf("synthesize failed: %v", err)
+	}
+	if len(alignment.Visemes()) == 0 {
+		t.Error("Expected an estimated viseme timeline")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"robot-head/shared"
+)
+
+// What went wrong with an upstream API, whichever one it was. Check for
+// them with errors.Is.
+var (
+	ErrUpstreamAuth    = errors.New("not authorized")
+	ErrQuotaExceeded   = errors.New("quota exceeded")
+	ErrRateLimited     = errors.New("rate limited")
+	ErrBadInput        = errors.New("bad input")
+	ErrContentFiltered = errors.New("content filtered")
+	ErrTimeout         = errors.New("timed out")
+	ErrUnavailable     = errors.New("unavailable")
+)
+
+// UpstreamError is a failed call to an upstream API, with what the
+// provider said about it.
+type UpstreamError struct {
+	Upstream string
+	// Kind is one of the Err sentinels above
+	Kind error
+	// Status is the HTTP status, 0 if there was no response
+	Status int
+	// Code and Message are from the provider's error body
+	Code    string
+	Message string
+	// Err is the transport error, if that's what it was
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	msg := e.Upstream + ": " + e.Kind.Error()
+	if e.Status != 0 {
+		msg += fmt.Sprintf(" (HTTP %d)", e.Status)
+	}
+	switch {
+	case e.Message != "":
+		msg += ": " + e.Message
+	case e.Err != nil:
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *UpstreamError) Is(target error) bool { return target == e.Kind }
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// newUpstreamError counts the error and returns it.
+func newUpstreamError(e *UpstreamError) *UpstreamError {
+	m, _ := meaningOf(e)
+	upstreamErrorsTotal.inc(e.Upstream, m.code)
+	return e
+}
+
+// statusKind is what an HTTP status means when the body doesn't say more.
+func statusKind(status int) error {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrUpstreamAuth
+	case status == http.StatusPaymentRequired:
+		return ErrQuotaExceeded
+	case status == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return ErrTimeout
+	case status >= 500:
+		return ErrUnavailable
+	}
+	return ErrBadInput
+}
+
+// parseOpenAIError reads an OpenAI error response:
+// {"error": {"message": "...", "type": "...", "code": "..."}}
+func parseOpenAIError(status int, body []byte) *UpstreamError {
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    any    `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &parsed)
+	e := &UpstreamError{Upstream: "openai", Status: status, Message: parsed.Error.Message}
+	// code is usually a string but can be null
+	if code, ok := parsed.Error.Code.(string); ok {
+		e.Code = code
+	}
+	if e.Code == "" {
+		e.Code = parsed.Error.Type
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	switch e.Code {
+	case "invalid_api_key", "invalid_organization":
+		e.Kind = ErrUpstreamAuth
+	case "insufficient_quota", "billing_hard_limit_reached":
+		e.Kind = ErrQuotaExceeded
+	case "content_filter", "content_policy_violation":
+		e.Kind = ErrContentFiltered
+	case "rate_limit_exceeded":
+		e.Kind = ErrRateLimited
+	default:
+		e.Kind = statusKind(status)
+	}
+	return newUpstreamError(e)
+}
+
+// parseElevenLabsError reads an ElevenLabs error response. detail is
+// usually {"status": "...", "message": "..."}, but can be a plain string or
+// a list of validation errors.
+func parseElevenLabsError(status int, body []byte) *UpstreamError {
+	var parsed struct {
+		Detail json.RawMessage `json:"detail"`
+	}
+	json.Unmarshal(body, &parsed)
+	e := &UpstreamError{Upstream: "elevenlabs", Status: status}
+	var detail struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(parsed.Detail, &detail) == nil {
+		e.Code, e.Message = detail.Status, detail.Message
+	} else {
+		json.Unmarshal(parsed.Detail, &e.Message)
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	switch e.Code {
+	case "invalid_api_key", "needs_authorization", "missing_permissions":
+		e.Kind = ErrUpstreamAuth
+	case "quota_exceeded":
+		e.Kind = ErrQuotaExceeded
+	case "too_many_concurrent_requests", "system_busy":
+		e.Kind = ErrRateLimited
+	default:
+		e.Kind = statusKind(status)
+	}
+	return newUpstreamError(e)
+}
+
+// transportError classifies a request that got no response.
+func (u *upstream) transportError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		// The client went away; nobody to tell
+		return err
+	}
+	e := &UpstreamError{Upstream: u.name, Kind: ErrUnavailable, Err: err}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		e.Kind = ErrTimeout
+	}
+	return newUpstreamError(e)
+}
+
+// errorMeaning is what a kind of upstream error means to the user.
+type errorMeaning struct {
+	kind      error
+	code      string
+	retryable bool
+	message   string
+}
+
+var errorMeanings = []errorMeaning{
+	{ErrUpstreamAuth, shared.ErrorCodeUpstreamAuth, false, "Sorry, I can't get through to my services. Someone needs to check my keys."},
+	{ErrQuotaExceeded, shared.ErrorCodeQuotaExceeded, false, "Sorry, I've run out of credit with my services for now."},
+	{ErrRateLimited, shared.ErrorCodeRateLimited, true, "I'm getting a lot of questions right now. Ask me again in a moment."},
+	{ErrBadInput, shared.ErrorCodeUpstreamRejected, false, "Sorry, I couldn't make sense of that. Try saying it another way."},
+	{ErrContentFiltered, shared.ErrorCodeContentFiltered, false, "Sorry, that's not something I can talk about."},
+	{ErrTimeout, shared.ErrorCodeTimeout, true, "Sorry, that took me too long. Please ask again."},
+	{ErrUnavailable, shared.ErrorCodeUnavailable, true, "Sorry, my services aren't answering right now. Try again in a little while."},
+}
+
+// meaningOf looks up what err means, if it's an upstream error.
+func meaningOf(err error) (errorMeaning, bool) {
+	for _, m := range errorMeanings {
+		if errors.Is(err, m.kind) {
+			return m, true
+		}
+	}
+	return errorMeaning{}, false
+}
+
+// errorReply is an error message for the client.
+func errorReply(data shared.ErrorData) shared.Message {
+	return shared.Message{
+		Type:      shared.MessageTypeError,
+		Timestamp: time.Now().Unix(),
+		Data:      data,
+	}
+}
+
+// protocolError answers a message the server couldn't use.
+func protocolError(message string) shared.Message {
+	return errorReply(shared.ErrorData{Code: shared.ErrorCodeBadRequest, Stage: shared.StageProtocol, Message: message})
+}
+
+// upstreamErrorReply tells the client why a stage failed, or just says
+// fallback if it wasn't an upstream error.
+func upstreamErrorReply(stage string, err error, fallback string) shared.Message {
+	m, ok := meaningOf(err)
+	if !ok {
+		m = errorMeaning{code: shared.ErrorCodeInternal, message: fallback}
+	}
+	return errorReply(shared.ErrorData{Code: m.code, Stage: stage, Retryable: m.retryable, Message: m.message})
+}
+
+// maxErrorSpeech bounds the spoken error cache. There are only a handful
+// of messages, but clients can pick any voice.
+const maxErrorSpeech = 64
+
+// errorSpeech caches spoken error messages by voice and text, so a run of
+// failures doesn't pay for the same apology each time.
+var errorSpeech = struct {
+	sync.Mutex
+	audio map[string][]byte
+}{audio: map[string][]byte{}}
+
+// speakError adds the spoken message to a failed turn's error for clients
+// that play audio, so the robot apologises out loud instead of going
+// quiet. Errors answering commands aren't spoken, nor are TTS errors.
+func speakError(ctx context.Context, session *Session, msg shared.Message) shared.Message {
+	data, ok := msg.Data.(shared.ErrorData)
+	if !ok || !cfg.SpeakErrors || !session.HasCapability(shared.CapabilityAudioOutput) {
+		return msg
+	}
+	switch data.Stage {
+	case shared.StageSTT, shared.StageLLM, shared.StageLimits:
+	default:
+		return msg
+	}
+
+	voice := personas.Resolve(session.Persona()).TTSVoice().merge(session.Voice())
+	voiceKey, _ := json.Marshal(voice)
+	key := string(voiceKey) + "\n" + data.Message
+	errorSpeech.Lock()
+	audio, ok := errorSpeech.audio[key]
+	errorSpeech.Unlock()
+
+	if !ok {
+		characters := utf8.RuneCountInString(data.Message)
+		if !budget.ReserveTTS(characters) {
+			return msg
+		}
+		// The turn may have run out of time, which is often what failed
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.ElevenLabs.Timeout)
+		defer cancel()
+		var err error
+		audio, err = generateSpeech(ctx, data.Message, voice)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to speak error", "code", data.Code, "error", err)
+			budget.RefundTTS(characters)
+			return msg
+		}
+		recordSpend(ctx, session, TurnUsage{TTSCharacters: characters})
+
+		errorSpeech.Lock()
+		if len(errorSpeech.audio) >= maxErrorSpeech {
+			clear(errorSpeech.audio)
+		}
+		errorSpeech.audio[key] = audio
+		errorSpeech.Unlock()
+	}
+
+	data.AudioData, data.MimeType = audio, voice.MimeType()
+	msg.Data = data
+	return msg
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+func TestParseOpenAIError(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		kind   error
+		code   string
+	}{
+		{401, `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`, ErrUpstreamAuth, "invalid_api_key"},
+		{429, `{"error":{"message":"You exceeded your current quota","type":"insufficient_quota","code":"insufficient_quota"}}`, ErrQuotaExceeded, "insufficient_quota"},
+		{429, `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`, ErrRateLimited, "rate_limit_exceeded"},
+		{400, `{"error":{"message":"Your request was rejected","type":"invalid_request_error","code":"content_policy_violation"}}`, ErrContentFiltered, "content_policy_violation"},
+		{400, `{"error":{"message":"Invalid model","type":"invalid_request_error","code":null}}`, ErrBadInput, "invalid_request_error"},
+		{503, `<html>Service Unavailable</html>`, ErrUnavailable, ""},
+		{504, ``, ErrTimeout, ""},
+	}
+	for _, c := range cases {
+		err := parseOpenAIError(c.status, []byte(c.body))
+		if !errors.Is(err, c.kind) || err.Code != c.code {
+			t.Errorf("%d %s: expected %v with code %q, got %v with code %q", c.status, c.body, c.kind, c.code, err.Kind, err.Code)
+		}
+		if err.Message == "" && c.body != "" {
+			t.Errorf("%d %s: expected a message", c.status, c.body)
+		}
+	}
+}
+
+func TestParseElevenLabsError(t *testing.T) {
+	cases := []struct {
+		status  int
+		body    string
+		kind    error
+		message string
+	}{
+		{401, `{"detail":{"status":"invalid_api_key","message":"Invalid API key"}}`, ErrUpstreamAuth, "Invalid API key"},
+		{401, `{"detail":{"status":"quota_exceeded","message":"This request exceeds your quota"}}`, ErrQuotaExceeded, "This request exceeds your quota"},
+		{429, `{"detail":{"status":"too_many_concurrent_requests","message":"Too many"}}`, ErrRateLimited, "Too many"},
+		{401, `{"detail":"invalid api key"}`, ErrUpstreamAuth, "invalid api key"},
+		{422, `{"detail":[{"loc":["body","text"],"msg":"field required"}]}`, ErrBadInput, ""},
+		{500, `oops`, ErrUnavailable, "oops"},
+	}
+	for _, c := range cases {
+		err := parseElevenLabsError(c.status, []byte(c.body))
+		if !errors.Is(err, c.kind) {
+			t.Errorf("%d %s: expected %v, got %v", c.status, c.body, c.kind, err)
+		}
+		if c.message != "" && err.Message != c.message {
+			t.Errorf("%d %s: expected message %q, got %q", c.status, c.body, c.message, err.Message)
+		}
+	}
+}
+
+func TestUpstreamTransportErrors(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := listVoices(ctx)
+	var upstreamErr *UpstreamError
+	if !errors.Is(err, ErrTimeout) || !errors.As(err, &upstreamErr) || upstreamErr.Upstream != "elevenlabs" {
+		t.Errorf("Expected an elevenlabs timeout, got %v", err)
+	}
+
+	// A cancelled turn isn't the upstream's fault
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := listVoices(ctx); errors.As(err, &upstreamErr) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancellation as is, got %v", err)
+	}
+}
+
+func TestLLMErrorReplies(t *testing.T) {
+	var status int
+	var body string
+	fakeOpenAI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+	cfg.Transcripts.Enabled = false
+
+	registry := NewSessionRegistry(time.Minute)
+	session, _ := registry.Attach("robot-1", "", []string{shared.CapabilityTextInput})
+	cases := []struct {
+		status    int
+		body      string
+		code      string
+		retryable bool
+	}{
+		{401, `{"error":{"message":"Incorrect API key provided","code":"invalid_api_key"}}`, shared.ErrorCodeUpstreamAuth, false},
+		{429, `{"error":{"message":"You exceeded your current quota","code":"insufficient_quota"}}`, shared.ErrorCodeQuotaExceeded, false},
+		{400, `{"error":{"message":"Your request was rejected","code":"content_policy_violation"}}`, shared.ErrorCodeContentFiltered, false},
+		{503, ``, shared.ErrorCodeUnavailable, true},
+	}
+	messages := map[string]bool{}
+	for _, c := range cases {
+		status, body = c.status, c.body
+		reply := createResponse(context.Background(), session, shared.Message{Type: shared.MessageTypeUserInput, Data: "hello"}, func(shared.Message) error { return nil })
+		data, ok := reply.Data.(shared.ErrorData)
+		if reply.Type != shared.MessageTypeError || !ok || data.Code != c.code || data.Stage != shared.StageLLM || data.Retryable != c.retryable {
+			t.Errorf("%d: expected an llm error with code %s, got %+v", c.status, c.code, reply)
+		}
+		messages[data.Message] = true
+	}
+	if len(messages) != len(cases) {
+		t.Errorf("Expected a different message for each code, got %v", messages)
+	}
+}
+
+func TestServerErrorReplies(t *testing.T) {
+	fakeOpenAI(t, replyWith("Hello there.", 12))
+	cfg.Transcripts.Enabled = false
+	deviceLimiter = newTurnLimiter(1)
+	defer func() { deviceLimiter = nil }()
+	defer whisperFailures.Store(0)
+
+	registry := NewSessionRegistry(time.Minute)
+	session, _ := registry.Attach("robot-1", "", []string{shared.CapabilityTextInput, shared.CapabilityAudioInput})
+	ask := shared.Message{Type: shared.MessageTypeUserInput, Data: "hello"}
+	send := func(shared.Message) error { return nil }
+
+	// The server's own limit is worth waiting out, and says for how long
+	createResponse(context.Background(), session, ask, send)
+	data, ok := createResponse(context.Background(), session, ask, send).Data.(shared.ErrorData)
+	if !ok || data.Code != shared.ErrorCodeRateLimited || data.Stage != shared.StageLimits || !data.Retryable || data.RetryAfterMS <= 0 {
+		t.Errorf("Expected a retryable limits error with a delay, got %+v", data)
+	}
+
+	// Without a whisper model transcription fails, and would again
+	audio := shared.Message{Type: shared.MessageTypeAudio, Data: shared.AudioData{AudioData: make([]byte, 320), MimeType: "audio/pcm"}}
+	data, ok = createResponse(context.Background(), session, audio, send).Data.(shared.ErrorData)
+	if !ok || data.Code != shared.ErrorCodeSTTFailed || data.Stage != shared.StageSTT || data.Retryable {
+		t.Errorf("Expected a final stt error, got %+v", data)
+	}
+}
+
+func TestContentFilteredReply(t *testing.T) {
+	fakeOpenAI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":""},"finish_reason":"content_filter"}],"usage":{"total_tokens":7}}`))
+	})
+
+	_, usage, err := callLLM(context.Background(), Persona{}, nil, "hello", nil)
+	if !errors.Is(err, ErrContentFiltered) || usage.TotalTokens != 7 {
+		t.Errorf("Expected a content filter error with usage, got %v and %+v", err, usage)
+	}
+}
+
+func TestSpeakError(t *testing.T) {
+	calls := 0
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("sorry audio"))
+	})
+	cfg.SpeakErrors = true
+	usageLedger = NewUsageLedger()
+	defer func() { usageLedger = NewUsageLedger() }()
+	errorSpeech.Lock()
+	clear(errorSpeech.audio)
+	errorSpeech.Unlock()
+
+	registry := NewSessionRegistry(time.Minute)
+	speaker, _ := registry.Attach("robot-1", "", []string{shared.CapabilityAudioOutput})
+	timeout := upstreamErrorReply(shared.StageLLM, &UpstreamError{Upstream: "openai", Kind: ErrTimeout}, "")
+	for range 2 {
+		data := speakError(context.Background(), speaker, timeout).Data.(shared.ErrorData)
+		if string(data.AudioData) != "sorry audio" || data.MimeType != "audio/mpeg" {
+			t.Errorf("Expected the error spoken, got %+v", data)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the speech to be cached, got %d TTS calls", calls)
+	}
+	if s := usageLedger.Report().Sessions["robot-1"]; s.Turns != 0 || s.TTSCharacters == 0 {
+		t.Errorf("Expected the speech in the usage totals, got %+v", s)
+	}
+
+	// Commands and text-only clients get no speech
+	typist, _ := registry.Attach("robot-2", "", []string{shared.CapabilityTextInput})
+	for _, c := range []struct {
+		session *Session
+		reply   shared.Message
+	}{
+		{speaker, protocolError("Unknown persona")},
+		{typist, timeout},
+	} {
+		if data := speakError(context.Background(), c.session, c.reply).Data.(shared.ErrorData); data.AudioData != nil {
+			t.Errorf("Expected no speech for %+v", data)
+		}
+	}
+}
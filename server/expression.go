@@ -0,0 +1,97 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"robot-head/shared"
+)
+
+// expressionNames are the expressions we suggest to the LLM. Clients show
+// a neutral face for anything they don't recognise, so tags outside this
+// list are still forwarded.
+var expressionNames = []string{
+	"neutral", "happy", "sad", "surprised", "thinking", "wink", "angry", "confused",
+}
+
+// expressionInstructions is appended to the persona's system prompt for
+// clients that can show expressions.
+var expressionInstructions = "\n\nYou have a face. To change your expression, put a tag such as [happy] " +
+	"just before the words it goes with. Available expressions: " +
+	strings.Join(expressionNames, ", ") + ". " +
+	"Use them sparingly, at most one per sentence, and never explain or read them out."
+
+var expressionTagPattern = regexp.MustCompile(`\[([A-Za-z_-]+)\]`)
+
+// expressionCue is an expression tag found in a reply. Offset is where it
+// was in the reply with the tags removed, counted in runes.
+type expressionCue struct {
+	Name   string
+	Offset int
+}
+
+// extractExpressions strips expression tags from an LLM reply so they
+// aren't spoken, returning the clean text and the tags in order.
+func extractExpressions(reply string) (string, []expressionCue) {
+	var clean strings.Builder
+	var cues []expressionCue
+	last := 0
+	for _, match := range expressionTagPattern.FindAllStringSubmatchIndex(reply, -1) {
+		clean.WriteString(reply[last:match[0]])
+		last = match[1]
+		// Don't leave a doubled or leading space where the tag was
+		text := clean.String()
+		if strings.HasPrefix(reply[last:], " ") && (text == "" || strings.HasSuffix(text, " ")) {
+			last++
+		}
+		cues = append(cues, expressionCue{
+			Name:   strings.ToLower(reply[match[2]:match[3]]),
+			Offset: utf8.RuneCountInString(text),
+		})
+	}
+	if cues == nil {
+		return reply, nil
+	}
+	clean.WriteString(reply[last:])
+	text := strings.TrimRight(clean.String(), " ")
+	// A tag at the very end may have pointed past the trimmed space
+	length := utf8.RuneCountInString(text)
+	for i := range cues {
+		if cues[i].Offset > length {
+			cues[i].Offset = length
+		}
+	}
+	return text, cues
+}
+
+// cuesWithin drops the cues that pointed past the end of a reply that has
+// since been shortened.
+func cuesWithin(cues []expressionCue, reply string) []expressionCue {
+	length := utf8.RuneCountInString(reply)
+	kept := cues[:0]
+	for _, cue := range cues {
+		if cue.Offset <= length {
+			kept = append(kept, cue)
+		}
+	}
+	return kept
+}
+
+// expressionMessages times each cue against the speech and wraps it for
+// the client.
+func expressionMessages(cues []expressionCue, alignment Alignment) []shared.Message {
+	messages := make([]shared.Message, 0, len(cues))
+	for _, cue := range cues {
+		messages = append(messages, shared.Message{
+			Type:      shared.MessageTypeExpression,
+			Timestamp: time.Now().Unix(),
+			Data: shared.ExpressionData{
+				Name: cue.Name,
+				At:   alignment.TimeAt(cue.Offset),
+			},
+		})
+	}
+	return messages
+}
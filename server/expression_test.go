@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+func TestExtractExpressions(t *testing.T) {
+	clean, cues := extractExpressions("[happy] Hello there! [Thinking] Let me see... [wink]")
+
+	if clean != "Hello there! Let me see..." {
+		t.Errorf("Unexpected clean text %q", clean)
+	}
+	want := []expressionCue{{"happy", 0}, {"thinking", 13}, {"wink", 26}}
+	if len(cues) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, cues)
+	}
+	for i := range want {
+		if cues[i] != want[i] {
+			t.Errorf("Cue %d: expected %v, got %v", i, want[i], cues[i])
+		}
+	}
+}
+
+func TestExtractExpressionsWithoutTags(t *testing.T) {
+	clean, cues := extractExpressions("  Nothing to see here ")
+	if clean != "  Nothing to see here " || cues != nil {
+		t.Errorf("Expected the reply unchanged, got %q %v", clean, cues)
+	}
+}
+
+func TestExpressionMessagesUseAlignment(t *testing.T) {
+	alignment := estimateAlignment("Hi there", 1)
+	messages := expressionMessages([]expressionCue{{"happy", 0}, {"surprised", 3}}, alignment)
+
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+	first := messages[0].Data.(shared.ExpressionData)
+	second := messages[1].Data.(shared.ExpressionData)
+	if messages[0].Type != shared.MessageTypeExpression || first.At != 0 {
+		t.Errorf("Unexpected first message %+v", messages[0])
+	}
+	if second.Name != "surprised" || second.At != alignment.StartTimes[3] {
+		t.Errorf("Unexpected second expression %+v", second)
+	}
+}
+
+func TestReplyLimitAppliesAfterExpressions(t *testing.T) {
+	fakeOpenAI(t, replyWith("[happy] Hello there friend. [wink] Bye now.", 10))
+	cfg.Expressions, cfg.Transcripts.Enabled = true, false
+	saved := personas
+	defer func() { personas = saved }()
+	personas = NewPersonaStore()
+	persona := builtinPersona()
+	persona.MaxReplyLength = 19
+	personas.personas[defaultPersonaName] = persona
+
+	registry := NewSessionRegistry(time.Minute)
+	face, _ := registry.Attach("robot-1", "", []string{shared.CapabilityTextInput, shared.CapabilityExpressions})
+	var sent []shared.Message
+	reply := createResponse(context.Background(), face, shared.Message{Type: shared.MessageTypeUserInput, Data: "hi"},
+		func(msg shared.Message) error { sent = append(sent, msg); return nil })
+	if reply.Data != "Hello there friend." {
+		t.Errorf("Expected the tags left out of the limit, got %q", reply.Data)
+	}
+	if len(sent) != 1 || sent[0].Data.(shared.ExpressionData).Name != "happy" {
+		t.Errorf("Expected only the expression before the cut, got %+v", sent)
+	}
+
+	// Without a face to show them, brackets are part of the reply
+	persona.MaxReplyLength = 0
+	personas.personas[defaultPersonaName] = persona
+	typist, _ := registry.Attach("robot-2", "", []string{shared.CapabilityTextInput})
+	reply = createResponse(context.Background(), typist, shared.Message{Type: shared.MessageTypeUserInput, Data: "hi"}, nil)
+	if reply.Data != "[happy] Hello there friend. [wink] Bye now." {
+		t.Errorf("Expected the reply untouched, got %q", reply.Data)
+	}
+}
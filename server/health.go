@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// whisperFailureLimit is how many transcriptions in a row can fail before
+// the model is reported broken.
+const whisperFailureLimit = 3
+
+// whisperFailures counts transcriptions failed since the last success.
+var whisperFailures atomic.Int32
+
+func recordWhisperResult(err error) {
+	if err != nil {
+		whisperFailures.Add(1)
+	} else {
+		whisperFailures.Store(0)
+	}
+}
+
+// serverStarted is when the process came up, for the reported uptime.
+var serverStarted = time.Now()
+
+// check is the outcome of one readiness check.
+type check struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	// CheckedAt is set on probe results, which may be cached.
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+func passed(detail string) check { return check{OK: true, Detail: detail} }
+
+func failed(format string, args ...interface{}) check {
+	return check{Detail: fmt.Sprintf(format, args...)}
+}
+
+// healthReport is what /healthz and /readyz return.
+type healthReport struct {
+	Status   string           `json:"status"`
+	Uptime   string           `json:"uptime"`
+	Sessions int              `json:"sessions"`
+	Clients  int              `json:"clients"`
+	Checks   map[string]check `json:"checks,omitempty"`
+}
+
+// probe calls an upstream API and caches the answer, so health checks
+// every few seconds don't turn into API calls every few seconds.
+type probe struct {
+	name     string
+	run      func(ctx context.Context) error
+	interval time.Duration
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	result check
+	at     time.Time
+}
+
+func (p *probe) check(ctx context.Context) check {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.at.IsZero() && time.Since(p.at) < p.interval {
+		return p.result
+	}
+
+	// The result is shared, so a health checker that gives up first
+	// mustn't leave the next ones a "context canceled"
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.timeout)
+	defer cancel()
+	p.at = time.Now()
+	if err := p.run(ctx); err != nil {
+		// /readyz is unauthenticated, so the details stay in the log
+		slog.WarnContext(ctx, "Readiness probe failed", "upstream", p.name, "error", err)
+		var status *probeStatusError
+		if errors.As(err, &status) {
+			p.result = failed("answered %s", status.status)
+		} else {
+			p.result = failed("unreachable")
+		}
+	} else {
+		p.result = passed("reachable")
+	}
+	at := p.at
+	p.result.CheckedAt = &at
+	return p.result
+}
+
+// probes are the upstream checks, set up by main when health.probe is on.
+var probes map[string]*probe
+
+func newProbes(c HealthConfig) map[string]*probe {
+	return map[string]*probe{
+		"openai":     {name: "openai", run: probeOpenAI, interval: c.ProbeInterval, timeout: c.ProbeTimeout},
+		"elevenlabs": {name: "elevenlabs", run: probeElevenLabs, interval: c.ProbeInterval, timeout: c.ProbeTimeout},
+	}
+}
+
+// probeOpenAI lists the models, which checks the key without spending
+// any tokens.
+func probeOpenAI(ctx context.Context) error {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(cfg.OpenAI.URL, "/chat/completions") + "/models"
+	return probeGet(ctx, url, "Authorization", "Bearer "+apiKey)
+}
+
+// probeElevenLabs fetches the account, which checks the key without
+// spending any characters.
+func probeElevenLabs(ctx context.Context) error {
+	apiKey, err := getElevenLabsAPIKey()
+	if err != nil {
+		return err
+	}
+	return probeGet(ctx, cfg.ElevenLabs.BaseURL+"/v1/user", "xi-api-key", apiKey)
+}
+
+func probeGet(ctx context.Context, url, header, value string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(header, value)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return &probeStatusError{url: url, status: resp.Status}
+	}
+	return nil
+}
+
+// probeStatusError is an upstream that answered a probe, but not with 200.
+type probeStatusError struct {
+	url, status string
+}
+
+func (e *probeStatusError) Error() string { return fmt.Sprintf("%s answered %s", e.url, e.status) }
+
+// readiness checks everything a turn needs: the whisper model, API keys,
+// the upstream APIs if probing is on, their circuit breakers, and room for
+// more sessions. Anyone can ask, so details such as file paths and error
+// text are logged rather than reported.
+func readiness(ctx context.Context) healthReport {
+	report := liveness()
+	report.Checks = map[string]check{}
+
+	switch {
+	case whisperModel == nil:
+		report.Checks["whisper"] = failed("model not loaded")
+	case whisperFailures.Load() >= whisperFailureLimit:
+		report.Checks["whisper"] = failed("last %d transcriptions failed", whisperFailures.Load())
+	default:
+		report.Checks["whisper"] = passed("model loaded")
+	}
+
+	if _, err := getAPIKey(); err != nil {
+		slog.WarnContext(ctx, "OpenAI API key unavailable", "error", err)
+		report.Checks["openai_key"] = failed("no API key configured")
+	} else {
+		report.Checks["openai_key"] = passed("")
+	}
+	if key, err := getElevenLabsAPIKey(); err != nil || key == "" {
+		report.Checks["elevenlabs_key"] = failed("no API key configured")
+	} else {
+		report.Checks["elevenlabs_key"] = passed("")
+	}
+
+	for name, p := range probes {
+		report.Checks[name] = p.check(ctx)
+	}
+	// An open circuit means turns are failing fast rather than calling it
+	for _, u := range []*upstream{openAIUpstream, elevenLabsUpstream} {
+		if state := u.breaker.state(); state == "open" {
+			report.Checks[u.name+"_circuit"] = failed("circuit open after repeated failures")
+		} else {
+			report.Checks[u.name+"_circuit"] = passed(state)
+		}
+	}
+
+	if max := cfg.Health.MaxSessions; max > 0 {
+		if report.Sessions >= max {
+			report.Checks["sessions"] = failed("%d of %d sessions in use", report.Sessions, max)
+		} else {
+			report.Checks["sessions"] = passed(fmt.Sprintf("%d of %d sessions in use", report.Sessions, max))
+		}
+	}
+
+	for _, c := range report.Checks {
+		if !c.OK {
+			report.Status = "unavailable"
+		}
+	}
+	return report
+}
+
+// liveness only says the process is up and serving.
+func liveness() healthReport {
+	report := healthReport{
+		Status:  "ok",
+		Uptime:  time.Since(serverStarted).Round(time.Second).String(),
+		Clients: int(connectedClients.get()),
+	}
+	if sessions != nil {
+		report.Sessions = sessions.Len()
+	}
+	return report
+}
+
+// handleHealthz is the liveness check: if it answers, the server is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, liveness())
+}
+
+// handleReadyz is the readiness check, 503 if any check fails.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, readiness(r.Context()))
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyzReportsEachCheck(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {})
+	cfg.OpenAI.APIKey = "test-key"
+	cfg.Health.MaxSessions = 1
+	sessions = NewSessionRegistry(time.Minute)
+	defer func() { sessions = nil }()
+
+	get := func(handler http.HandlerFunc) (int, healthReport) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		var report healthReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, report
+	}
+
+	// No whisper model is loaded in tests
+	code, report := get(handleReadyz)
+	if code != http.StatusServiceUnavailable || report.Status != "unavailable" {
+		t.Errorf("Expected 503 without a whisper model, got %d %+v", code, report)
+	}
+	if report.Checks["whisper"].OK || !report.Checks["openai_key"].OK || !report.Checks["elevenlabs_key"].OK || !report.Checks["sessions"].OK {
+		t.Errorf("Unexpected checks %+v", report.Checks)
+	}
+	if !report.Checks["openai_circuit"].OK || report.Checks["elevenlabs_circuit"].Detail != "closed" {
+		t.Errorf("Expected closed circuits, got %+v", report.Checks)
+	}
+
+	sessions.Attach("robot-1", "", nil)
+	if _, report := get(handleReadyz); report.Checks["sessions"].OK || report.Sessions != 1 {
+		t.Errorf("Expected the session limit reached, got %+v", report)
+	}
+
+	// Liveness doesn't care about any of that
+	if code, report := get(handleHealthz); code != http.StatusOK || report.Status != "ok" || report.Checks != nil {
+		t.Errorf("Expected a plain 200 from /healthz, got %d %+v", code, report)
+	}
+}
+
+func TestWhisperFailuresMarkModelBroken(t *testing.T) {
+	defer whisperFailures.Store(0)
+	for i := 0; i < whisperFailureLimit; i++ {
+		recordWhisperResult(errors.New("boom"))
+	}
+	if whisperFailures.Load() != whisperFailureLimit {
+		t.Fatalf("Expected %d failures counted, got %d", whisperFailureLimit, whisperFailures.Load())
+	}
+	recordWhisperResult(nil)
+	if whisperFailures.Load() != 0 {
+		t.Error("Expected a success to clear the failures")
+	}
+}
+
+func TestProbeCachesResult(t *testing.T) {
+	calls := 0
+	p := &probe{
+		run: func(ctx context.Context) error {
+			calls++
+			return &probeStatusError{url: "https://api.example.com/v1/user", status: "401 Unauthorized"}
+		},
+		interval: time.Minute,
+		timeout:  time.Second,
+	}
+	first := p.check(context.Background())
+	second := p.check(context.Background())
+	if calls != 1 {
+		t.Errorf("Expected one upstream call within the interval, got %d", calls)
+	}
+	if first.OK || first.Detail != "answered 401 Unauthorized" || first.CheckedAt == nil || second.CheckedAt == nil || !second.CheckedAt.Equal(*first.CheckedAt) {
+		t.Errorf("Expected the cached failure back, got %+v then %+v", first, second)
+	}
+}
+
+func TestReadyzKeepsDetailsPrivate(t *testing.T) {
+	probes = map[string]*probe{"openai": {
+		name:     "openai",
+		run:      func(ctx context.Context) error { return errors.New("open /etc/robot-head/openai.key: permission denied") },
+		interval: time.Minute,
+		timeout:  time.Second,
+	}}
+	defer func() { probes = nil }()
+
+	rec := httptest.NewRecorder()
+	handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if strings.Contains(rec.Body.String(), "/etc/robot-head") {
+		t.Errorf("Expected no file paths in the report, got %s", rec.Body.String())
+	}
+	var report healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if c := report.Checks["openai"]; c.OK || c.Detail != "unreachable" {
+		t.Errorf("Expected a generic failure, got %+v", c)
+	}
+}
+
+func TestProbeOutlivesImpatientCaller(t *testing.T) {
+	p := &probe{
+		run:      func(ctx context.Context) error { return ctx.Err() },
+		interval: time.Minute,
+		timeout:  time.Second,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result := p.check(ctx); !result.OK {
+		t.Errorf("Expected the caller's cancellation not to fail the probe, got %+v", result)
+	}
+}
+
+func TestProbeElevenLabs(t *testing.T) {
+	var gotKey string
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("xi-api-key")
+		if r.URL.Path != "/v1/user" {
+			http.NotFound(w, r)
+		}
+	})
+	if err := probeElevenLabs(context.Background()); err != nil || gotKey != "test-key" {
+		t.Errorf("Expected the probe to pass with the key, got %v (key %q)", err, gotKey)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// rateWindow is the period the turn rate limits count over.
+const rateWindow = time.Minute
+
+// turnLimiter allows at most limit turns per key in any rateWindow.
+type turnLimiter struct {
+	limit int
+
+	mu    sync.Mutex
+	turns map[string][]time.Time
+}
+
+// deviceLimiter and globalLimiter are nil when there's no limit.
+var deviceLimiter, globalLimiter *turnLimiter
+
+func newTurnLimiter(limit int) *turnLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &turnLimiter{limit: limit, turns: map[string][]time.Time{}}
+}
+
+// wait is how long until key may take another turn, 0 if it may now.
+func (l *turnLimiter) wait(key string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	turns := l.recent(key, now)
+	if len(turns) < l.limit {
+		return 0
+	}
+	return turns[len(turns)-l.limit].Add(rateWindow).Sub(now)
+}
+
+func (l *turnLimiter) record(key string, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Forget keys that have gone quiet, so anonymous sessions don't pile up
+	for other := range l.turns {
+		if len(l.recent(other, now)) == 0 {
+			delete(l.turns, other)
+		}
+	}
+	l.turns[key] = append(l.recent(key, now), now)
+}
+
+// recent returns key's turns still inside the window. Called with mu held.
+func (l *turnLimiter) recent(key string, now time.Time) []time.Time {
+	turns := l.turns[key]
+	for len(turns) > 0 && now.Sub(turns[0]) >= rateWindow {
+		turns = turns[1:]
+	}
+	return turns
+}
+
+// counts returns how many turns each key took in the last window.
+func (l *turnLimiter) counts(now time.Time) map[string]int {
+	counts := map[string]int{}
+	if l == nil {
+		return counts
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key := range l.turns {
+		if n := len(l.recent(key, now)); n > 0 {
+			counts[key] = n
+		}
+	}
+	return counts
+}
+
+// limitKey is who a session's turns count against: its device, or the
+// session itself when auth is off.
+func limitKey(session *Session) string {
+	if session.Device != "" {
+		return session.Device
+	}
+	return session.ID
+}
+
+// allowTurn checks the device and global rate limits and counts the turn
+// if both allow it. Otherwise it returns which limit was hit and how long
+// until it frees up.
+func allowTurn(session *Session) (scope string, retryAfter time.Duration) {
+	now := time.Now()
+	key := limitKey(session)
+	if wait := deviceLimiter.wait(key, now); wait > 0 {
+		return "device", wait
+	}
+	if wait := globalLimiter.wait("", now); wait > 0 {
+		return "global", wait
+	}
+	deviceLimiter.record(key, now)
+	globalLimiter.record("", now)
+	return "", 0
+}
+
+// Budget tracks the day's spending on the LLM and TTS APIs against the
+// configured limits. Usage is saved to a state file after every turn so a
+// restart doesn't hand out a fresh budget, and starts over at midnight UTC.
+type Budget struct {
+	// Daily limits, 0 for none
+	llmTokens     int
+	ttsCharacters int
+	path          string
+
+	mu    sync.Mutex
+	usage budgetUsage
+	// pendingLLM is held for LLM calls under way, whose tokens aren't
+	// known until they finish
+	pendingLLM int
+}
+
+// llmReservation is what an LLM call holds against the budget until its
+// real usage is known, so turns running at once can't all start on the
+// last of it.
+const llmReservation = 1000
+
+// budgetUsage is what the state file holds.
+type budgetUsage struct {
+	Day           string `json:"day"`
+	LLMTokens     int    `json:"llm_tokens"`
+	TTSCharacters int    `json:"tts_characters"`
+}
+
+// budget is set up by main; when nil nothing is tracked or limited.
+var budget *Budget
+
+func NewBudget(c LimitsConfig) (*Budget, error) {
+	b := &Budget{llmTokens: c.DailyLLMTokens, ttsCharacters: c.DailyTTSCharacters, path: c.StateFile}
+	if b.path == "" {
+		return b, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0o700); err != nil {
+		return nil, fmt.Errorf("could not create budget state directory: %w", err)
+	}
+	data, err := os.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read budget state: %w", err)
+	}
+	if err := json.Unmarshal(data, &b.usage); err != nil {
+		return nil, fmt.Errorf("could not parse budget state %s: %w", b.path, err)
+	}
+	return b, nil
+}
+
+// today returns the day's usage, starting over on a new day. Called with
+// mu held.
+func (b *Budget) today() *budgetUsage {
+	if day := time.Now().UTC().Format(time.DateOnly); b.usage.Day != day {
+		b.usage = budgetUsage{Day: day}
+	}
+	return &b.usage
+}
+
+// LLMAvailable reports whether any of the day's LLM tokens are left.
+func (b *Budget) LLMAvailable() bool {
+	if b == nil || b.llmTokens == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.today().LLMTokens < b.llmTokens
+}
+
+// ReserveLLM claims room in the day's LLM budget for a call, reporting false
+// once none is left. A claim that succeeded must be settled with SettleLLM.
+func (b *Budget) ReserveLLM() bool {
+	if b == nil || b.llmTokens == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.today().LLMTokens+b.pendingLLM >= b.llmTokens {
+		return false
+	}
+	b.pendingLLM += min(llmReservation, b.llmTokens)
+	return true
+}
+
+// SettleLLM gives back a call's reservation, if it had one, and spends the
+// tokens it actually used; a call that failed uses none.
+func (b *Budget) SettleLLM(reserved bool, tokens int) {
+	b.spend(func(u *budgetUsage) {
+		if reserved && b.llmTokens != 0 {
+			b.pendingLLM -= min(llmReservation, b.llmTokens)
+		}
+		u.LLMTokens += tokens
+	})
+}
+
+// ReserveTTS spends characters of the day's TTS budget up front, reporting
+// false without spending them if they'd go over it. Speech that then fails
+// gives them back with RefundTTS.
+func (b *Budget) ReserveTTS(characters int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u := b.today()
+	if b.ttsCharacters != 0 && u.TTSCharacters+characters > b.ttsCharacters {
+		return false
+	}
+	u.TTSCharacters += characters
+	if err := b.save(); err != nil {
+		slog.Error("Failed to save budget state", "error", err)
+	}
+	return true
+}
+
+// RefundTTS returns characters reserved for speech that wasn't made.
+func (b *Budget) RefundTTS(characters int) {
+	b.spend(func(u *budgetUsage) { u.TTSCharacters = max(u.TTSCharacters-characters, 0) })
+}
+
+func (b *Budget) spend(add func(*budgetUsage)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	add(b.today())
+	if err := b.save(); err != nil {
+		slog.Error("Failed to save budget state", "error", err)
+	}
+}
+
+// save writes the usage to the state file, via a rename so a crash can't
+// leave it half written. Called with mu held.
+func (b *Budget) save() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(b.usage)
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// Usage returns the day's usage so far.
+func (b *Budget) Usage() budgetUsage {
+	if b == nil {
+		return budgetUsage{Day: time.Now().UTC().Format(time.DateOnly)}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return *b.today()
+}
+
+// budgetLine is one budget in the admin report. A zero limit means none.
+type budgetLine struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit"`
+}
+
+// limitsReport is what /admin/budget returns.
+type limitsReport struct {
+	Day           string     `json:"day"`
+	LLMTokens     budgetLine `json:"llm_tokens"`
+	TTSCharacters budgetLine `json:"tts_characters"`
+	// FallbackModel is set while the LLM budget is spent and the fallback
+	// model is answering instead.
+	FallbackModel string `json:"fallback_model,omitempty"`
+
+	DeviceTurnsPerMinute int `json:"device_turns_per_minute"`
+	GlobalTurnsPerMinute int `json:"global_turns_per_minute"`
+	// Turns taken in the last minute, per device and in total
+	DeviceTurns map[string]int `json:"device_turns"`
+	GlobalTurns int            `json:"global_turns"`
+}
+
+// handleBudget serves /admin/budget.
+func handleBudget(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	usage := budget.Usage()
+	report := limitsReport{
+		Day:                  usage.Day,
+		LLMTokens:            budgetLine{Used: usage.LLMTokens, Limit: cfg.Limits.DailyLLMTokens},
+		TTSCharacters:        budgetLine{Used: usage.TTSCharacters, Limit: cfg.Limits.DailyTTSCharacters},
+		DeviceTurnsPerMinute: cfg.Limits.DeviceTurnsPerMinute,
+		GlobalTurnsPerMinute: cfg.Limits.GlobalTurnsPerMinute,
+		DeviceTurns:          deviceLimiter.counts(now),
+		GlobalTurns:          globalLimiter.counts(now)[""],
+	}
+	if !budget.LLMAvailable() {
+		report.FallbackModel = cfg.Limits.FallbackModel
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
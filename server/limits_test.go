@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+func TestTurnLimiter(t *testing.T) {
+	l := newTurnLimiter(2)
+	start := time.Now()
+	l.record("kitchen", start)
+	l.record("kitchen", start.Add(time.Second))
+
+	if wait := l.wait("kitchen", start.Add(2*time.Second)); wait != 58*time.Second {
+		t.Errorf("Expected to wait for the first turn to age out, got %v", wait)
+	}
+	if wait := l.wait("lounge", start.Add(2*time.Second)); wait != 0 {
+		t.Errorf("Expected other devices unaffected, got %v", wait)
+	}
+	if wait := l.wait("kitchen", start.Add(rateWindow)); wait != 0 {
+		t.Errorf("Expected a turn free after the window, got %v", wait)
+	}
+
+	l.record("lounge", start.Add(2*rateWindow))
+	if counts := l.counts(start.Add(2 * rateWindow)); len(counts) != 1 || counts["lounge"] != 1 {
+		t.Errorf("Expected quiet devices forgotten, got %v", counts)
+	}
+	if newTurnLimiter(0).wait("kitchen", start) != 0 {
+		t.Error("Expected no limit at 0")
+	}
+}
+
+func TestAllowTurnChecksDeviceThenGlobal(t *testing.T) {
+	deviceLimiter, globalLimiter = newTurnLimiter(1), newTurnLimiter(2)
+	defer func() { deviceLimiter, globalLimiter = nil, nil }()
+
+	for _, c := range []struct{ device, scope string }{
+		{"kitchen", ""},
+		{"kitchen", "device"},
+		{"lounge", ""},
+		{"hallway", "global"},
+	} {
+		if scope, _ := allowTurn(&Session{ID: "s-" + c.device, Device: c.device}); scope != c.scope {
+			t.Errorf("%s: expected scope %q, got %q", c.device, c.scope, scope)
+		}
+	}
+}
+
+func TestBudgetPersistsAndResetsDaily(t *testing.T) {
+	c := LimitsConfig{DailyLLMTokens: 100, DailyTTSCharacters: 50, StateFile: filepath.Join(t.TempDir(), "state", "budget.json")}
+	b, err := NewBudget(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SettleLLM(false, 80)
+	if !b.ReserveTTS(40) || b.ReserveTTS(11) || !b.LLMAvailable() {
+		t.Errorf("Unexpected availability at %+v", b.Usage())
+	}
+	b.SettleLLM(false, 30)
+
+	// A restart picks up where it left off
+	b, err = NewBudget(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.LLMAvailable() || b.Usage().TTSCharacters != 40 {
+		t.Errorf("Expected the spent budget to survive a restart, got %+v", b.Usage())
+	}
+
+	// Yesterday's spending doesn't count
+	stale := `{"day":"2001-01-01","llm_tokens":500,"tts_characters":500}`
+	if err := os.WriteFile(c.StateFile, []byte(stale), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b, err = NewBudget(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.LLMAvailable() || b.Usage().LLMTokens != 0 {
+		t.Errorf("Expected a fresh budget on a new day, got %+v", b.Usage())
+	}
+}
+
+func TestBudgetReservations(t *testing.T) {
+	b, err := NewBudget(LimitsConfig{DailyLLMTokens: 100, DailyTTSCharacters: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one call at a time gets the last of the LLM budget
+	if !b.ReserveLLM() || b.ReserveLLM() {
+		t.Error("Expected the second call refused while the first holds the budget")
+	}
+	b.SettleLLM(true, 0)
+	if !b.ReserveLLM() {
+		t.Error("Expected a failed call to give its reservation back")
+	}
+	b.SettleLLM(true, 20)
+	if b.Usage().LLMTokens != 20 || !b.ReserveLLM() {
+		t.Errorf("Expected only the tokens used spent, got %+v", b.Usage())
+	}
+
+	if !b.ReserveTTS(30) || b.ReserveTTS(30) {
+		t.Error("Expected the second reservation to go over the TTS budget")
+	}
+	b.RefundTTS(30)
+	if !b.ReserveTTS(30) {
+		t.Errorf("Expected the refund to free the budget, got %+v", b.Usage())
+	}
+}
+
+func TestRespondToSpentBudgets(t *testing.T) {
+	var gotModel string
+	fakeOpenAI(t, func(w http.ResponseWriter, r *http.Request) {
+		var request LLMRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		gotModel = request.Model
+		replyWith("Hello there.", 12)(w, r)
+	})
+	ttsCalls := 0
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) { ttsCalls++ })
+	cfg.Transcripts.Enabled = false
+	cfg.Limits.DailyLLMTokens, cfg.Limits.DailyTTSCharacters = 10, 5
+	cfg.Limits.StateFile = ""
+	var err error
+	budget, err = NewBudget(cfg.Limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usageLedger = NewUsageLedger()
+	defer func() { budget, usageLedger = nil, NewUsageLedger() }()
+
+	registry := NewSessionRegistry(time.Minute)
+	session, _ := registry.Attach("robot-1", "", []string{shared.CapabilityTextInput, shared.CapabilityAudioOutput})
+	say := func() shared.Message {
+		return createResponse(context.Background(), session, shared.Message{Type: shared.MessageTypeUserInput, Data: "hello"}, func(shared.Message) error { return nil })
+	}
+
+	// The reply is longer than the TTS budget, so it's sent as text
+	if reply := say(); reply.Type != shared.MessageTypeAIResponse || reply.Data != "Hello there." || ttsCalls != 0 {
+		t.Errorf("Expected a text reply without TTS, got %+v (%d TTS calls)", reply, ttsCalls)
+	}
+
+	// The first turn spent the LLM budget
+	if reply := say(); reply.Type != shared.MessageTypeAIResponse || reply.Data != cfg.Limits.OfflineMessage {
+		t.Errorf("Expected the offline message, got %+v", reply)
+	}
+
+	cfg.Limits.FallbackModel = "gpt-4o-mini"
+	if reply := say(); reply.Data != "Hello there." || gotModel != "gpt-4o-mini" {
+		t.Errorf("Expected the fallback model to answer, got %+v from %q", reply, gotModel)
+	}
+
+	rec := httptest.NewRecorder()
+	handleBudget(rec, httptest.NewRequest(http.MethodGet, "/admin/budget", nil))
+	var report limitsReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.LLMTokens.Used != 24 || report.LLMTokens.Limit != 10 || report.FallbackModel != "gpt-4o-mini" {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	// The offline reply never reached the LLM, so it isn't a turn
+	if s := usageLedger.Report().Sessions["robot-1"]; s.Turns != 2 {
+		t.Errorf("Expected the two answered turns counted, got %+v", s)
+	}
+}
+
+func TestRateLimitedTurnsAreNotCounted(t *testing.T) {
+	calls := 0
+	fakeOpenAI(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		replyWith("Hello there.", 12)(w, r)
+	})
+	cfg.Transcripts.Enabled = false
+	deviceLimiter = newTurnLimiter(1)
+	usageLedger = NewUsageLedger()
+	defer func() { deviceLimiter, usageLedger = nil, NewUsageLedger() }()
+
+	registry := NewSessionRegistry(time.Minute)
+	session, _ := registry.Attach("robot-1", "", []string{shared.CapabilityTextInput})
+	for range 2 {
+		createResponse(context.Background(), session, shared.Message{Type: shared.MessageTypeUserInput, Data: "hello"}, func(shared.Message) error { return nil })
+	}
+
+	if s := usageLedger.Report().Sessions["robot-1"]; calls != 1 || s.Turns != 1 {
+		t.Errorf("Expected only the allowed turn counted, got %d LLM calls and %+v", calls, s)
+	}
+}
@@ -3,24 +3,30 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"syscall"
 	"robot-head/shared"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow connections from any origin
-	},
+	CheckOrigin: allowedOrigin,
 }
 
+var sessions *SessionRegistry
+
+var personas = NewPersonaStore()
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -28,209 +34,897 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func createResponse(msg shared.Message) shared.Message {
+// sendFunc delivers a message to the client straight away. Most handlers
+// just return their reply, but streamed audio goes out chunk by chunk before
+// the turn is over.
+type sendFunc func(shared.Message) error
+
+// createResponse handles one message from the client. ctx carries the
+// session and turn ids for logging.
+func createResponse(ctx context.Context, session *Session, msg shared.Message, send sendFunc) shared.Message {
 	// Handle voice messages (audio input from client)
 	if msg.Type == shared.MessageTypeAudio {
 		// Parse audio data from client
+		_, decodeSpan := tracer.Start(ctx, "decode")
 		audioDataJSON, err := json.Marshal(msg.Data)
 		if err != nil {
-			log.Printf("Failed to marshal audio data: %v", err)
-			return shared.Message{
-				Type:      shared.MessageTypeError,
-				Timestamp: time.Now().Unix(),
-				Data:      "Failed to process audio data",
-			}
+			shared.EndSpan(decodeSpan, err)
+			slog.ErrorContext(ctx, "Failed to marshal audio data", "error", err)
+			return protocolError("Failed to process audio data")
 		}
 
 		var audioData shared.AudioData
 		err = json.Unmarshal(audioDataJSON, &audioData)
+		decodeSpan.SetAttributes(attribute.Int("audio.bytes", len(audioData.AudioData)))
+		shared.EndSpan(decodeSpan, err)
 		if err != nil {
-			log.Printf("Failed to unmarshal audio data: %v", err)
-			return shared.Message{
-				Type:      shared.MessageTypeError,
-				Timestamp: time.Now().Unix(),
-				Data:      "Failed to parse audio data",
-			}
+			slog.ErrorContext(ctx, "Failed to unmarshal audio data", "error", err)
+			return protocolError("Failed to parse audio data")
 		}
 
+		audioBytesTotal.add(float64(len(audioData.AudioData)), "in")
+		// Whisper's work is paid for whether or not anything was said
+		sttUsage := TurnUsage{AudioSeconds: float64(len(audioData.AudioData)/2) / inputSampleRate}
+
 		// Transcribe audio to text using Whisper
+		started := time.Now()
+		sendState(ctx, session, shared.StateTranscribing, send)
+		_, span := tracer.Start(ctx, "transcribeAudio")
 		transcript, err := transcribeAudio(audioData.AudioData)
+		transcribed := time.Since(started)
+		observeStage("transcribe", transcribed, err)
+		span.SetAttributes(attribute.Int("transcript.length", len(transcript)))
+		shared.EndSpan(span, err)
 		if err != nil {
-			log.Printf("Speech-to-text error: %v", err)
-			return shared.Message{
-				Type:      shared.MessageTypeError,
-				Timestamp: time.Now().Unix(),
-				Data:      "Sorry, I couldn't understand what you said.",
-			}
+			slog.ErrorContext(ctx, "Speech-to-text failed", "stage", "transcribe", "duration_ms", transcribed.Milliseconds(), "error", err)
+			recordSpend(ctx, session, sttUsage)
+			// Whisper runs here, so the same audio would most likely fail
+			// the same way again
+			return errorReply(shared.ErrorData{
+				Code:      shared.ErrorCodeSTTFailed,
+				Stage:     shared.StageSTT,
+				Retryable: false,
+				Message:   "Sorry, I couldn't understand what you said.",
+			})
 		}
 
 		// Skip processing if no speech detected - return empty message
 		if transcript == "" || transcript == "[BLANK_AUDIO]" {
+			slog.DebugContext(ctx, "No speech detected", "stage", "transcribe", "duration_ms", transcribed.Milliseconds())
+			blankAudioTotal.inc()
+			recordSpend(ctx, session, sttUsage)
+			sendState(ctx, session, shared.StateIdle, send)
 			return shared.Message{} // Empty message - won't be sent
 		}
 
-		fmt.Printf("User: %s\n", transcript)
-
-		// Process transcript with OpenAI
-		aiResponse, err := callLLM(transcript)
-		if err != nil {
-			log.Printf("OpenAI API error: %v", err)
-			return shared.Message{
-				Type:      shared.MessageTypeError,
+		slog.InfoContext(ctx, "Transcribed", "stage", "transcribe", "duration_ms", transcribed.Milliseconds(), "transcript", transcript)
+		turn := &userTurn{
+			started:    started,
+			input:      "audio",
+			transcribe: transcribed,
+			recording:  recorder.StartTurn(session),
+			usage:      sttUsage,
+		}
+		defer turn.recording.Close()
+		turn.recording.saveInput(audioData.AudioData)
+		turn.recording.saveText("transcript.txt", transcript)
+		if session.HasCapability(shared.CapabilityTranscripts) {
+			err := send(shared.Message{
+				Type:      shared.MessageTypeTranscript,
 				Timestamp: time.Now().Unix(),
-				Data:      "Sorry, I'm having trouble thinking right now.",
+				Data:      transcript,
+			})
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to send transcript", "error", err)
 			}
 		}
+		return respondTo(ctx, session, transcript, turn, send)
+	}
+
+	// Handle text input messages (fallback)
+	if msg.Type == shared.MessageTypeUserInput {
+		if userText, ok := msg.Data.(string); ok {
+			turn := &userTurn{started: time.Now(), input: "text", recording: recorder.StartTurn(session)}
+			defer turn.recording.Close()
+			turn.recording.saveText("input.txt", userText)
+			return respondTo(ctx, session, userText, turn, send)
+		}
+	}
 
-		fmt.Printf("Robot: %s\n", aiResponse)
+	// Handle persona selection from the client
+	if msg.Type == shared.MessageTypePersona {
+		var request shared.PersonaData
+		if err := msg.DecodeData(&request); err != nil {
+			slog.WarnContext(ctx, "Failed to parse persona data", "error", err)
+			return protocolError("Failed to parse persona request")
+		}
+		persona, ok := personas.Get(request.Name)
+		if !ok {
+			return protocolError(fmt.Sprintf("Unknown persona %q", request.Name))
+		}
+		return switchPersona(ctx, session, persona)
+	}
 
-		// Generate speech from AI response
-		audioBytes, err := generateSpeech(aiResponse)
+	// Handle requests to start the conversation over
+	if msg.Type == shared.MessageTypeReset {
+		session.ResetHistory()
+		slog.InfoContext(ctx, "Conversation reset")
+		// Marked in the transcript so reloading doesn't bring it back
+		saveTranscript(ctx, session.ID, TranscriptEntry{At: time.Now(), Device: session.Device, Reset: true})
+		return shared.Message{
+			Type:      shared.MessageTypeStatus,
+			Timestamp: time.Now().Unix(),
+			Data: shared.StatusData{
+				Message: "Conversation reset",
+				Persona: session.Persona(),
+			},
+		}
+	}
+
+	// Handle the client opting in or out of the debug recorder
+	if msg.Type == shared.MessageTypeRecord {
+		return setRecording(ctx, session, msg)
+	}
+
+	// Handle voice selection from the client
+	if msg.Type == shared.MessageTypeVoice {
+		return selectVoice(ctx, session, msg)
+	}
+
+	// Handle requests for the list of available voices
+	if msg.Type == shared.MessageTypeVoices {
+		voices, err := listVoices(ctx)
 		if err != nil {
-			log.Printf("TTS error: %v", err)
-			// Fallback to text response
+			slog.ErrorContext(ctx, "Failed to list voices", "error", err)
+			return upstreamErrorReply(shared.StageTTS, err, "Sorry, I couldn't fetch the list of voices.")
+		}
+		return shared.Message{
+			Type:      shared.MessageTypeVoices,
+			Timestamp: time.Now().Unix(),
+			Data:      shared.VoiceList{Voices: voices},
+		}
+	}
+
+	// Fallback for other message types
+	return shared.Message{
+		Type:      shared.MessageTypeStatus,
+		Timestamp: time.Now().Unix(),
+		Data: shared.StatusData{
+			Message: fmt.Sprintf("Received: %v", msg.Data),
+			Persona: session.Persona(),
+		},
+	}
+}
+
+// userTurn is one exchange with the user, from their words arriving to the
+// reply going out.
+type userTurn struct {
+	started time.Time
+	// input is "audio" or "text"
+	input      string
+	transcribe time.Duration
+	// recording is nil unless the session is being recorded
+	recording *turnRecording
+	// usage is filled in as each stage runs
+	usage TurnUsage
+}
+
+// respondTo runs one conversational turn for what the user said: LLM reply
+// in the session's persona, then speech for it.
+func respondTo(ctx context.Context, session *Session, userText string, turn *userTurn, send sendFunc) shared.Message {
+	// Spoken persona switches are handled here rather than by the LLM, so
+	// they aren't turns; only hearing them cost anything
+	if persona, ok := personas.detectPersonaSwitch(userText); ok {
+		recordSpend(ctx, session, turn.usage)
+		return switchPersona(ctx, session, persona)
+	}
+
+	// Counted however the turn ends, but only as a turn once it got as far
+	// as the LLM. Turns refused before then cost just their transcription.
+	defer func() {
+		if turn.usage.Model == "" {
+			recordSpend(ctx, session, turn.usage)
+			return
+		}
+		recordUsage(ctx, session, turn.usage)
+	}()
+
+	if scope, retryAfter := allowTurn(session); scope != "" {
+		turnsRateLimitedTotal.inc(scope)
+		slog.WarnContext(ctx, "Turn rate limited", "scope", scope, "retry_after_ms", retryAfter.Milliseconds())
+		return errorReply(shared.ErrorData{
+			Code:         shared.ErrorCodeRateLimited,
+			Stage:        shared.StageLimits,
+			Retryable:    true,
+			RetryAfterMS: retryAfter.Milliseconds(),
+			Message:      "I need a moment to catch my breath. Ask me again shortly.",
+		})
+	}
+
+	// The LLM and TTS calls, retries and all, get TurnTimeout between them
+	ctx, cancel := context.WithTimeout(ctx, cfg.TurnTimeout)
+	defer cancel()
+
+	persona := personas.Resolve(session.Persona())
+	reserved := budget.ReserveLLM()
+	if !reserved {
+		budgetExceededTotal.inc("llm")
+		if cfg.Limits.FallbackModel == "" {
+			slog.WarnContext(ctx, "LLM budget spent, replying offline", "stage", "llm")
 			return shared.Message{
 				Type:      shared.MessageTypeAIResponse,
 				Timestamp: time.Now().Unix(),
-				Data:      aiResponse,
+				Data:      cfg.Limits.OfflineMessage,
 			}
 		}
+		slog.InfoContext(ctx, "LLM budget spent, using the fallback model", "stage", "llm", "model", cfg.Limits.FallbackModel)
+		persona.Model = cfg.Limits.FallbackModel
+	}
+	showExpressions := cfg.Expressions && session.HasCapability(shared.CapabilityExpressions)
+	if showExpressions {
+		persona.SystemPrompt += expressionInstructions
+	}
+
+	// Process transcript with OpenAI
+	sendState(ctx, session, shared.StateThinking, send)
+	thinking := time.Now()
+	llmCtx, span := tracer.Start(ctx, "callLLM", trace.WithAttributes(
+		attribute.String("llm.model", persona.LLMModel()),
+		attribute.String("persona", persona.Name),
+		attribute.Int("input.length", len(userText)),
+	))
+	aiResponse, usage, err := callLLM(llmCtx, persona, session.History(), userText, turn.recording)
+	observeStage("llm", time.Since(thinking), err)
+	budget.SettleLLM(reserved, usage.TotalTokens)
+	turn.usage.Model = persona.LLMModel()
+	turn.usage.PromptTokens, turn.usage.CompletionTokens = usage.PromptTokens, usage.CompletionTokens
+	span.SetAttributes(attribute.Int("reply.length", len(aiResponse)), attribute.Int("llm.tokens", usage.TotalTokens))
+	shared.EndSpan(span, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "LLM request failed", "stage", "llm", "duration_ms", time.Since(thinking).Milliseconds(), "error", err)
+		return upstreamErrorReply(shared.StageLLM, err, "Sorry, I'm having trouble thinking right now.")
+	}
+
+	// Expression tags are never spoken. Without them, brackets in the
+	// reply are just text.
+	var expressions []expressionCue
+	if showExpressions {
+		aiResponse, expressions = extractExpressions(aiResponse)
+	}
+	// The limit applies to what's spoken, so tags don't count towards it
+	// and are never cut in half
+	aiResponse = persona.LimitReply(aiResponse)
+	expressions = cuesWithin(expressions, aiResponse)
+
+	replied := time.Now()
+	slog.InfoContext(ctx, "LLM replied", "stage", "llm", "duration_ms", replied.Sub(thinking).Milliseconds(),
+		"persona", persona.Name, "reply", aiResponse)
+	session.AppendTurn(userText, aiResponse)
+	turn.recording.saveText("reply.txt", aiResponse)
+
+	defer func() {
+		entry := TranscriptEntry{
+			At:           turn.started,
+			Device:       session.Device,
+			Persona:      persona.Name,
+			Input:        turn.input,
+			User:         userText,
+			Robot:        aiResponse,
+			TranscribeMS: turn.transcribe.Milliseconds(),
+			LLMMS:        replied.Sub(thinking).Milliseconds(),
+			TotalMS:      time.Since(turn.started).Milliseconds(),
+		}
+		usage := turn.usage.priced(cfg.Prices)
+		entry.Usage = &usage
+		if session.HasCapability(shared.CapabilityAudioOutput) {
+			entry.TTSMS = time.Since(replied).Milliseconds()
+			slog.InfoContext(ctx, "Speech sent", "stage", "tts", "duration_ms", entry.TTSMS)
+		}
+		slog.InfoContext(ctx, "Turn complete", "duration_ms", entry.TotalMS, "cost_usd", usage.CostUSD)
+		saveTranscript(ctx, session.ID, entry)
+	}()
 
-		// Return audio response
-		responseAudioData := shared.AudioData{
-			Text:      aiResponse,
-			AudioData: audioBytes,
-			MimeType:  "audio/mpeg",
+	// Text-only clients don't need speech, so don't pay for it
+	if !session.HasCapability(shared.CapabilityAudioOutput) {
+		sendExpressions(ctx, expressions, Alignment{}, send)
+		return shared.Message{
+			Type:      shared.MessageTypeAIResponse,
+			Timestamp: time.Now().Unix(),
+			Data:      aiResponse,
 		}
+	}
 
+	// Past the day's TTS budget the reply goes out as text
+	characters := utf8.RuneCountInString(aiResponse)
+	if !budget.ReserveTTS(characters) {
+		budgetExceededTotal.inc("tts")
+		slog.WarnContext(ctx, "TTS budget spent, replying in text", "stage", "tts", "characters", characters)
+		sendExpressions(ctx, expressions, Alignment{}, send)
 		return shared.Message{
-			Type:      shared.MessageTypeAudio,
+			Type:      shared.MessageTypeAIResponse,
 			Timestamp: time.Now().Unix(),
-			Data:      responseAudioData,
+			Data:      aiResponse,
 		}
 	}
 
-	// Handle text input messages (fallback)
-	if msg.Type == shared.MessageTypeUserInput {
-		if userText, ok := msg.Data.(string); ok {
-			aiResponse, err := callLLM(userText)
-			if err != nil {
-				log.Printf("OpenAI API error: %v", err)
-				return shared.Message{
-					Type:      shared.MessageTypeError,
-					Timestamp: time.Now().Unix(),
-					Data:      "Sorry, I'm having trouble thinking right now.",
-				}
-			}
+	voice := persona.TTSVoice().merge(session.Voice())
+
+	// Stream the speech to clients that can play it as it arrives
+	if cfg.ElevenLabs.Stream && session.HasCapability(shared.CapabilityAudioStream) {
+		sendExpressions(ctx, expressions, estimateSpeech(aiResponse, voice), send)
+		speaking := time.Now()
+		speechCtx, span := speechSpan(ctx, voice, true)
+		streamed, err := streamResponse(speechCtx, aiResponse, voice, turn.recording.tee(send))
+		observeStage("tts", time.Since(speaking), err)
+		if streamed > 0 {
+			turn.usage.TTSCharacters = characters
+		} else {
+			budget.RefundTTS(characters)
+		}
+		span.SetAttributes(attribute.Int("audio.bytes", streamed))
+		shared.EndSpan(span, err)
+		if err == nil {
+			return shared.Message{} // Everything was sent already
+		}
+		slog.ErrorContext(ctx, "TTS stream failed", "stage", "tts", "streamed_bytes", streamed, "error", err)
+		if streamed > 0 {
+			// The client has part of the audio; finishStream told it to stop
+			return shared.Message{}
+		}
+		// Nothing went out yet, so fall through to a text response
+		return shared.Message{
+			Type:      shared.MessageTypeAIResponse,
+			Timestamp: time.Now().Unix(),
+			Data:      aiResponse,
+		}
+	}
 
-			audioBytes, err := generateSpeech(aiResponse)
-			if err != nil {
-				log.Printf("TTS error: %v", err)
-				// Fallback to text response
-				return shared.Message{
-					Type:      shared.MessageTypeAIResponse,
-					Timestamp: time.Now().Unix(),
-					Data:      aiResponse,
-				}
-			}
+	// Generate speech from AI response
+	speaking := time.Now()
+	speechCtx, span := speechSpan(ctx, voice, false)
+	audioBytes, alignment, err := synthesize(speechCtx, aiResponse, voice)
+	observeStage("tts", time.Since(speaking), err)
+	span.SetAttributes(attribute.Int("audio.bytes", len(audioBytes)))
+	shared.EndSpan(span, err)
+	sendExpressions(ctx, expressions, alignment, send)
+	if err != nil {
+		slog.ErrorContext(ctx, "TTS failed", "stage", "tts", "error", err)
+		budget.RefundTTS(characters)
+		// Fallback to text response
+		return shared.Message{
+			Type:      shared.MessageTypeAIResponse,
+			Timestamp: time.Now().Unix(),
+			Data:      aiResponse,
+		}
+	}
 
-			// Return audio message
-			audioData := shared.AudioData{
-				Text:      aiResponse,
-				AudioData: audioBytes,
-				MimeType:  "audio/mpeg",
-			}
+	turn.usage.TTSCharacters = characters
+	turn.recording.saveReply(audioBytes, voice.MimeType())
 
-			return shared.Message{
-				Type:      shared.MessageTypeAudio,
-				Timestamp: time.Now().Unix(),
-				Data:      audioData,
-			}
+	// Return audio response
+	responseAudioData := shared.AudioData{
+		Text:      aiResponse,
+		AudioData: audioBytes,
+		MimeType:  voice.MimeType(),
+		Visemes:   alignment.Visemes(),
+	}
+
+	return shared.Message{
+		Type:      shared.MessageTypeAudio,
+		Timestamp: time.Now().Unix(),
+		Data:      responseAudioData,
+	}
+}
+
+// saveTranscript adds an entry to the session's stored transcript.
+func saveTranscript(ctx context.Context, sessionID string, entry TranscriptEntry) {
+	if transcripts == nil {
+		return
+	}
+	if err := transcripts.Append(sessionID, entry); err != nil {
+		slog.ErrorContext(ctx, "Failed to save transcript", "error", err)
+	}
+}
+
+// restoreHistory reloads a returning session's conversation from its
+// transcript, for when the server restarted since it was last here.
+func restoreHistory(ctx context.Context, session *Session) {
+	if transcripts == nil || !cfg.Transcripts.Reload {
+		return
+	}
+	history, err := transcripts.History(session.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to reload transcript", "error", err)
+		return
+	}
+	if len(history) > 0 {
+		session.LoadHistory(history)
+		slog.InfoContext(ctx, "Restored conversation from transcript", "messages", len(history))
+	}
+}
+
+// sendState tells clients that asked for state updates what the server is
+// working on. Like expressions these are cosmetic, so failures are logged.
+func sendState(ctx context.Context, session *Session, state string, send sendFunc) {
+	if !session.HasCapability(shared.CapabilityStates) {
+		return
+	}
+	err := send(shared.Message{
+		Type:      shared.MessageTypeStatus,
+		Timestamp: time.Now().Unix(),
+		Data:      shared.StatusData{State: state},
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to send state", "state", state, "error", err)
+	}
+}
+
+// sendExpressions sends the reply's expression cues ahead of its audio.
+// They're cosmetic, so failures are only logged.
+func sendExpressions(ctx context.Context, cues []expressionCue, alignment Alignment, send sendFunc) {
+	for _, msg := range expressionMessages(cues, alignment) {
+		if err := send(msg); err != nil {
+			slog.WarnContext(ctx, "Failed to send expression", "error", err)
+			return
 		}
 	}
+}
 
-	// Fallback for other message types
+// streamResponse forwards TTS audio to the client as audio_chunk messages.
+// The first chunk carries the reply text, the last one is marked Final.
+func streamResponse(ctx context.Context, text string, voice VoiceConfig, send sendFunc) (int, error) {
+	streamID := newID()
+	seq := 0
+	streamed, err := streamSpeech(ctx, text, voice, func(audio []byte) error {
+		chunk := shared.AudioChunk{
+			StreamID:  streamID,
+			Seq:       seq,
+			AudioData: audio,
+			MimeType:  voice.MimeType(),
+		}
+		if seq == 0 {
+			// The stream has no timing data, so the client gets an
+			// estimated timeline up front
+			chunk.Text = text
+			chunk.Visemes = estimateSpeech(text, voice).Visemes()
+		}
+		seq++
+		return send(shared.Message{
+			Type:      shared.MessageTypeAudioChunk,
+			Timestamp: time.Now().Unix(),
+			Data:      chunk,
+		})
+	})
+
+	// Close the stream on the client, even if it was cut short
+	if streamed > 0 {
+		finish := send(shared.Message{
+			Type:      shared.MessageTypeAudioChunk,
+			Timestamp: time.Now().Unix(),
+			Data: shared.AudioChunk{
+				StreamID: streamID,
+				Seq:      seq,
+				MimeType: voice.MimeType(),
+				Final:    true,
+			},
+		})
+		if err == nil {
+			err = finish
+		}
+	}
+	return streamed, err
+}
+
+// selectVoice applies a client's voice override to the session.
+func selectVoice(ctx context.Context, session *Session, msg shared.Message) shared.Message {
+	var request shared.VoiceData
+	if err := msg.DecodeData(&request); err != nil {
+		slog.WarnContext(ctx, "Failed to parse voice data", "error", err)
+		return protocolError("Failed to parse voice request")
+	}
+
+	override := voiceConfigFromMessage(request)
+	if !request.Reset {
+		override = session.Voice().merge(override)
+	}
+	if err := override.validate(); err != nil {
+		return protocolError(fmt.Sprintf("Invalid voice settings: %v", err))
+	}
+	session.SetVoice(override)
+
+	voice := personas.Resolve(session.Persona()).TTSVoice().merge(override)
+	slog.InfoContext(ctx, "Voice selected", "voice_id", voice.VoiceID)
+	return shared.Message{
+		Type:      shared.MessageTypeStatus,
+		Timestamp: time.Now().Unix(),
+		Data: shared.StatusData{
+			Message: fmt.Sprintf("Voice set to %s", voice.VoiceID),
+			Persona: session.Persona(),
+		},
+	}
+}
+
+// setRecording opts the session in or out of the debug recorder.
+func setRecording(ctx context.Context, session *Session, msg shared.Message) shared.Message {
+	var request shared.RecordData
+	if err := msg.DecodeData(&request); err != nil {
+		slog.WarnContext(ctx, "Failed to parse record data", "error", err)
+		return protocolError("Failed to parse record request")
+	}
+	if recorder == nil {
+		return protocolError("Recording is disabled on this server")
+	}
+
+	session.SetRecording(request.Enabled)
+	status := "Recording off"
+	if request.Enabled {
+		status = "Recording on"
+	}
+	slog.InfoContext(ctx, "Recording toggled", "recording", request.Enabled)
 	return shared.Message{
 		Type:      shared.MessageTypeStatus,
 		Timestamp: time.Now().Unix(),
-		Data:      fmt.Sprintf("Received: %v", msg.Data),
+		Data: shared.StatusData{
+			Message: status,
+			Persona: session.Persona(),
+		},
 	}
 }
 
+// switchPersona changes the session's persona and reports it back. The
+// conversation history is kept so the new persona knows what was said.
+func switchPersona(ctx context.Context, session *Session, persona Persona) shared.Message {
+	session.SetPersona(persona.Name)
+	// The persona brings its own voice, so drop any per-session override
+	session.SetVoice(VoiceConfig{})
+	slog.InfoContext(ctx, "Switched persona", "persona", persona.Name)
+
+	return shared.Message{
+		Type:      shared.MessageTypeStatus,
+		Timestamp: time.Now().Unix(),
+		Data: shared.StatusData{
+			Message: fmt.Sprintf("Switched to %s mode", persona.Name),
+			Persona: persona.Name,
+		},
+	}
+}
+
+// attachSession handles a client's hello message, reattaching it to its
+// previous session when one is still alive. device is who the client
+// authenticated as; it can only pick up its own sessions.
+func attachSession(ctx context.Context, msg shared.Message, device string) (*Session, shared.Message) {
+	var hello shared.HelloData
+	if err := msg.DecodeData(&hello); err != nil {
+		slog.WarnContext(ctx, "Failed to parse hello data", "error", err)
+	}
+
+	id := hello.SessionID
+	if id != "" && !validSessionID(id) {
+		slog.WarnContext(ctx, "Client asked for an unusable session id", "requested_session_id", id)
+		id = ""
+	}
+	if id != "" {
+		owned, err := transcripts.Owns(id, device)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to check transcript owner", "error", err)
+		}
+		if !owned {
+			slog.WarnContext(ctx, "Session id belongs to another device", "requested_session_id", id)
+			id = ""
+		}
+	}
+
+	session, resumed := sessions.Attach(id, device, hello.Capabilities)
+	ctx = sessionContext(ctx, session)
+	if !resumed && id != "" && session.ID == id {
+		restoreHistory(ctx, session)
+	}
+	if hello.Persona != "" {
+		if persona, ok := personas.Get(hello.Persona); ok {
+			session.SetPersona(persona.Name)
+		} else {
+			slog.WarnContext(ctx, "Client asked for unknown persona", "persona", hello.Persona)
+		}
+	}
+	if session.Persona() == "" {
+		session.SetPersona(personas.Default())
+	}
+	slog.InfoContext(ctx, "Session attached", "resumed", resumed,
+		"persona", session.Persona(), "capabilities", session.Capabilities())
+
+	return session, shared.Message{
+		Type:      shared.MessageTypeSession,
+		Timestamp: time.Now().Unix(),
+		Data: shared.SessionInfo{
+			SessionID:    session.ID,
+			Resumed:      resumed,
+			Capabilities: session.Capabilities(),
+			Persona:      session.Persona(),
+			Personas:     personas.Names(),
+		},
+	}
+}
+
+// sessionContext tags log records with the session id.
+func sessionContext(ctx context.Context, session *Session) context.Context {
+	return shared.WithLogAttrs(ctx, slog.String("session_id", session.ID))
+}
+
+// handleMessageExchange serves one connection. device is who the client
+// authenticated as, "" when auth is off.
+func handleMessageExchange(ctx context.Context, conn *websocket.Conn, device string) {
+	var session *Session
+	sessionCtx := ctx
+	defer func() {
+		if session != nil {
+			sessions.Detach(session)
+			slog.InfoContext(sessionCtx, "Session detached")
+		}
+	}()
 
-func handleMessageExchange(conn *websocket.Conn) {
 	for {
 		var msg shared.Message
 		err := conn.ReadJSON(&msg)
 		if err != nil {
-			log.Println("WebSocket read error:", err)
+			slog.InfoContext(sessionCtx, "WebSocket closed", "error", err)
 			break
 		}
-		
-		// Log message type without printing binary data
-		if msg.Type == shared.MessageTypeAudio {
-			fmt.Printf("Received audio message\n")
-		} else {
-			fmt.Printf("Received: %+v\n", msg)
+
+		if msg.Type == shared.MessageTypeHello {
+			if session != nil {
+				sessions.Detach(session)
+			}
+			var reply shared.Message
+			messagesTotal.inc("in", messageTypeLabel(msg.Type))
+			session, reply = attachSession(ctx, msg, device)
+			sessionCtx = sessionContext(ctx, session)
+			messagesTotal.inc("out", string(reply.Type))
+			if err := conn.WriteJSON(reply); err != nil {
+				slog.ErrorContext(sessionCtx, "Failed to send response", "error", err)
+				break
+			}
+			continue
+		}
+
+		// Clients that skip the hello get an anonymous session of their own
+		if session == nil {
+			session, _ = sessions.Attach("", device, nil)
+			session.SetPersona(personas.Default())
+			sessionCtx = sessionContext(ctx, session)
 		}
-		
-		response := createResponse(msg)
+
+		// Every message starts a turn, continuing the client's trace if
+		// it sent one
+		turnCtx, span := tracer.Start(shared.ExtractTrace(sessionCtx, msg.TraceParent), "turn",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("session.id", session.ID),
+				attribute.String("device.id", session.Device),
+				attribute.String("message.type", string(msg.Type)),
+			))
+		turnCtx = shared.WithLogAttrs(turnCtx,
+			slog.String("turn_id", newID()),
+			slog.String("message_type", string(msg.Type)))
+		if span.SpanContext().IsValid() {
+			turnCtx = shared.WithLogAttrs(turnCtx, slog.String("trace_id", span.SpanContext().TraceID().String()))
+		}
+		// Message.LogValue keeps audio out
+		slog.InfoContext(turnCtx, "Received message", "message", msg)
+		messagesTotal.inc("in", messageTypeLabel(msg.Type))
+
+		// Replies carry the trace back so the client's playback joins it
+		traceParent := shared.InjectTrace(turnCtx)
+		received := time.Now()
+		sentAudio := false
+		send := func(m shared.Message) error {
+			slog.DebugContext(turnCtx, "Sending message", "message", m)
+			messagesTotal.inc("out", string(m.Type))
+			if n := replyAudioBytes(m); n > 0 {
+				audioBytesTotal.add(float64(n), "out")
+				if !sentAudio {
+					sentAudio = true
+					firstAudioSeconds.observe(time.Since(received).Seconds())
+				}
+			}
+			_, write := tracer.Start(turnCtx, "websocket.write",
+				trace.WithAttributes(attribute.String("message.type", string(m.Type))))
+			m.TraceParent = traceParent
+			err := conn.WriteJSON(m)
+			shared.EndSpan(write, err)
+			return err
+		}
+		response := speakError(turnCtx, session, createResponse(turnCtx, session, msg, send))
 		// Only send response if it has content (not empty message)
 		if response.Type != "" {
-			err = conn.WriteJSON(response)
-			if err != nil {
-				log.Println("Failed to send response:", err)
+			if err := send(response); err != nil {
+				slog.ErrorContext(turnCtx, "Failed to send response", "error", err)
+				shared.EndSpan(span, err)
 				break
 			}
 		}
+		span.End()
+	}
+}
+
+// replyAudioBytes is how much speech a message to the client carries.
+func replyAudioBytes(msg shared.Message) int {
+	switch data := msg.Data.(type) {
+	case shared.AudioData:
+		return len(data.AudioData)
+	case shared.AudioChunk:
+		return len(data.AudioData)
 	}
+	return 0
 }
 
 // Handle WebSocket connections
 func establishWebsocketConnection(w http.ResponseWriter, r *http.Request) {
+	ctx := shared.WithLogAttrs(context.Background(), slog.String("remote_addr", r.RemoteAddr))
+	// Checked before upgrading so unknown clients never get a socket
+	device, failure := authenticate(r)
+	if failure != nil {
+		rejectRequest(ctx, w, r, failure)
+		return
+	}
+	if device != "" {
+		ctx = shared.WithLogAttrs(ctx, slog.String("device", device))
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("WebSocket upgrade failed:", err)
+		slog.WarnContext(ctx, "WebSocket upgrade failed", "error", err)
 		return
 	}
 	defer conn.Close()
+	connectedClients.add(1)
+	defer connectedClients.add(-1)
 
-	fmt.Println("Client connected via WebSocket")
-	handleMessageExchange(conn)
+	slog.InfoContext(ctx, "Client connected via WebSocket")
+	handleMessageExchange(ctx, conn, device)
 }
 
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "transcripts" {
+		os.Exit(runTranscriptsCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	config, printOnly, err := loadConfig(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		shared.Fatal("Failed to load configuration", err)
+	}
+	if printOnly {
+		if err := shared.PrintConfig(os.Stdout, config.Redacted()); err != nil {
+			shared.Fatal("Failed to print configuration", err)
+		}
+		return
+	}
+	cfg = config
+	if err := shared.SetupLogging(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		shared.Fatal("Failed to set up logging", err)
+	}
+	shutdownTracing, err := shared.SetupTracing(context.Background(), "robot-head-server", cfg.Tracing)
+	if err != nil {
+		shared.Fatal("Failed to set up tracing", err)
+	}
+
 	// Initialize Whisper model
-	fmt.Println("Loading Whisper model...")
+	slog.Info("Loading Whisper model", "path", cfg.Whisper.ModelPath)
 	if err := initWhisper(); err != nil {
-		log.Fatal("Failed to initialize Whisper:", err)
+		shared.Fatal("Failed to initialize Whisper", err)
+	}
+
+	personas, err = LoadPersonas(cfg.PersonasDir, cfg.DefaultPersona)
+	if err != nil {
+		shared.Fatal("Failed to load personas", err)
 	}
 
-	port := getEnv("PORT", "9001")
-	host := getEnv("HOST", "0.0.0.0")
-	portNum := ":" + port
+	sessions = NewSessionRegistry(cfg.SessionTTL)
+
+	if cfg.Auth.TokensFile != "" {
+		deviceTokens, err = LoadDeviceTokens(cfg.Auth.TokensFile)
+		if err != nil {
+			shared.Fatal("Failed to load device tokens", err)
+		}
+		slog.Info("Device auth enabled", "devices", len(deviceTokens.devices))
+	} else {
+		slog.Warn("No auth.tokens_file set, anyone who can reach the server can use it")
+	}
+	if cfg.Health.Probe {
+		probes = newProbes(cfg.Health)
+	}
+
+	deviceLimiter = newTurnLimiter(cfg.Limits.DeviceTurnsPerMinute)
+	globalLimiter = newTurnLimiter(cfg.Limits.GlobalTurnsPerMinute)
+	budget, err = NewBudget(cfg.Limits)
+	if err != nil {
+		shared.Fatal("Failed to load budget state", err)
+	}
+	if usage := budget.Usage(); usage.LLMTokens > 0 || usage.TTSCharacters > 0 {
+		slog.Info("Resumed today's budget", "llm_tokens", usage.LLMTokens, "tts_characters", usage.TTSCharacters)
+	}
+
+	if cfg.Transcripts.Enabled {
+		transcripts, err = NewTranscriptStore(cfg.Transcripts.Dir)
+		if err != nil {
+			shared.Fatal("Failed to open transcript store", err)
+		}
+	}
+
+	if cfg.Recorder.Enabled {
+		recorder = NewRecorder(cfg.Recorder)
+		if err := recorder.Prune(); err != nil {
+			slog.Error("Failed to prune recordings", "error", err)
+		}
+		slog.Info("Debug recorder enabled", "dir", cfg.Recorder.Dir, "all_sessions", cfg.Recorder.AllSessions)
+	}
+
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	go sessions.RunJanitor(janitorCtx, time.Minute)
+	if recorder != nil {
+		go recorder.RunPruner(janitorCtx, pruneInterval)
+	}
+
+	portNum := ":" + cfg.Port
 
 	server := &http.Server{
-		Addr: host + portNum,
+		Addr: cfg.Host + portNum,
 	}
 
-	// health check endpoint - used for Docker health checks
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Server is healthy!")
-	})
+	// Liveness and readiness checks. /health predates them and is what
+	// Docker health checks point at, so it reports readiness.
+	http.HandleFunc("GET /healthz", handleHealthz)
+	http.HandleFunc("GET /readyz", handleReadyz)
+	http.HandleFunc("GET /health", handleReadyz)
+
+	http.HandleFunc("GET /metrics", handleMetrics)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello from Robot Head Server!")
 	})
 
+	// Each device sees only its own transcripts, so without tokens there's
+	// nobody to show them to. The transcripts command reads them locally.
+	switch {
+	case transcripts == nil:
+	case deviceTokens == nil:
+		slog.Info("Transcript endpoints are off without auth; use the transcripts command")
+	default:
+		http.HandleFunc("GET /transcripts", requireAuth(handleTranscripts))
+		http.HandleFunc("GET /transcripts/{id}", requireAuth(handleTranscript))
+	}
+
+	if cfg.Auth.AdminToken != "" {
+		http.HandleFunc("GET /admin/budget", requireAdmin(handleBudget))
+		http.HandleFunc("GET /admin/usage", requireAdmin(handleUsage))
+	} else {
+		slog.Info("Admin endpoints are off; set auth.admin_token to turn them on")
+	}
+
 	http.HandleFunc("/ws", establishWebsocketConnection)
-	fmt.Printf("Server running on localhost%s\n", portNum)
+
+	if cfg.TLS.CertFile != "" {
+		server.TLSConfig, err = serverTLSConfig(cfg.TLS)
+		if err != nil {
+			shared.Fatal("Failed to set up TLS", err)
+		}
+	}
+	slog.Info("Server running", "addr", server.Addr, "tls", server.TLSConfig != nil,
+		"client_certs", server.TLSConfig != nil && server.TLSConfig.ClientCAs != nil)
 
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed to start: %v", err)
-			return
+		var err error
+		if server.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			shared.Fatal("Server failed to start", err)
 		}
 	}()
 
@@ -239,16 +933,18 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	fmt.Println("\nShutting down server...")
-
-  	// Graceful shutdown with 30 second timeout
-  	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-  	defer cancel()
+	slog.Info("Shutting down server")
 
-  	if err := server.Shutdown(ctx); err != nil {
-  		log.Fatal("Server forced to shutdown:", err)
-  	}
+	// Graceful shutdown, bounded by the configured timeout
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
 
-  	fmt.Println("Server exited")
+	if err := server.Shutdown(ctx); err != nil {
+		shared.Fatal("Server forced to shutdown", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
 
+	slog.Info("Server exited")
 }
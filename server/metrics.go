@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"robot-head/shared"
+)
+
+// The server's metrics, served at /metrics in the Prometheus text format.
+// There are only a handful, so they are kept here rather than pulling in
+// the Prometheus client library.
+var (
+	connectedClients = newGauge("robot_head_connected_clients",
+		"WebSocket clients currently connected.")
+	messagesTotal = newCounterVec("robot_head_messages_total",
+		"Messages received from and sent to clients.", "direction", "type")
+	audioBytesTotal = newCounterVec("robot_head_audio_bytes_total",
+		"Audio bytes received from and sent to clients.", "direction")
+	blankAudioTotal = newCounterVec("robot_head_blank_audio_total",
+		"Audio chunks skipped because no speech was heard.")
+	stageSeconds = newHistogramVec("robot_head_stage_duration_seconds",
+		"Time taken by each pipeline stage: transcribe, llm or tts.", latencyBuckets, "stage")
+	stageErrorsTotal = newCounterVec("robot_head_stage_errors_total",
+		"Pipeline stages that failed.", "stage")
+	turnsRateLimitedTotal = newCounterVec("robot_head_turns_rate_limited_total",
+		"Turns refused for going over a rate limit, by scope: device or global.", "scope")
+	budgetExceededTotal = newCounterVec("robot_head_budget_exceeded_total",
+		"Turns that found a daily budget spent: llm or tts.", "budget")
+	llmTokensTotal = newCounterVec("robot_head_llm_tokens_total",
+		"LLM tokens used, by model and kind: prompt or completion.", "model", "kind")
+	ttsCharactersTotal = newCounterVec("robot_head_tts_characters_total",
+		"Characters sent for speech synthesis.")
+	sttAudioSecondsTotal = newCounterVec("robot_head_stt_audio_seconds_total",
+		"Seconds of audio transcribed.")
+	costUSDTotal = newCounterVec("robot_head_cost_usd_total",
+		"Estimated spend from the price table, by service: stt, llm or tts.", "service")
+	upstreamRetriesTotal = newCounterVec("robot_head_upstream_retries_total",
+		"Upstream requests tried again after a failure, by upstream.", "upstream")
+	upstreamRejectedTotal = newCounterVec("robot_head_upstream_rejected_total",
+		"Upstream requests not made because the circuit breaker was open.", "upstream")
+	upstreamErrorsTotal = newCounterVec("robot_head_upstream_errors_total",
+		"Failed upstream requests, by upstream and error code.", "upstream", "code")
+	authFailuresTotal = newCounterVec("robot_head_auth_failures_total",
+		"Connections and requests turned away, by reason.", "reason")
+	firstAudioSeconds = newHistogramVec("robot_head_time_to_first_audio_seconds",
+		"Time from a message arriving to the first reply audio going out.", latencyBuckets)
+)
+
+// latencyBuckets cover a fast local turn up to a slow upstream API.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 3, 5, 10, 30}
+
+// observeStage records how long a pipeline stage took and whether it failed.
+func observeStage(stage string, took time.Duration, err error) {
+	stageSeconds.observe(took.Seconds(), stage)
+	if err != nil {
+		stageErrorsTotal.inc(stage)
+	}
+}
+
+// messageTypes are the types counted by name in robot_head_messages_total.
+// The type comes from the client, so anything else is counted as "other"
+// rather than letting it make up new series.
+var messageTypes = map[shared.MessageType]bool{
+	shared.MessageTypeUserInput: true, shared.MessageTypeAIResponse: true,
+	shared.MessageTypeStatus: true, shared.MessageTypeError: true,
+	shared.MessageTypeAudio: true, shared.MessageTypeHello: true,
+	shared.MessageTypeSession: true, shared.MessageTypePersona: true,
+	shared.MessageTypeVoice: true, shared.MessageTypeVoices: true,
+	shared.MessageTypeAudioChunk: true, shared.MessageTypeExpression: true,
+	shared.MessageTypeReset: true, shared.MessageTypeTranscript: true,
+	shared.MessageTypeRecord: true,
+}
+
+// messageTypeLabel is the type label for a message.
+func messageTypeLabel(t shared.MessageType) string {
+	if !messageTypes[t] {
+		return "other"
+	}
+	return string(t)
+}
+
+// collector is one metric family.
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	collectorsMu sync.Mutex
+	collectors   []collector
+)
+
+func register(c collector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	collectors = append(collectors, c)
+}
+
+// handleMetrics serves every registered metric.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(w)
+	collectorsMu.Lock()
+	for _, c := range collectors {
+		c.write(b)
+	}
+	collectorsMu.Unlock()
+	b.Flush()
+}
+
+// gauge is a single value that goes up and down.
+type gauge struct {
+	name, help string
+	mu         sync.Mutex
+	value      float64
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{name: name, help: help}
+	register(g)
+	return g
+}
+
+func (g *gauge) add(delta float64) {
+	g.mu.Lock()
+	g.value += delta
+	g.mu.Unlock()
+}
+
+func (g *gauge) get() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value))
+}
+
+// counterVec is a counter per combination of label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) add(delta float64, values ...string) {
+	key := formatLabels(c.labels, values)
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		// A plain counter is always shown, even before it counts anything
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec counts observations into buckets, per combination of label
+// values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := formatLabels(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			labels := formatLabels(append(h.labels[:len(h.labels):len(h.labels)], "le"), append(s.labels, formatFloat(le)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, cumulative)
+		}
+		labels := formatLabels(append(h.labels[:len(h.labels):len(h.labels)], "le"), append(s.labels, "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders label pairs as {name="value",...}, or nothing when
+// there are none.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	saved := collectors
+	collectors = nil
+	defer func() { collectors = saved }()
+
+	clients := newGauge("test_clients", "Clients.")
+	messages := newCounterVec("test_messages_total", "Messages.", "direction", "type")
+	newCounterVec("test_skipped_total", "Skipped.")
+	latency := newHistogramVec("test_seconds", "Latency.", []float64{0.1, 1}, "stage")
+
+	clients.add(2)
+	clients.add(-1)
+	messages.inc("in", "audio")
+	messages.inc("in", "audio")
+	messages.inc("out", `say "hi"`)
+	latency.observe(0.05, "llm")
+	latency.observe(0.5, "llm")
+	latency.observe(5, "llm")
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE test_clients gauge\ntest_clients 1\n",
+		"# TYPE test_messages_total counter\n",
+		`test_messages_total{direction="in",type="audio"} 2`,
+		`test_messages_total{direction="out",type="say \"hi\""} 1`,
+		"test_skipped_total 0\n",
+		"# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{stage="llm",le="0.1"} 1`,
+		`test_seconds_bucket{stage="llm",le="1"} 2`,
+		`test_seconds_bucket{stage="llm",le="+Inf"} 3`,
+		`test_seconds_sum{stage="llm"} 5.55`,
+		`test_seconds_count{stage="llm"} 3`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestObserveStageCountsErrors(t *testing.T) {
+	before := stageErrorsTotal.values[`{stage="tts"}`]
+	observeStage("tts", time.Second, nil)
+	observeStage("tts", time.Second, http.ErrHandlerTimeout)
+	if got := stageErrorsTotal.values[`{stage="tts"}`] - before; got != 1 {
+		t.Errorf("Expected one tts error counted, got %v", got)
+	}
+}
+
+func TestMessageTypeLabel(t *testing.T) {
+	for typ, want := range map[shared.MessageType]string{
+		shared.MessageTypeAudio: "audio",
+		shared.MessageTypeHello: "hello",
+		"made-up-1234":          "other",
+		"":                      "other",
+	} {
+		if got := messageTypeLabel(typ); got != want {
+			t.Errorf("Type %q: expected label %q, got %q", typ, want, got)
+		}
+	}
+}
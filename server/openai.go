@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,14 +10,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
-var model string = "gpt-4o"
-
 type LLMRequest struct {
-	Model  string   `json:"model"`
-	Messages []Message `json:"messages"`
+	Model       string    `json:"model"`
+	Messages    []Message `json:"messages"`
+	Temperature *float64  `json:"temperature,omitempty"`
 }
 
 type Message struct {
@@ -25,18 +24,28 @@ type Message struct {
 }
 
 type LLMResponse struct {
-	Choices  []Choice `json:"choices"`
+	Choices []Choice `json:"choices"`
+	Usage   LLMUsage `json:"usage"`
+}
+
+// LLMUsage is what a completion cost, as reported by the API.
+type LLMUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 type Choice struct {
 	Message Message `json:"message"`
+	// FinishReason is content_filter when the reply was withheld
+	FinishReason string `json:"finish_reason"`
 }
 
 func getAPIKey() (string, error) {
-	// try env, if not, look in file
-	if key := os.Getenv("OPENAI_API_KEY"); key != "" {
-			return key, nil
-		}
+	// try config (which includes env), if not, look in file
+	if cfg.OpenAI.APIKey != "" {
+		return cfg.OpenAI.APIKey, nil
+	}
 	homeDir, err := os.UserHomeDir()
   	if err != nil {
   		return "", fmt.Errorf("could not get home directory: %v", err)
@@ -57,74 +66,80 @@ func getAPIKey() (string, error) {
 
 }
 
-func callLLM(userMessage string) (string, error) {
+// callLLM sends the user's message to the persona's chat model along with
+// the conversation history of the session. The request and response are
+// kept in turn when it's being recorded. The usage is returned for the
+// daily token budget. ctx bounds the request, retries included.
+func callLLM(ctx context.Context, persona Persona, history []Message, userMessage string, turn *turnRecording) (string, LLMUsage, error) {
 	apiKey, err := getAPIKey()
 	if err != nil {
-		return "", fmt.Errorf("failed to get API key: %w", err)
+		return "", LLMUsage{}, fmt.Errorf("failed to get API key: %w", err)
 	}
 
+	messages := []Message{
+		{Role: "system", Content: persona.SystemPrompt},
+	}
+	messages = append(messages, history...)
+	messages = append(messages, Message{Role: "user", Content: userMessage})
+
 	// Create request structure
 	request := LLMRequest{
-		Model: model,
-		Messages: []Message{
-				{
-					Role:	"system",
-					Content: 
-						`You are a helpful, voice-based assistant.
-						Speak naturally, like you are talking to a friend.
-						Keep your answers short and to the point.
-						Use conversational language, contractions, and 
-						occasionally check in like 'Want to hear more?'`,
-            	},
-				
-				{
-					Role:	"user",
-					Content: userMessage,
-				},
-		},
+		Model:       persona.LLMModel(),
+		Messages:    messages,
+		Temperature: persona.Temperature,
 	}
 
 	// Encode in JSON
 	jsonData, err := json.Marshal(request)
-  	if err != nil {
-  		return "", fmt.Errorf("failed to marshal request: %w", err)
-  	}
+	if err != nil {
+		return "", LLMUsage{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	turn.saveJSON("llm_request.json", jsonData)
 
 	// Create HTTP request
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest("POST", cfg.OpenAI.URL, bytes.NewBuffer(jsonData))
 	if err != nil {
-  		return "", fmt.Errorf("failed to create request: %w", err)
-  	}
+		return "", LLMUsage{}, fmt.Errorf("failed to create request: %w", err)
+	}
 
-  	// Set headers
-  	req.Header.Set("Content-Type", "application/json")
-  	req.Header.Set("Authorization", "Bearer "+apiKey)
+	// Set headers
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-  	// Make request
-  	client := &http.Client{Timeout: 30 * time.Second}
-  	resp, err := client.Do(req)
-  	if err != nil {
-  		return "", fmt.Errorf("API request failed: %w", err)
-  	}
-  	defer resp.Body.Close()
+	// Make request
+	resp, err := openAIUpstream.Do(ctx, req)
+	if err != nil {
+		return "", LLMUsage{}, fmt.Errorf("API request failed: %w", err)
+	}
+	defer resp.Body.Close()
 
-  	// Read response
-  	body, err := io.ReadAll(resp.Body)
-  	if err != nil {
-  		return "", fmt.Errorf("failed to read response: %w", err)
-  	}
+	// Read response
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", LLMUsage{}, fmt.Errorf("failed to read response: %w", err)
+	}
+	turn.saveJSON("llm_response.json", body)
+	if resp.StatusCode != http.StatusOK {
+		return "", LLMUsage{}, parseOpenAIError(resp.StatusCode, body)
+	}
 
-  	// Parse JSON response
-  	var llmResponse LLMResponse
-  	err = json.Unmarshal(body, &llmResponse)
-  	if err != nil {
-  		return "", fmt.Errorf("failed to parse response: %w", err)
-  	}
+	// Parse JSON response
+	var llmResponse LLMResponse
+	err = json.Unmarshal(body, &llmResponse)
+	if err != nil {
+		return "", LLMUsage{}, fmt.Errorf("failed to parse response: %w", err)
+	}
 
-  	// Extract message
-  	if len(llmResponse.Choices) == 0 {
-  		return "", fmt.Errorf("no response choices returned")
-  	}
+	// Extract message
+	if len(llmResponse.Choices) == 0 {
+		return "", LLMUsage{}, fmt.Errorf("no response choices returned")
+	}
+	if llmResponse.Choices[0].FinishReason == "content_filter" {
+		// The tokens were still spent
+		return "", llmResponse.Usage, newUpstreamError(&UpstreamError{
+			Upstream: "openai", Kind: ErrContentFiltered, Status: resp.StatusCode, Code: "content_filter",
+		})
+	}
 
-  	return llmResponse.Choices[0].Message.Content, nil
-}
\ No newline at end of file
+	return llmResponse.Choices[0].Message.Content, llmResponse.Usage, nil
+}
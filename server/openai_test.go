@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeOpenAI points the chat completions URL at handler for the test.
+func fakeOpenAI(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.OpenAI.URL = server.URL + "/v1/chat/completions"
+	cfg.OpenAI.APIKey = "test-key"
+	fastRetries(t, &openAIUpstream)
+	return server
+}
+
+// replyWith answers chat completions with reply, reporting tokens used.
+func replyWith(reply string, tokens int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(LLMResponse{
+			Choices: []Choice{{Message: Message{Role: "assistant", Content: reply}}},
+			Usage:   LLMUsage{PromptTokens: tokens - 1, CompletionTokens: 1, TotalTokens: tokens},
+		})
+	}
+}
+
+func TestCallLLMReturnsUsage(t *testing.T) {
+	var gotRequest LLMRequest
+	fakeOpenAI(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&gotRequest)
+		replyWith("Hello there.", 42)(w, r)
+	})
+
+	reply, usage, err := callLLM(context.Background(), Persona{Name: "test", SystemPrompt: "Be brief."}, nil, "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hello there." || usage.TotalTokens != 42 || usage.PromptTokens != 41 {
+		t.Errorf("Unexpected reply %q with usage %+v", reply, usage)
+	}
+	if gotRequest.Model != cfg.OpenAI.Model || len(gotRequest.Messages) != 2 {
+		t.Errorf("Unexpected request %+v", gotRequest)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultPersonaName = "default"
+
+// Persona bundles everything that shapes how the robot talks: what the LLM
+// is told, which model answers and which voice reads the reply.
+type Persona struct {
+	Name         string   `yaml:"name"`
+	SystemPrompt string   `yaml:"system_prompt"`
+	Model        string   `yaml:"model,omitempty"`
+	Temperature  *float64 `yaml:"temperature,omitempty"`
+	// MaxReplyLength caps the reply in characters before it goes to TTS.
+	// Zero means no limit.
+	MaxReplyLength int         `yaml:"max_reply_length,omitempty"`
+	Voice          VoiceConfig `yaml:"voice,omitempty"`
+}
+
+// builtinPersona is used when no persona files are configured.
+func builtinPersona() Persona {
+	return Persona{
+		Name: defaultPersonaName,
+		SystemPrompt: "You are a helpful, voice-based assistant. " +
+			"Speak naturally, like you are talking to a friend. " +
+			"Keep your answers short and to the point. " +
+			"Use conversational language, contractions, and " +
+			"occasionally check in like 'Want to hear more?'",
+	}
+}
+
+// LLMModel returns the chat model for this persona, falling back to the
+// server-wide setting.
+func (p Persona) LLMModel() string {
+	if p.Model != "" {
+		return p.Model
+	}
+	return cfg.OpenAI.Model
+}
+
+// TTSVoice returns the voice for this persona, filling gaps from the
+// server-wide setting.
+func (p Persona) TTSVoice() VoiceConfig {
+	return cfg.ElevenLabs.defaultVoice().merge(p.Voice)
+}
+
+// LimitReply trims a reply to MaxReplyLength, preferring to cut at the end
+// of a sentence so the robot doesn't stop mid-word. The length counts
+// characters, and the cut never splits one.
+func (p Persona) LimitReply(reply string) string {
+	if p.MaxReplyLength <= 0 || utf8.RuneCountInString(reply) <= p.MaxReplyLength {
+		return reply
+	}
+	cut := runePrefix(reply, p.MaxReplyLength)
+	if end := strings.LastIndexAny(cut, ".!?"); end > 0 {
+		return cut[:end+1]
+	}
+	// The "..." has to fit within the limit too
+	if space := strings.LastIndex(runePrefix(reply, p.MaxReplyLength-2), " "); space > 0 {
+		return reply[:space] + "..."
+	}
+	return cut
+}
+
+// runePrefix returns s's first n characters.
+func runePrefix(s string, n int) string {
+	runes := 0
+	for i := range s {
+		if runes >= n {
+			return s[:i]
+		}
+		runes++
+	}
+	return s
+}
+
+func (p Persona) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("persona name is required")
+	}
+	if strings.TrimSpace(p.SystemPrompt) == "" {
+		return fmt.Errorf("persona %q has no system_prompt", p.Name)
+	}
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("persona %q temperature must be between 0 and 2", p.Name)
+	}
+	if p.MaxReplyLength < 0 {
+		return fmt.Errorf("persona %q max_reply_length can't be negative", p.Name)
+	}
+	if err := p.Voice.validate(); err != nil {
+		return fmt.Errorf("persona %q voice: %w", p.Name, err)
+	}
+	return nil
+}
+
+// PersonaStore holds the personas the server knows about, keyed by
+// lower-case name.
+type PersonaStore struct {
+	mu          sync.RWMutex
+	personas    map[string]Persona
+	defaultName string
+}
+
+// NewPersonaStore returns a store containing only the built-in persona.
+func NewPersonaStore() *PersonaStore {
+	return &PersonaStore{
+		personas:    map[string]Persona{defaultPersonaName: builtinPersona()},
+		defaultName: defaultPersonaName,
+	}
+}
+
+// LoadPersonas reads every *.yaml file in dir. A missing directory is not an
+// error; the built-in persona is always available.
+func LoadPersonas(dir, defaultName string) (*PersonaStore, error) {
+	store := NewPersonaStore()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		persona, err := loadPersonaFile(path)
+		if err != nil {
+			return nil, err
+		}
+		store.personas[strings.ToLower(persona.Name)] = persona
+	}
+	if len(paths) > 0 {
+		slog.Info("Loaded personas", "count", len(paths), "dir", dir)
+	}
+
+	if defaultName != "" {
+		if _, ok := store.personas[strings.ToLower(defaultName)]; !ok {
+			return nil, fmt.Errorf("default persona %q not found in %s", defaultName, dir)
+		}
+		store.defaultName = strings.ToLower(defaultName)
+	}
+	return store, nil
+}
+
+func loadPersonaFile(path string) (Persona, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Persona{}, fmt.Errorf("could not read persona file: %w", err)
+	}
+
+	var persona Persona
+	if err := yaml.Unmarshal(data, &persona); err != nil {
+		return Persona{}, fmt.Errorf("could not parse persona file %s: %w", path, err)
+	}
+	if persona.Name == "" {
+		persona.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if err := persona.validate(); err != nil {
+		return Persona{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return persona, nil
+}
+
+// Get looks up a persona by name, case-insensitively.
+func (s *PersonaStore) Get(name string) (Persona, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	persona, ok := s.personas[strings.ToLower(name)]
+	return persona, ok
+}
+
+// Resolve returns the named persona or the default one if the name is empty
+// or unknown.
+func (s *PersonaStore) Resolve(name string) Persona {
+	if persona, ok := s.Get(name); ok {
+		return persona
+	}
+	persona, _ := s.Get(s.defaultName)
+	return persona
+}
+
+// Default returns the name of the persona new sessions start with.
+func (s *PersonaStore) Default() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.personas[s.defaultName].Name
+}
+
+// Names lists the available personas in alphabetical order.
+func (s *PersonaStore) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.personas))
+	for _, persona := range s.personas {
+		names = append(names, persona.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var personaSwitchPattern = regexp.MustCompile(`(?i)\bswitch (?:to|into) (?:the )?([a-z0-9 _-]+?) (?:mode|persona|voice)\b`)
+
+// detectPersonaSwitch recognises spoken requests like "switch to pirate
+// mode" and returns the persona they name, if it exists.
+func (s *PersonaStore) detectPersonaSwitch(transcript string) (Persona, bool) {
+	match := personaSwitchPattern.FindStringSubmatch(transcript)
+	if match == nil {
+		return Persona{}, false
+	}
+	return s.Get(strings.TrimSpace(match[1]))
+}
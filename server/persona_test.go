@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf8"
+)
+
+func writePersonaFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write persona file: %v", err)
+	}
+}
+
+func TestLoadPersonas(t *testing.T) {
+	dir := t.TempDir()
+	writePersonaFile(t, dir, "pirate.yaml", "name: Pirate\nsystem_prompt: Talk like a pirate.\ntemperature: 0.9\n")
+
+	store, err := LoadPersonas(dir, "pirate")
+	if err != nil {
+		t.Fatalf("Failed to load personas: %v", err)
+	}
+
+	persona, ok := store.Get("PIRATE")
+	if !ok {
+		t.Fatal("Expected persona lookup to be case-insensitive")
+	}
+	if persona.Temperature == nil || *persona.Temperature != 0.9 {
+		t.Errorf("Expected temperature 0.9, got %v", persona.Temperature)
+	}
+	if store.Default() != "Pirate" {
+		t.Errorf("Expected Pirate as default, got %v", store.Default())
+	}
+	if len(store.Names()) != 2 {
+		t.Errorf("Expected built-in and pirate personas, got %v", store.Names())
+	}
+}
+
+func TestLoadPersonasMissingDirectory(t *testing.T) {
+	store, err := LoadPersonas(filepath.Join(t.TempDir(), "nope"), "")
+	if err != nil {
+		t.Fatalf("Missing directory should not be an error: %v", err)
+	}
+	if store.Resolve("anything").Name != defaultPersonaName {
+		t.Error("Unknown persona should resolve to the default")
+	}
+}
+
+func TestLoadPersonasRejectsInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	writePersonaFile(t, dir, "empty.yaml", "name: empty\n")
+
+	if _, err := LoadPersonas(dir, ""); err == nil {
+		t.Error("Expected an error for a persona without a system prompt")
+	}
+}
+
+func TestDetectPersonaSwitch(t *testing.T) {
+	store := NewPersonaStore()
+	store.personas["pirate"] = Persona{Name: "pirate", SystemPrompt: "Arr."}
+
+	persona, ok := store.detectPersonaSwitch("Okay robot, switch to pirate mode please")
+	if !ok || persona.Name != "pirate" {
+		t.Errorf("Expected switch to pirate, got %v %v", persona.Name, ok)
+	}
+
+	if _, ok := store.detectPersonaSwitch("switch to ninja mode"); ok {
+		t.Error("Unknown persona should not trigger a switch")
+	}
+	if _, ok := store.detectPersonaSwitch("tell me about pirates"); ok {
+		t.Error("Ordinary sentences should not trigger a switch")
+	}
+}
+
+func TestLimitReply(t *testing.T) {
+	persona := Persona{MaxReplyLength: 30}
+
+	reply := persona.LimitReply("This is short. This second sentence runs past the limit.")
+	if reply != "This is short." {
+		t.Errorf("Expected cut at sentence end, got %q", reply)
+	}
+
+	reply = persona.LimitReply("one two three four five six seven eight nine")
+	if reply != "one two three four five six..." {
+		t.Errorf("Expected cut at word boundary, got %q", reply)
+	}
+
+	// The "..." counts towards the limit
+	long := "one two three four five six seven eight nine ten"
+	for max := 1; max < len(long); max++ {
+		if got := (Persona{MaxReplyLength: max}).LimitReply(long); utf8.RuneCountInString(got) > max {
+			t.Errorf("Limit %d: got %q, %d characters", max, got, utf8.RuneCountInString(got))
+		}
+	}
+
+	// The limit is in characters, and multi-byte ones are kept whole
+	reply = Persona{MaxReplyLength: 8}.LimitReply("héllo wörld 🤖🤖")
+	if reply != "héllo..." || !utf8.ValidString(reply) {
+		t.Errorf("Expected a cut on a character boundary, got %q", reply)
+	}
+	reply = Persona{MaxReplyLength: 3}.LimitReply("🤖🤖🤖🤖🤖")
+	if reply != "🤖🤖🤖" {
+		t.Errorf("Expected three whole emoji, got %q", reply)
+	}
+
+	unlimited := Persona{}
+	if got := unlimited.LimitReply("anything"); got != "anything" {
+		t.Errorf("Expected no limit, got %q", got)
+	}
+}
+
+func TestTTSVoiceFallsBackToConfig(t *testing.T) {
+	voice := builtinPersona().TTSVoice()
+	if voice.VoiceID != cfg.ElevenLabs.VoiceID {
+		t.Errorf("Expected configured voice id, got %v", voice.VoiceID)
+	}
+	if voice.Settings.Stability == nil || *voice.Settings.Stability != 0.5 {
+		t.Errorf("Expected default stability, got %v", voice.Settings.Stability)
+	}
+}
+
+func TestShippedPersonasLoad(t *testing.T) {
+	if _, err := LoadPersonas("../personas", ""); err != nil {
+		t.Errorf("Shipped persona files failed to load: %v", err)
+	}
+}
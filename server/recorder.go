@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"robot-head/shared"
+)
+
+// inputSampleRate is the rate clients record at and whisper expects.
+const inputSampleRate = 16000
+
+// turnTimeLayout names turn directories so they sort by time. A second turn
+// of the session in the same millisecond gets a "-1" after it, and so on.
+const turnTimeLayout = "20060102T150405.000Z"
+
+// pruneInterval is how often old recordings are looked for.
+const pruneInterval = time.Minute
+
+// replyExtensions name recorded reply audio by its MIME type.
+var replyExtensions = map[string]string{
+	"audio/mpeg":  ".mp3",
+	"audio/pcm":   ".pcm",
+	"audio/basic": ".ulaw",
+	"audio/opus":  ".opus",
+}
+
+// Recorder keeps a copy of every turn of the sessions being recorded so a
+// misheard question or an odd reply can be looked at afterwards. Each turn
+// gets its own directory:
+//
+//	<dir>/<session id>/<UTC time>[-n]/
+//	    input.wav or input.txt
+//	    transcript.txt
+//	    llm_request.json
+//	    llm_response.json
+//	    reply.txt
+//	    reply.mp3
+//
+// Every minute turns older than the retention period are deleted, then the
+// oldest ones until the rest fit under the size cap.
+type Recorder struct {
+	dir         string
+	retention   time.Duration
+	maxBytes    int64
+	allSessions bool
+	now         func() time.Time
+
+	// mu stops the pruner and startup from pruning the same files at once
+	mu sync.Mutex
+}
+
+// recorder is nil unless the server was started with the recorder enabled.
+var recorder *Recorder
+
+func NewRecorder(c RecorderConfig) *Recorder {
+	return &Recorder{
+		dir:         c.Dir,
+		retention:   c.Retention,
+		maxBytes:    int64(c.MaxMB) << 20,
+		allSessions: c.AllSessions,
+		now:         time.Now,
+	}
+}
+
+// StartTurn returns a recording for the session's next turn, or nil if
+// the session isn't being recorded. Every turnRecording method is safe to
+// call on nil, so callers don't need to check.
+func (r *Recorder) StartTurn(session *Session) *turnRecording {
+	if r == nil || !session.Recording(r.allSessions) {
+		return nil
+	}
+	if !validSessionID(session.ID) {
+		slog.Error("Not recording a session with an unusable id", "session_id", session.ID)
+		return nil
+	}
+	sessionDir := filepath.Join(r.dir, session.ID)
+	if err := os.MkdirAll(sessionDir, 0o700); err != nil {
+		slog.Error("Failed to start recording", "session_id", session.ID, "error", err)
+		return nil
+	}
+	name := r.now().UTC().Format(turnTimeLayout)
+	dir := filepath.Join(sessionDir, name)
+	for n := 1; ; n++ {
+		err := os.Mkdir(dir, 0o700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			slog.Error("Failed to start recording", "session_id", session.ID, "error", err)
+			return nil
+		}
+		dir = filepath.Join(sessionDir, fmt.Sprintf("%s-%d", name, n))
+	}
+	return &turnRecording{recorder: r, dir: dir, sessionID: session.ID}
+}
+
+// RunPruner prunes recordings every interval until ctx is cancelled.
+func (r *Recorder) RunPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Prune(); err != nil {
+				slog.Error("Failed to prune recordings", "error", err)
+			}
+		}
+	}
+}
+
+// Prune deletes recordings past the retention period, then the oldest
+// ones until the rest fit under the size cap.
+func (r *Recorder) Prune() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type turnDir struct {
+		path string
+		at   time.Time
+		size int64
+	}
+	var turns []turnDir
+	var total int64
+
+	sessionDirs, err := os.ReadDir(r.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, sessionDir := range sessionDirs {
+		if !sessionDir.IsDir() {
+			continue
+		}
+		sessionPath := filepath.Join(r.dir, sessionDir.Name())
+		entries, err := os.ReadDir(sessionPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			stamp, _, _ := strings.Cut(entry.Name(), "-")
+			at, err := time.Parse(turnTimeLayout, stamp)
+			if err != nil || !entry.IsDir() {
+				// Not ours, leave it alone
+				continue
+			}
+			path := filepath.Join(sessionPath, entry.Name())
+			size, err := dirSize(path)
+			if err != nil {
+				return err
+			}
+			turns = append(turns, turnDir{path: path, at: at, size: size})
+			total += size
+		}
+	}
+
+	sort.Slice(turns, func(i, j int) bool { return turns[i].at.Before(turns[j].at) })
+	cutoff := r.now().Add(-r.retention)
+	for _, turn := range turns {
+		if !turn.at.Before(cutoff) && total <= r.maxBytes {
+			break
+		}
+		if err := os.RemoveAll(turn.path); err != nil {
+			return err
+		}
+		total -= turn.size
+	}
+
+	// Sessions with nothing left go too; Remove fails on the others
+	for _, sessionDir := range sessionDirs {
+		if sessionDir.IsDir() {
+			os.Remove(filepath.Join(r.dir, sessionDir.Name()))
+		}
+	}
+	return nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// turnRecording is one turn being written to disk. Recording is a debugging
+// aid, so failures are logged rather than failing the turn.
+type turnRecording struct {
+	recorder  *Recorder
+	dir       string
+	sessionID string
+	// stream collects streamed reply audio as it goes out
+	stream *os.File
+}
+
+func (t *turnRecording) save(name string, data []byte) {
+	if t == nil {
+		return
+	}
+	if err := os.WriteFile(filepath.Join(t.dir, name), data, 0o600); err != nil {
+		slog.Error("Failed to record", "session_id", t.sessionID, "file", name, "error", err)
+	}
+}
+
+// saveJSON saves an API request or response, indented for reading.
+func (t *turnRecording) saveJSON(name string, data []byte) {
+	if t == nil {
+		return
+	}
+	var indented bytes.Buffer
+	if json.Indent(&indented, data, "", "  ") == nil {
+		data = indented.Bytes()
+	}
+	t.save(name, data)
+}
+
+func (t *turnRecording) saveText(name, text string) {
+	t.save(name, []byte(text+"\n"))
+}
+
+// saveInput saves what the client sent as a WAV that opens in any player.
+func (t *turnRecording) saveInput(pcm []byte) {
+	t.save("input.wav", encodeWAV(pcm, inputSampleRate))
+}
+
+func (t *turnRecording) saveReply(audio []byte, mimeType string) {
+	t.save("reply"+replyExtension(mimeType), audio)
+}
+
+// tee returns a sendFunc that also records streamed reply audio.
+func (t *turnRecording) tee(send sendFunc) sendFunc {
+	if t == nil {
+		return send
+	}
+	return func(msg shared.Message) error {
+		if chunk, ok := msg.Data.(shared.AudioChunk); ok && len(chunk.AudioData) > 0 {
+			t.appendReply(chunk.AudioData, chunk.MimeType)
+		}
+		return send(msg)
+	}
+}
+
+func (t *turnRecording) appendReply(audio []byte, mimeType string) {
+	if t.stream == nil {
+		f, err := os.OpenFile(filepath.Join(t.dir, "reply"+replyExtension(mimeType)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			slog.Error("Failed to record reply audio", "session_id", t.sessionID, "error", err)
+			return
+		}
+		t.stream = f
+	}
+	if _, err := t.stream.Write(audio); err != nil {
+		slog.Error("Failed to record reply audio", "session_id", t.sessionID, "error", err)
+	}
+}
+
+// Close finishes the turn.
+func (t *turnRecording) Close() {
+	if t == nil || t.stream == nil {
+		return
+	}
+	t.stream.Close()
+}
+
+func replyExtension(mimeType string) string {
+	if ext, ok := replyExtensions[mimeType]; ok {
+		return ext
+	}
+	return ".bin"
+}
+
+// encodeWAV wraps 16-bit mono PCM in a WAV header.
+func encodeWAV(pcm []byte, sampleRate int) []byte {
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+len(pcm)))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(header[22:], 1) // mono
+	binary.LittleEndian.PutUint32(header[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(sampleRate*2))
+	binary.LittleEndian.PutUint16(header[32:], 2)
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(len(pcm)))
+	return append(header, pcm...)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+func newTestRecorder(t *testing.T, allSessions bool) *Recorder {
+	t.Helper()
+	return NewRecorder(RecorderConfig{
+		Enabled:     true,
+		Dir:         t.TempDir(),
+		AllSessions: allSessions,
+		Retention:   time.Hour,
+		MaxMB:       1,
+	})
+}
+
+func TestRecorderOnlyRecordsOptedInSessions(t *testing.T) {
+	r := newTestRecorder(t, false)
+	session := &Session{ID: "robot-1"}
+
+	if turn := r.StartTurn(session); turn != nil {
+		t.Fatal("Expected no recording before the session opts in")
+	}
+	// A nil recording ignores everything
+	var turn *turnRecording
+	turn.saveText("transcript.txt", "hello")
+	turn.Close()
+
+	session.SetRecording(true)
+	if turn := r.StartTurn(session); turn == nil {
+		t.Fatal("Expected a recording once the session opted in")
+	}
+
+	all := newTestRecorder(t, true)
+	if all.StartTurn(&Session{ID: "robot-2"}) == nil {
+		t.Error("Expected all_sessions to record sessions that didn't opt in")
+	}
+	optedOut := &Session{ID: "robot-3"}
+	optedOut.SetRecording(false)
+	if all.StartTurn(optedOut) != nil {
+		t.Error("Expected a session that opted out to stay unrecorded")
+	}
+
+	var disabled *Recorder
+	if disabled.StartTurn(session) != nil {
+		t.Error("Expected no recording without a recorder")
+	}
+}
+
+func TestRecorderWritesTurn(t *testing.T) {
+	r := newTestRecorder(t, true)
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	// Ids that would escape the directory aren't recorded at all
+	if r.StartTurn(&Session{ID: "../escape"}) != nil {
+		t.Error("Expected an unusable session id refused")
+	}
+
+	turn := r.StartTurn(&Session{ID: "robot-1"})
+	turn.saveInput(make([]byte, 320))
+	turn.saveText("transcript.txt", "hello robot")
+	turn.saveJSON("llm_request.json", []byte(`{"model":"gpt-4o"}`))
+
+	var sent []shared.Message
+	send := turn.tee(func(msg shared.Message) error {
+		sent = append(sent, msg)
+		return nil
+	})
+	for _, audio := range []string{"abc", "def"} {
+		send(shared.Message{Type: shared.MessageTypeAudioChunk, Data: shared.AudioChunk{AudioData: []byte(audio), MimeType: "audio/mpeg"}})
+	}
+	turn.Close()
+
+	dir := filepath.Join(r.dir, "robot-1", "20240501T123000.000Z")
+	wav, err := os.ReadFile(filepath.Join(dir, "input.wav"))
+	if err != nil || len(wav) != 44+320 || string(wav[:4]) != "RIFF" {
+		t.Errorf("Expected the input saved as a WAV, got %d bytes (%v)", len(wav), err)
+	}
+	transcript, _ := os.ReadFile(filepath.Join(dir, "transcript.txt"))
+	if string(transcript) != "hello robot\n" {
+		t.Errorf("Unexpected transcript %q", transcript)
+	}
+	request, _ := os.ReadFile(filepath.Join(dir, "llm_request.json"))
+	if !strings.Contains(string(request), "\n  \"model\"") {
+		t.Errorf("Expected the request indented, got %s", request)
+	}
+	reply, _ := os.ReadFile(filepath.Join(dir, "reply.mp3"))
+	if string(reply) != "abcdef" || len(sent) != 2 {
+		t.Errorf("Expected streamed audio recorded and still sent, got %q and %d messages", reply, len(sent))
+	}
+}
+
+func TestRecorderKeepsSameMillisecondTurnsApart(t *testing.T) {
+	r := newTestRecorder(t, true)
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	session := &Session{ID: "robot-1"}
+	first, second := r.StartTurn(session), r.StartTurn(session)
+	if first == nil || second == nil || first.dir == second.dir {
+		t.Fatalf("Expected two turn directories, got %+v and %+v", first, second)
+	}
+	if filepath.Base(second.dir) != "20240501T123000.000Z-1" {
+		t.Errorf("Unexpected second directory %s", second.dir)
+	}
+}
+
+func TestRecorderPrune(t *testing.T) {
+	r := newTestRecorder(t, true)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	write := func(session string, at time.Time, size int) string {
+		dir := filepath.Join(r.dir, session, at.Format(turnTimeLayout))
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "input.wav"), make([]byte, size), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	expired := write("old", now.Add(-2*time.Hour), 10)
+	expiredTwin := expired + "-1"
+	if err := os.Mkdir(expiredTwin, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	oldest := write("a", now.Add(-30*time.Minute), 600<<10)
+	newest := write("b", now.Add(-10*time.Minute), 600<<10)
+	unrelated := filepath.Join(r.dir, "a", "notes")
+	if err := os.MkdirAll(unrelated, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	for _, gone := range []string{expired, expiredTwin, oldest, filepath.Join(r.dir, "old")} {
+		if _, err := os.Stat(gone); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be pruned", gone)
+		}
+	}
+	for _, kept := range []string{newest, unrelated} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("Expected %s to be kept: %v", kept, err)
+		}
+	}
+}
+
+func TestRecordMessage(t *testing.T) {
+	session := &Session{ID: "robot-1"}
+	msg := shared.Message{Type: shared.MessageTypeRecord, Data: shared.RecordData{Enabled: true}}
+
+	recorder = nil
+	if reply := createResponse(context.Background(), session, msg, nil); reply.Type != shared.MessageTypeError {
+		t.Errorf("Expected an error with the recorder disabled, got %+v", reply)
+	}
+
+	recorder = newTestRecorder(t, false)
+	defer func() { recorder = nil }()
+	if reply := createResponse(context.Background(), session, msg, nil); reply.Type != shared.MessageTypeStatus {
+		t.Errorf("Expected a status reply, got %+v", reply)
+	}
+	if !session.Recording(false) {
+		t.Error("Expected the session to be recorded")
+	}
+}
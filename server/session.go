@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"robot-head/shared"
+)
+
+// maxHistoryMessages caps how many user/assistant messages we keep per
+// session so the LLM context doesn't grow without bound.
+const maxHistoryMessages = 20
+
+// serverCapabilities are the capabilities this server can honour.
+var serverCapabilities = []string{
+	shared.CapabilityTextInput,
+	shared.CapabilityAudioInput,
+	shared.CapabilityAudioOutput,
+	shared.CapabilityAudioStream,
+	shared.CapabilityExpressions,
+	shared.CapabilityStates,
+	shared.CapabilityTranscripts,
+}
+
+// Session holds everything we remember about one robot client between
+// turns and across short disconnects.
+type Session struct {
+	ID string
+	// Device is who the client authenticated as, "" when auth is off.
+	Device string
+
+	mu           sync.Mutex
+	history      []Message
+	persona      string
+	voice        VoiceConfig
+	capabilities []string
+	connections  int
+	lastSeen     time.Time
+	// recording is nil until the client opts in or out of the recorder
+	recording *bool
+}
+
+// History returns a copy of the conversation so far.
+func (s *Session) History() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.history...)
+}
+
+// AppendTurn records a completed user/assistant exchange.
+func (s *Session) AppendTurn(userText, assistantText string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history,
+		Message{Role: "user", Content: userText},
+		Message{Role: "assistant", Content: assistantText},
+	)
+	if len(s.history) > maxHistoryMessages {
+		s.history = s.history[len(s.history)-maxHistoryMessages:]
+	}
+}
+
+// LoadHistory replaces the conversation, e.g. with one restored from the
+// transcript store.
+func (s *Session) LoadHistory(history []Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append([]Message(nil), history...)
+	if len(s.history) > maxHistoryMessages {
+		s.history = s.history[len(s.history)-maxHistoryMessages:]
+	}
+}
+
+// ResetHistory forgets the conversation but keeps the session attached.
+func (s *Session) ResetHistory() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = nil
+}
+
+func (s *Session) Persona() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.persona
+}
+
+func (s *Session) SetPersona(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.persona = name
+}
+
+// Voice returns the session's voice override. Empty fields mean the
+// persona's voice applies.
+func (s *Session) Voice() VoiceConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.voice
+}
+
+func (s *Session) SetVoice(voice VoiceConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.voice = voice
+}
+
+// SetRecording opts the session in or out of the debug recorder.
+func (s *Session) SetRecording(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recording = &on
+}
+
+// Recording reports whether the session's turns should be recorded, or def
+// if the client never said.
+func (s *Session) Recording(def bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recording == nil {
+		return def
+	}
+	return *s.recording
+}
+
+func (s *Session) Capabilities() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.capabilities...)
+}
+
+// HasCapability reports whether the capability was negotiated for this session.
+func (s *Session) HasCapability(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate keeps only the requested capabilities the server supports.
+// A client that doesn't advertise anything gets everything the server has,
+// which matches how older clients behaved before the hello message existed.
+func (s *Session) negotiate(requested []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(requested) == 0 {
+		s.capabilities = append([]string(nil), serverCapabilities...)
+		return
+	}
+	s.capabilities = nil
+	for _, want := range requested {
+		for _, have := range serverCapabilities {
+			if want == have {
+				s.capabilities = append(s.capabilities, want)
+				break
+			}
+		}
+	}
+}
+
+// SessionRegistry tracks sessions by client-provided ID. Sessions outlive
+// their WebSocket connection for ttl so a reconnecting client picks up
+// where it left off.
+type SessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+func NewSessionRegistry(ttl time.Duration) *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]*Session),
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// Attach returns the session for id, creating it if it doesn't exist or has
+// expired. An empty id gets a freshly generated one, as does an id already
+// in use by another device. resumed is true when an existing session was
+// reattached.
+func (r *SessionRegistry) Attach(id, device string, capabilities []string) (session *Session, resumed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id == "" {
+		id = newID()
+	}
+
+	session, ok := r.sessions[id]
+	if ok && r.expired(session) {
+		ok = false
+	}
+	if ok && session.Device != device {
+		// Someone else's conversation; start this device afresh
+		id, ok = newID(), false
+	}
+	if !ok {
+		session = &Session{ID: id, Device: device}
+		r.sessions[id] = session
+	}
+
+	session.negotiate(capabilities)
+
+	session.mu.Lock()
+	session.connections++
+	session.lastSeen = r.now()
+	session.mu.Unlock()
+
+	return session, ok
+}
+
+// Detach marks one connection to the session as gone. The session stays in
+// the registry until the janitor expires it.
+func (r *SessionRegistry) Detach(session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.connections > 0 {
+		session.connections--
+	}
+	session.lastSeen = r.now()
+}
+
+// Get returns a session without attaching to it.
+func (r *SessionRegistry) Get(id string) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session, ok := r.sessions[id]
+	if ok && r.expired(session) {
+		return nil, false
+	}
+	return session, ok
+}
+
+// Len returns the number of sessions currently held, connected or not.
+func (r *SessionRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// Expire removes disconnected sessions whose TTL has run out and returns how
+// many were removed.
+func (r *SessionRegistry) Expire() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	removed := 0
+	for id, session := range r.sessions {
+		if r.expired(session) {
+			delete(r.sessions, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// RunJanitor expires sessions every interval until ctx is cancelled.
+func (r *SessionRegistry) RunJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := r.Expire(); n > 0 {
+				slog.Info("Expired idle sessions", "count", n)
+			}
+		}
+	}
+}
+
+// expired must be called with r.mu held.
+func (r *SessionRegistry) expired(session *Session) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.connections == 0 && r.now().Sub(session.lastSeen) > r.ttl
+}
+
+// maxSessionIDLength keeps session ids usable as file names.
+const maxSessionIDLength = 64
+
+// validSessionID reports whether a client-chosen session id can name the
+// session's transcript and recordings: lowercase ASCII letters, digits, "-"
+// and "_" only, so it can't escape their directories and no two ids share a
+// file. Uppercase is refused rather than folded, since "Robot" and "robot"
+// are the same file on a case-insensitive filesystem but different sessions.
+func validSessionID(id string) bool {
+	if id == "" || len(id) > maxSessionIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c != '-' && c != '_' && (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// newID returns a random hex identifier for sessions and audio streams.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405000000000")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+func TestAttachCreatesAndResumesSession(t *testing.T) {
+	registry := NewSessionRegistry(time.Minute)
+
+	session, resumed := registry.Attach("robot-1", "", nil)
+	if resumed {
+		t.Error("First attach should not be a resume")
+	}
+	session.AppendTurn("hello", "hi there")
+	registry.Detach(session)
+
+	again, resumed := registry.Attach("robot-1", "", nil)
+	if !resumed {
+		t.Error("Second attach should resume the session")
+	}
+	if again != session {
+		t.Error("Expected the same session to be returned")
+	}
+	if len(again.History()) != 2 {
+		t.Errorf("Expected history to survive reconnect, got %v", again.History())
+	}
+}
+
+func TestAttachGeneratesID(t *testing.T) {
+	registry := NewSessionRegistry(time.Minute)
+
+	session, _ := registry.Attach("", "", nil)
+	if session.ID == "" {
+		t.Error("Expected a generated session id")
+	}
+}
+
+func TestAttachKeepsDevicesApart(t *testing.T) {
+	registry := NewSessionRegistry(time.Minute)
+
+	kitchen, _ := registry.Attach("robot-1", "kitchen", nil)
+	lounge, resumed := registry.Attach("robot-1", "lounge", nil)
+	if resumed || lounge == kitchen || lounge.ID == "robot-1" || lounge.Device != "lounge" {
+		t.Errorf("Expected another device to get a session of its own, got %+v", lounge)
+	}
+	if again, resumed := registry.Attach("robot-1", "kitchen", nil); !resumed || again != kitchen {
+		t.Error("Expected the owning device to resume its session")
+	}
+}
+
+func TestExpireRemovesOnlyIdleSessions(t *testing.T) {
+	registry := NewSessionRegistry(time.Minute)
+	now := time.Now()
+	registry.now = func() time.Time { return now }
+
+	idle, _ := registry.Attach("idle", "", nil)
+	registry.Detach(idle)
+	registry.Attach("connected", "", nil)
+
+	now = now.Add(2 * time.Minute)
+	if removed := registry.Expire(); removed != 1 {
+		t.Errorf("Expected 1 session expired, got %d", removed)
+	}
+	if _, ok := registry.Get("idle"); ok {
+		t.Error("Idle session should have expired")
+	}
+	if _, ok := registry.Get("connected"); !ok {
+		t.Error("Connected session should not expire")
+	}
+}
+
+func TestExpiredSessionStartsFresh(t *testing.T) {
+	registry := NewSessionRegistry(time.Minute)
+	now := time.Now()
+	registry.now = func() time.Time { return now }
+
+	session, _ := registry.Attach("robot-1", "", nil)
+	session.AppendTurn("hello", "hi there")
+	registry.Detach(session)
+
+	now = now.Add(2 * time.Minute)
+	fresh, resumed := registry.Attach("robot-1", "", nil)
+	if resumed {
+		t.Error("Expired session should not be resumed")
+	}
+	if len(fresh.History()) != 0 {
+		t.Error("Expired session history should be gone")
+	}
+}
+
+func TestValidSessionID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"robot-1":               true,
+		"kitchen_bot":           true,
+		"":                      false,
+		"../escape":             false,
+		"a.b":                   false,
+		"É":                     false,
+		"ａ":                     false,
+		"Robot-1":               false,
+		strings.Repeat("a", 64): true,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := validSessionID(id); got != want {
+			t.Errorf("validSessionID(%q) = %v, expected %v", id, got, want)
+		}
+	}
+}
+
+func TestCapabilityNegotiation(t *testing.T) {
+	registry := NewSessionRegistry(time.Minute)
+
+	session, _ := registry.Attach("robot-1", "", []string{shared.CapabilityAudioInput, "teleport"})
+	if !session.HasCapability(shared.CapabilityAudioInput) {
+		t.Error("Expected audio_input to be negotiated")
+	}
+	if session.HasCapability("teleport") {
+		t.Error("Unsupported capability should be dropped")
+	}
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	session := &Session{ID: "robot-1"}
+	for i := 0; i < maxHistoryMessages; i++ {
+		session.AppendTurn("user", "assistant")
+	}
+	if got := len(session.History()); got != maxHistoryMessages {
+		t.Errorf("Expected history capped at %d, got %d", maxHistoryMessages, got)
+	}
+}
+
+func TestResetMessageClearsHistory(t *testing.T) {
+	registry := NewSessionRegistry(time.Minute)
+	session, _ := registry.Attach("robot-1", "", nil)
+	session.AppendTurn("hello", "hi there")
+
+	reply := createResponse(context.Background(), session, shared.Message{Type: shared.MessageTypeReset}, nil)
+
+	if reply.Type != shared.MessageTypeStatus {
+		t.Errorf("Expected a status reply, got %v", reply.Type)
+	}
+	if len(session.History()) != 0 {
+		t.Errorf("Expected history to be cleared, got %v", session.History())
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 
 	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
@@ -11,16 +11,19 @@ import (
 var whisperModel whisper.Model
 
 func initWhisper() error {
-	model, err := whisper.New("./models/ggml-base.en.bin")
+	model, err := whisper.New(cfg.Whisper.ModelPath)
 	if err != nil {
 		return fmt.Errorf("failed to load whisper model: %v", err)
 	}
 	whisperModel = model
-	log.Println("Whisper model loaded successfully")
+	slog.Info("Whisper model loaded")
 	return nil
 }
 
-func transcribeAudio(audioData []byte) (string, error) {
+// transcribeAudio turns 16-bit PCM into text. Failures are counted so
+// /readyz notices a model that has stopped working.
+func transcribeAudio(audioData []byte) (transcript string, err error) {
+	defer func() { recordWhisperResult(err) }()
 	if whisperModel == nil {
 		return "", fmt.Errorf("whisper model not initialized")
 	}
@@ -46,7 +49,6 @@ func transcribeAudio(audioData []byte) (string, error) {
 	}
 
 	// Extract transcript using NextSegment
-	var transcript string
 	for {
 		segment, err := context.NextSegment()
 		if err != nil {
@@ -58,4 +60,4 @@ func transcribeAudio(audioData []byte) (string, error) {
 	// Clean up transcript
 	transcript = strings.TrimSpace(transcript)
 	return transcript, nil
-}
\ No newline at end of file
+}
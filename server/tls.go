@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"robot-head/shared"
+)
+
+// certReloader serves the certificate in certFile and keyFile, loading it
+// again when either file changes so a renewed certificate is picked up
+// without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the key pair if the files changed since the last load.
+func (r *certReloader) reload() error {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && modTimes == r.modTimes {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	if r.cert != nil {
+		slog.Info("Reloaded TLS certificate", "cert_file", r.certFile)
+	}
+	r.cert, r.modTimes = &cert, modTimes
+	return nil
+}
+
+// GetCertificate is called for every handshake. A certificate that fails
+// to load, e.g. half written, is logged and the previous one kept.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := r.reload(); err != nil {
+		slog.Error("Failed to reload TLS certificate, keeping the old one", "error", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// serverTLSConfig builds the listener's TLS setup, requiring client
+// certificates signed by ClientCAFile when one is given.
+func serverTLSConfig(c TLSConfig) (*tls.Config, error) {
+	reloader, err := newCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if c.ClientCAFile != "" {
+		config.ClientCAs, err = shared.LoadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
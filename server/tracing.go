@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer makes the spans for each turn: a "turn" span per message from the
+// client, continuing the client's trace when it sent one, with a child for
+// each stage. They go nowhere unless tracing is set up in main.
+var tracer = otel.Tracer("robot-head/server")
+
+// speechSpan starts the span for turning a reply into speech.
+func speechSpan(ctx context.Context, voice VoiceConfig, stream bool) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "generateSpeech", trace.WithAttributes(
+		attribute.String("voice.id", voice.VoiceID),
+		attribute.String("voice.model", voice.ModelID),
+		attribute.Bool("tts.stream", stream),
+	))
+}
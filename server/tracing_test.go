@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+
+	"github.com/gorilla/websocket"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTurnJoinsClientTrace(t *testing.T) {
+	// The global provider only takes effect the first time it's set, so
+	// the tracer is swapped instead
+	spans := tracetest.NewInMemoryExporter()
+	saved := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)).Tracer("robot-head/server")
+	sessions = NewSessionRegistry(time.Minute)
+	defer func() { tracer, sessions = saved, nil }()
+
+	server := httptest.NewServer(http.HandlerFunc(establishWebsocketConnection))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The client's capture span
+	clientCtx, capture := sdktrace.NewTracerProvider().Tracer("client").Start(context.Background(), "capture")
+	defer capture.End()
+	traceID := capture.SpanContext().TraceID().String()
+
+	conn.WriteJSON(shared.Message{Type: shared.MessageTypeHello, Data: shared.HelloData{SessionID: "robot-1"}})
+	var reply shared.Message
+	conn.ReadJSON(&reply)
+
+	conn.WriteJSON(shared.Message{Type: shared.MessageTypeReset, TraceParent: shared.InjectTrace(clientCtx)})
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reply.TraceParent, traceID) {
+		t.Errorf("Expected the reply to carry trace %s, got %q", traceID, reply.TraceParent)
+	}
+
+	// The turn span ends just after the reply is written
+	deadline := time.Now().Add(time.Second)
+	for len(spans.GetSpans()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	names := map[string]bool{}
+	for _, span := range spans.GetSpans() {
+		names[span.Name] = true
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("Expected span %s in the client's trace", span.Name)
+		}
+	}
+	if !names["turn"] || !names["websocket.write"] {
+		t.Errorf("Expected turn and websocket.write spans, got %v", names)
+	}
+}
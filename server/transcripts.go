@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TranscriptEntry is one line of a session's transcript: a completed turn,
+// or a marker where the conversation was reset.
+type TranscriptEntry struct {
+	At      time.Time `json:"at"`
+	Device  string    `json:"device,omitempty"`
+	Persona string    `json:"persona,omitempty"`
+	// Input is how the user spoke: "audio" or "text".
+	Input string `json:"input,omitempty"`
+	User  string `json:"user,omitempty"`
+	Robot string `json:"robot,omitempty"`
+	Reset bool   `json:"reset,omitempty"`
+
+	// Latencies of each stage, in milliseconds.
+	TranscribeMS int64 `json:"transcribe_ms,omitempty"`
+	LLMMS        int64 `json:"llm_ms,omitempty"`
+	TTSMS        int64 `json:"tts_ms,omitempty"`
+	TotalMS      int64 `json:"total_ms,omitempty"`
+
+	Usage *TurnUsage `json:"usage,omitempty"`
+}
+
+// TranscriptSummary describes one stored session.
+type TranscriptSummary struct {
+	SessionID string    `json:"session_id"`
+	Device    string    `json:"device,omitempty"`
+	Turns     int       `json:"turns"`
+	Persona   string    `json:"persona,omitempty"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+}
+
+// TranscriptStore keeps each session's conversation as a JSON lines file,
+// <dir>/<session id>.jsonl, one entry per turn.
+type TranscriptStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// transcripts is nil when the server was started without a transcript store.
+var transcripts *TranscriptStore
+
+func NewTranscriptStore(dir string) (*TranscriptStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create transcript directory: %w", err)
+	}
+	return &TranscriptStore{dir: dir}, nil
+}
+
+func (s *TranscriptStore) path(sessionID string) string {
+	return filepath.Join(s.dir, sessionID+".jsonl")
+}
+
+// Append adds an entry to the session's transcript.
+func (s *TranscriptStore) Append(sessionID string, entry TranscriptEntry) error {
+	if !validSessionID(sessionID) {
+		return fmt.Errorf("session id %q can't name a transcript", sessionID)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path(sessionID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Load returns the session's whole transcript. ok is false if there is
+// none, as for ids that could never have had one.
+func (s *TranscriptStore) Load(sessionID string) (entries []TranscriptEntry, ok bool, err error) {
+	if !validSessionID(sessionID) {
+		return nil, false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path(sessionID))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	entries, err = readTranscript(f, sessionID)
+	return entries, err == nil, err
+}
+
+// readTranscript parses a transcript file. A line that doesn't parse, like
+// one cut short by a crash, is skipped so the rest can still be read.
+func readTranscript(r io.Reader, sessionID string) ([]TranscriptEntry, error) {
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("Skipping unreadable transcript line", "session_id", sessionID, "line", line, "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Sessions lists the stored sessions, most recently active first.
+func (s *TranscriptStore) Sessions() ([]TranscriptSummary, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries []TranscriptSummary
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".jsonl")
+		entries, _, err := s.Load(id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		summary := TranscriptSummary{SessionID: id, Device: transcriptDevice(entries)}
+		for _, entry := range entries {
+			if summary.First.IsZero() {
+				summary.First = entry.At
+			}
+			summary.Last = entry.At
+			if !entry.Reset {
+				summary.Turns++
+				summary.Persona = entry.Persona
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Last.After(summaries[j].Last) })
+	return summaries, nil
+}
+
+// transcriptDevice is the device a transcript was recorded from, "" if it
+// is all from before auth was on.
+func transcriptDevice(entries []TranscriptEntry) string {
+	device := ""
+	for _, entry := range entries {
+		if entry.Device != "" {
+			device = entry.Device
+		}
+	}
+	return device
+}
+
+// Owns reports whether device may pick up the session's transcript: it has
+// none yet, or only entries from that device or from before auth was on.
+func (s *TranscriptStore) Owns(sessionID, device string) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	entries, _, err := s.Load(sessionID)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Device != "" && entry.Device != device {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// History rebuilds the LLM context from the session's transcript: the
+// turns since it was last reset, capped like a live session's history.
+func (s *TranscriptStore) History(sessionID string) ([]Message, error) {
+	entries, _, err := s.Load(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var history []Message
+	for _, entry := range entries {
+		if entry.Reset {
+			history = nil
+			continue
+		}
+		history = append(history,
+			Message{Role: "user", Content: entry.User},
+			Message{Role: "assistant", Content: entry.Robot},
+		)
+	}
+	if len(history) > maxHistoryMessages {
+		history = history[len(history)-maxHistoryMessages:]
+	}
+	return history, nil
+}
+
+// writeTranscriptMarkdown formats a transcript for people to read.
+func writeTranscriptMarkdown(w io.Writer, sessionID string, entries []TranscriptEntry) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "# Conversation %s\n", sessionID)
+	for _, entry := range entries {
+		at := entry.At.Local().Format("2006-01-02 15:04:05")
+		if entry.Reset {
+			fmt.Fprintf(b, "\n---\n\n*Conversation reset at %s*\n", at)
+			continue
+		}
+		fmt.Fprintf(b, "\n**User** (%s, %s): %s\n\n", at, entry.Input, entry.User)
+		fmt.Fprintf(b, "**Robot** (%s, %dms): %s\n", entry.Persona, entry.TotalMS, entry.Robot)
+	}
+	return b.Flush()
+}
+
+// exportTranscript writes a transcript as "json" or "markdown".
+func exportTranscript(w io.Writer, sessionID string, entries []TranscriptEntry, format string) error {
+	switch format {
+	case "json", "":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			SessionID string            `json:"session_id"`
+			Turns     []TranscriptEntry `json:"turns"`
+		}{sessionID, entries})
+	case "markdown", "md":
+		return writeTranscriptMarkdown(w, sessionID, entries)
+	default:
+		return fmt.Errorf("unknown format %q, use json or markdown", format)
+	}
+}
+
+// handleTranscripts lists the sessions of the calling device as JSON.
+func handleTranscripts(w http.ResponseWriter, r *http.Request) {
+	all, err := transcripts.Sessions()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list transcripts", "error", err)
+		http.Error(w, "could not list transcripts", http.StatusInternalServerError)
+		return
+	}
+	summaries := []TranscriptSummary{}
+	for _, summary := range all {
+		if summary.Device == requestDevice(r) {
+			summaries = append(summaries, summary)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// handleTranscript exports one of the calling device's transcripts, as
+// JSON unless ?format=markdown is given. Other devices' sessions are not
+// found.
+func handleTranscript(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	entries, ok, err := transcripts.Load(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load transcript", "session_id", id, "error", err)
+		http.Error(w, "could not load transcript", http.StatusInternalServerError)
+		return
+	}
+	if !ok || transcriptDevice(entries) != requestDevice(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+	case "markdown", "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q, use json or markdown", format), http.StatusBadRequest)
+		return
+	}
+	if err := exportTranscript(w, id, entries, format); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to export transcript", "session_id", id, "error", err)
+	}
+}
+
+// runTranscriptsCommand is the "transcripts" subcommand:
+//
+//	robot-head-server transcripts [--config FILE] [--dir DIR] list
+//	robot-head-server transcripts [--config FILE] [--dir DIR] [--format markdown] export SESSION
+//
+// The directory is found like the server finds it, from the config file and
+// TRANSCRIPTS_DIR, unless --dir is given. It returns the exit code.
+func runTranscriptsCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("transcripts", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", getEnv("ROBOT_SERVER_CONFIG", ""), "path to the server's YAML config file")
+	dir := fs.String("dir", "", "transcript directory, instead of transcripts.dir from the config")
+	format := fs.String("format", "json", "export format: json or markdown")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: transcripts [flags] list | export SESSION")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	config, err := baseConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *dir == "" {
+		*dir = config.Transcripts.Dir
+	}
+
+	store := &TranscriptStore{dir: *dir}
+	switch fs.Arg(0) {
+	case "list":
+		summaries, err := store.Sessions()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		for _, s := range summaries {
+			fmt.Fprintf(stdout, "%s\t%d turns\t%s\t%s\n", s.SessionID, s.Turns, s.Persona, s.Last.Local().Format(time.DateTime))
+		}
+		return 0
+	case "export":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return 2
+		}
+		entries, ok, err := store.Load(fs.Arg(1))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if !ok {
+			fmt.Fprintf(stderr, "no transcript for session %s\n", fs.Arg(1))
+			return 1
+		}
+		if err := exportTranscript(stdout, fs.Arg(1), entries, *format); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	default:
+		fs.Usage()
+		return 2
+	}
+}
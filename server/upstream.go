@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned without calling an upstream that has been
+// failing, so the turn falls back straight away instead of waiting on it.
+var errCircuitOpen = errors.New("circuit open")
+
+// upstream is an API the server depends on. Requests to it are retried on
+// failures that might pass, and a circuit breaker stops calling it once it
+// looks down.
+type upstream struct {
+	name string
+	// timeout is how long each attempt waits for the response headers; the
+	// turn's context bounds them all and the reading of the body
+	timeout func() time.Duration
+	breaker circuitBreaker
+}
+
+var (
+	openAIUpstream     = &upstream{name: "openai", timeout: func() time.Duration { return cfg.OpenAI.Timeout }}
+	elevenLabsUpstream = &upstream{name: "elevenlabs", timeout: func() time.Duration { return cfg.ElevenLabs.Timeout }}
+)
+
+// Do sends req, retrying with jittered backoff while the upstream answers
+// with a retriable status or can't be reached. A retry that couldn't start
+// before ctx's deadline isn't tried. The last response is returned as is,
+// so callers parse error statuses themselves, but a request that got no
+// response returns an *UpstreamError.
+func (u *upstream) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := u.do(ctx, req)
+	if err != nil {
+		var upstreamErr *UpstreamError
+		if !errors.As(err, &upstreamErr) {
+			err = u.transportError(err)
+		}
+	}
+	return resp, err
+}
+
+func (u *upstream) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if !u.breaker.allow() {
+			upstreamRejectedTotal.inc(u.name)
+			return nil, &UpstreamError{Upstream: u.name, Kind: ErrUnavailable, Err: errCircuitOpen}
+		}
+
+		try := req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			try.Body = body
+		}
+		resp, err := u.attempt(ctx, try)
+		if ctx.Err() != nil {
+			// The turn was cancelled or ran out of time, which says nothing
+			// about the upstream
+			u.breaker.release()
+			return resp, err
+		}
+		u.breaker.record(err == nil && resp.StatusCode < 500)
+
+		if !retriable(resp, err) || attempt >= cfg.Upstream.MaxAttempts {
+			return resp, err
+		}
+		delay := backoff(attempt, resp)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		slog.WarnContext(ctx, "Retrying upstream request", "upstream", u.name, "attempt", attempt,
+			"delay_ms", delay.Milliseconds(), "reason", reason)
+		upstreamRetriesTotal.inc(u.name)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// errHeaderTimeout is an attempt the upstream didn't start answering in time.
+var errHeaderTimeout = fmt.Errorf("no response headers in time: %w", context.DeadlineExceeded)
+
+// attempt sends req once. Only the wait for the response headers is timed:
+// a streamed body can take far longer to arrive than the upstream takes to
+// start sending it, so reading it is left to ctx.
+func (u *upstream) attempt(ctx context.Context, req *http.Request) (*http.Response, error) {
+	attemptCtx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(u.timeout(), cancel)
+	resp, err := http.DefaultClient.Do(req.WithContext(attemptCtx))
+	if !timer.Stop() && ctx.Err() == nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, errHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases an attempt's context once its body is done with.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retriable reports whether trying again might work: the upstream was
+// unreachable, busy or briefly broken.
+func retriable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff is how long to wait before the next attempt: what the upstream
+// asked for in Retry-After, or else a random delay up to an exponentially
+// growing cap.
+func backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return wait
+		}
+	}
+	limit := cfg.Upstream.BaseDelay
+	for i := 1; i < attempt && limit < cfg.Upstream.MaxDelay; i++ {
+		limit *= 2
+	}
+	return rand.N(min(limit, cfg.Upstream.MaxDelay)) + 1
+}
+
+// retryAfter parses a Retry-After header, in seconds or as a date.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// circuitBreaker opens after cfg.Upstream.BreakerFailures failures in a
+// row, refusing calls for BreakerCooldown. Then one call is let through to
+// see if the upstream is back: success closes the circuit, failure opens it
+// for another cooldown.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cfg.Upstream.BreakerFailures == 0 || b.failures < cfg.Upstream.BreakerFailures {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < cfg.Upstream.BreakerCooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if cfg.Upstream.BreakerFailures > 0 && b.failures >= cfg.Upstream.BreakerFailures {
+		b.openedAt = time.Now()
+	}
+}
+
+// release gives up a call's turn as the probe without saying how it went.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// state is closed, open or half_open, for /readyz.
+func (b *circuitBreaker) state() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case cfg.Upstream.BreakerFailures == 0 || b.failures < cfg.Upstream.BreakerFailures:
+		return "closed"
+	case b.probing || time.Since(b.openedAt) >= cfg.Upstream.BreakerCooldown:
+		return "half_open"
+	}
+	return "open"
+}
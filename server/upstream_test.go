@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fastRetries gives the test its own upstream, so breaker state doesn't
+// leak between tests, and shrinks the backoff so retries don't slow it.
+func fastRetries(t *testing.T, u **upstream) {
+	t.Helper()
+	saved, savedConfig := *u, cfg.Upstream
+	*u = &upstream{name: saved.name, timeout: saved.timeout}
+	cfg.Upstream.BaseDelay, cfg.Upstream.MaxDelay = time.Millisecond, 5*time.Millisecond
+	t.Cleanup(func() { *u, cfg.Upstream = saved, savedConfig })
+}
+
+// scripted answers each request with the next status in turn, repeating
+// the last one once they run out.
+func scripted(calls *int, statuses ...int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[min(*calls, len(statuses)-1)]
+		*calls++
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+	}
+}
+
+func TestUpstreamRetriesUntilSuccess(t *testing.T) {
+	calls := 0
+	var bodies []string
+	fakeOpenAI(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if calls < 2 {
+			scripted(&calls, http.StatusServiceUnavailable, http.StatusTooManyRequests)(w, r)
+			return
+		}
+		calls++
+		replyWith("Made it.", 5)(w, r)
+	})
+
+	reply, _, err := callLLM(context.Background(), Persona{Name: "test", SystemPrompt: "Be brief."}, nil, "hi", nil)
+	if err != nil || reply != "Made it." {
+		t.Fatalf("Expected the third attempt to succeed, got %q (%v)", reply, err)
+	}
+	if calls != 3 || bodies[0] == "" || bodies[2] != bodies[0] {
+		t.Errorf("Expected the same request sent three times, got %d calls with bodies %q", calls, bodies)
+	}
+}
+
+func TestUpstreamGivesUp(t *testing.T) {
+	for name, c := range map[string]struct {
+		status int
+		calls  int
+	}{
+		"server error": {http.StatusInternalServerError, 3},
+		"bad request":  {http.StatusBadRequest, 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			fakeElevenLabs(t, scripted(&calls, c.status))
+			if _, err := generateSpeech(context.Background(), "hello", VoiceConfig{VoiceID: "voice-1"}); err == nil {
+				t.Error("Expected an error")
+			}
+			if calls != c.calls {
+				t.Errorf("Expected %d calls, got %d", c.calls, calls)
+			}
+		})
+	}
+}
+
+func TestUpstreamRetryBoundedByDeadline(t *testing.T) {
+	calls := 0
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	started := time.Now()
+	if _, err := generateSpeech(ctx, "hello", VoiceConfig{VoiceID: "voice-1"}); err == nil {
+		t.Error("Expected the 503 back")
+	}
+	if calls != 1 || time.Since(started) > 500*time.Millisecond {
+		t.Errorf("Expected no retry that would pass the deadline, got %d calls in %v", calls, time.Since(started))
+	}
+}
+
+func TestUpstreamTimesOutWaitingForHeaders(t *testing.T) {
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	cfg.ElevenLabs.Timeout = 20 * time.Millisecond
+	cfg.Upstream.MaxAttempts = 1
+
+	_, err := generateSpeech(context.Background(), "hello", VoiceConfig{VoiceID: "voice-1"})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	calls := 0
+	status := http.StatusBadGateway
+	fakeElevenLabs(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	})
+	cfg.Upstream.MaxAttempts = 1
+	cfg.Upstream.BreakerFailures = 2
+	cfg.Upstream.BreakerCooldown = 20 * time.Millisecond
+	speak := func() error {
+		_, err := generateSpeech(context.Background(), "hello", VoiceConfig{VoiceID: "voice-1"})
+		return err
+	}
+
+	speak()
+	speak()
+	if err := speak(); !errors.Is(err, errCircuitOpen) || calls != 2 {
+		t.Fatalf("Expected the open circuit to skip the call, got %v after %d calls", err, calls)
+	}
+	if state := elevenLabsUpstream.breaker.state(); state != "open" {
+		t.Errorf("Expected the breaker open, got %s", state)
+	}
+
+	time.Sleep(cfg.Upstream.BreakerCooldown)
+	status = http.StatusOK
+	if err := speak(); err != nil || calls != 3 {
+		t.Fatalf("Expected a probe through after the cooldown, got %v after %d calls", err, calls)
+	}
+	if state := elevenLabsUpstream.breaker.state(); state != "closed" {
+		t.Errorf("Expected the breaker closed again, got %s", state)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if wait, ok := retryAfter("3"); !ok || wait != 3*time.Second {
+		t.Errorf("Expected 3s, got %v", wait)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if wait, ok := retryAfter(date); !ok || wait <= 50*time.Second || wait > time.Minute {
+		t.Errorf("Expected about a minute from %q, got %v", date, wait)
+	}
+	if _, ok := retryAfter("soon"); ok {
+		t.Error("Expected an unparseable Retry-After to be ignored")
+	}
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	for attempt := 1; attempt < 70; attempt++ {
+		if wait := backoff(attempt, nil); wait <= 0 || wait > cfg.Upstream.MaxDelay {
+			t.Fatalf("Attempt %d: backoff %v outside (0, %v]", attempt, wait, cfg.Upstream.MaxDelay)
+		}
+	}
+}
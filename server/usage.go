@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TurnUsage is what one turn used of each paid service, and what that is
+// estimated to cost from the price table.
+type TurnUsage struct {
+	// AudioSeconds is how much speech whisper transcribed.
+	AudioSeconds     float64 `json:"audio_seconds,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	PromptTokens     int     `json:"prompt_tokens,omitempty"`
+	CompletionTokens int     `json:"completion_tokens,omitempty"`
+	TTSCharacters    int     `json:"tts_characters,omitempty"`
+	CostUSD          float64 `json:"cost_usd,omitempty"`
+}
+
+// costs prices each service's part of the turn. Models missing from the
+// price table cost nothing.
+func (p PricesConfig) costs(u TurnUsage) (stt, llm, tts float64) {
+	stt = u.AudioSeconds / 60 * p.STTPerMinute
+	if price, ok := p.LLM[u.Model]; ok {
+		llm = (float64(u.PromptTokens)*price.Prompt + float64(u.CompletionTokens)*price.Completion) / 1e6
+	}
+	tts = float64(u.TTSCharacters) / 1000 * p.TTSPer1KCharacters
+	return stt, llm, tts
+}
+
+// priced fills in CostUSD.
+func (u TurnUsage) priced(p PricesConfig) TurnUsage {
+	stt, llm, tts := p.costs(u)
+	u.CostUSD = stt + llm + tts
+	return u
+}
+
+// usageTotals adds up the usage of many turns.
+type usageTotals struct {
+	Turns            int       `json:"turns"`
+	AudioSeconds     float64   `json:"audio_seconds"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TTSCharacters    int       `json:"tts_characters"`
+	CostUSD          float64   `json:"cost_usd"`
+	Last             time.Time `json:"last"`
+}
+
+func (t *usageTotals) add(u TurnUsage, turns int, at time.Time) {
+	t.Turns += turns
+	t.AudioSeconds += u.AudioSeconds
+	t.PromptTokens += u.PromptTokens
+	t.CompletionTokens += u.CompletionTokens
+	t.TTSCharacters += u.TTSCharacters
+	t.CostUSD += u.CostUSD
+	t.Last = at
+}
+
+// How long the ledger remembers sessions and days after their last turn.
+// Transcripts keep every turn's usage for longer.
+const (
+	sessionUsageRetention = 24 * time.Hour
+	dayUsageRetention     = 31 * 24 * time.Hour
+)
+
+// UsageLedger adds up turn usage per session, per device and per UTC day.
+// It lives in memory; the daily budget has its own state file.
+type UsageLedger struct {
+	mu       sync.Mutex
+	sessions map[string]*usageTotals
+	devices  map[string]*usageTotals
+	days     map[string]*usageTotals
+}
+
+var usageLedger = NewUsageLedger()
+
+func NewUsageLedger() *UsageLedger {
+	return &UsageLedger{
+		sessions: map[string]*usageTotals{},
+		devices:  map[string]*usageTotals{},
+		days:     map[string]*usageTotals{},
+	}
+}
+
+// Record adds a turn to the session's, its device's and the day's totals.
+func (l *UsageLedger) Record(session *Session, u TurnUsage, at time.Time) {
+	l.record(session, u, 1, at)
+}
+
+// Spend adds usage that wasn't part of a turn, like blank audio or a spoken
+// error, to the totals.
+func (l *UsageLedger) Spend(session *Session, u TurnUsage, at time.Time) {
+	l.record(session, u, 0, at)
+}
+
+func (l *UsageLedger) record(session *Session, u TurnUsage, turns int, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, t := range []struct {
+		totals map[string]*usageTotals
+		key    string
+	}{
+		{l.sessions, session.ID},
+		{l.devices, session.Device},
+		{l.days, at.UTC().Format(time.DateOnly)},
+	} {
+		if t.key == "" {
+			// Without auth there are no devices
+			continue
+		}
+		totals, ok := t.totals[t.key]
+		if !ok {
+			totals = &usageTotals{}
+			t.totals[t.key] = totals
+		}
+		totals.add(u, turns, at)
+	}
+	prune(l.sessions, at.Add(-sessionUsageRetention))
+	prune(l.days, at.Add(-dayUsageRetention))
+}
+
+func prune(totals map[string]*usageTotals, before time.Time) {
+	for key, t := range totals {
+		if t.Last.Before(before) {
+			delete(totals, key)
+		}
+	}
+}
+
+// usageReport is what /admin/usage returns.
+type usageReport struct {
+	Sessions map[string]usageTotals `json:"sessions"`
+	Devices  map[string]usageTotals `json:"devices"`
+	Days     map[string]usageTotals `json:"days"`
+}
+
+func (l *UsageLedger) Report() usageReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	copyTotals := func(totals map[string]*usageTotals) map[string]usageTotals {
+		copied := make(map[string]usageTotals, len(totals))
+		for key, t := range totals {
+			copied[key] = *t
+		}
+		return copied
+	}
+	return usageReport{
+		Sessions: copyTotals(l.sessions),
+		Devices:  copyTotals(l.devices),
+		Days:     copyTotals(l.days),
+	}
+}
+
+// recordUsage prices a finished turn's usage, counts it in the metrics and
+// adds it to the ledger.
+func recordUsage(ctx context.Context, session *Session, u TurnUsage) {
+	u = countUsage(u)
+	usageLedger.Record(session, u, time.Now())
+	slog.DebugContext(ctx, "Turn usage", "prompt_tokens", u.PromptTokens, "completion_tokens", u.CompletionTokens,
+		"tts_characters", u.TTSCharacters, "audio_seconds", u.AudioSeconds, "cost_usd", u.CostUSD)
+}
+
+// recordSpend is recordUsage for work outside a turn: audio transcribed
+// without a turn coming of it, and spoken errors.
+func recordSpend(ctx context.Context, session *Session, u TurnUsage) {
+	u = countUsage(u)
+	usageLedger.Spend(session, u, time.Now())
+	slog.DebugContext(ctx, "Usage outside a turn", "tts_characters", u.TTSCharacters,
+		"audio_seconds", u.AudioSeconds, "cost_usd", u.CostUSD)
+}
+
+// countUsage prices u and counts it in the metrics.
+func countUsage(u TurnUsage) TurnUsage {
+	stt, llm, tts := cfg.Prices.costs(u)
+	u.CostUSD = stt + llm + tts
+
+	sttAudioSecondsTotal.add(u.AudioSeconds)
+	if u.Model != "" {
+		llmTokensTotal.add(float64(u.PromptTokens), u.Model, "prompt")
+		llmTokensTotal.add(float64(u.CompletionTokens), u.Model, "completion")
+	}
+	ttsCharactersTotal.add(float64(u.TTSCharacters))
+	costUSDTotal.add(stt, "stt")
+	costUSDTotal.add(llm, "llm")
+	costUSDTotal.add(tts, "tts")
+	return u
+}
+
+// handleUsage serves /admin/usage.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(usageLedger.Report())
+}
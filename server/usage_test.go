@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"robot-head/shared"
+)
+
+func TestPricesCosts(t *testing.T) {
+	prices := defaultConfig().Prices
+	prices.STTPerMinute = 0.006
+	u := TurnUsage{AudioSeconds: 30, Model: "gpt-4o", PromptTokens: 1000, CompletionTokens: 100, TTSCharacters: 2000}
+
+	stt, llm, tts := prices.costs(u)
+	for name, c := range map[string][2]float64{
+		"stt": {stt, 0.003},
+		"llm": {llm, 0.0025 + 0.001},
+		"tts": {tts, 0.6},
+	} {
+		if math.Abs(c[0]-c[1]) > 1e-9 {
+			t.Errorf("Expected %s to cost %v, got %v", name, c[1], c[0])
+		}
+	}
+
+	u.Model = "unpriced"
+	if _, llm, _ := prices.costs(u); llm != 0 {
+		t.Errorf("Expected an unpriced model to cost nothing, got %v", llm)
+	}
+}
+
+func TestUsageLedgerAggregates(t *testing.T) {
+	ledger := NewUsageLedger()
+	now := time.Now()
+	ledger.Record(&Session{ID: "s1", Device: "kitchen"}, TurnUsage{PromptTokens: 10, CostUSD: 0.5}, now.Add(-48*time.Hour))
+	ledger.Record(&Session{ID: "s2", Device: "kitchen"}, TurnUsage{PromptTokens: 20, CostUSD: 1}, now)
+	ledger.Record(&Session{ID: "s3"}, TurnUsage{TTSCharacters: 5}, now)
+
+	report := ledger.Report()
+	if _, ok := report.Sessions["s1"]; ok || len(report.Sessions) != 2 {
+		t.Errorf("Expected the idle session dropped, got %v", report.Sessions)
+	}
+	if kitchen := report.Devices["kitchen"]; kitchen.Turns != 2 || kitchen.PromptTokens != 30 || kitchen.CostUSD != 1.5 || len(report.Devices) != 1 {
+		t.Errorf("Expected the kitchen's two turns added up, got %v", report.Devices)
+	}
+	if today := report.Days[now.UTC().Format(time.DateOnly)]; today.Turns != 2 || today.TTSCharacters != 5 || len(report.Days) != 2 {
+		t.Errorf("Expected turns split by day, got %v", report.Days)
+	}
+}
+
+func TestRespondToRecordsUsage(t *testing.T) {
+	fakeOpenAI(t, replyWith("Hello there.", 12))
+	transcripts = newTestTranscripts(t)
+	usageLedger = NewUsageLedger()
+	defer func() { transcripts, usageLedger = nil, NewUsageLedger() }()
+
+	registry := NewSessionRegistry(time.Minute)
+	session, _ := registry.Attach("robot-1", "", []string{shared.CapabilityTextInput})
+	createResponse(context.Background(), session, shared.Message{Type: shared.MessageTypeUserInput, Data: "hello"}, nil)
+
+	entries, _, err := transcripts.Load("robot-1")
+	if err != nil || len(entries) != 1 || entries[0].Usage == nil {
+		t.Fatalf("Expected the turn's usage in the transcript, got %+v (%v)", entries, err)
+	}
+	if u := *entries[0].Usage; u.Model != cfg.OpenAI.Model || u.PromptTokens != 11 || u.CompletionTokens != 1 || u.CostUSD <= 0 {
+		t.Errorf("Unexpected turn usage %+v", u)
+	}
+
+	rec := httptest.NewRecorder()
+	handleUsage(rec, httptest.NewRequest(http.MethodGet, "/admin/usage", nil))
+	var report usageReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if s := report.Sessions["robot-1"]; s.Turns != 1 || s.PromptTokens != 11 || s.CostUSD != entries[0].Usage.CostUSD {
+		t.Errorf("Expected the turn in the session's totals, got %+v", report.Sessions)
+	}
+
+	metrics := httptest.NewRecorder()
+	handleMetrics(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), `robot_head_llm_tokens_total{model="gpt-4o",kind="prompt"}`) {
+		t.Error("Expected the prompt tokens in the metrics")
+	}
+}
+
+func TestAudioWithoutTurnIsCounted(t *testing.T) {
+	usageLedger = NewUsageLedger()
+	defer func() { usageLedger = NewUsageLedger() }()
+	defer whisperFailures.Store(0)
+
+	// Without a whisper model every chunk fails to transcribe
+	registry := NewSessionRegistry(time.Minute)
+	session, _ := registry.Attach("robot-1", "", []string{shared.CapabilityAudioInput})
+	audio := shared.Message{Type: shared.MessageTypeAudio, Data: shared.AudioData{AudioData: make([]byte, 2*inputSampleRate), MimeType: "audio/pcm"}}
+	createResponse(context.Background(), session, audio, func(shared.Message) error { return nil })
+
+	if s := usageLedger.Report().Sessions["robot-1"]; s.Turns != 0 || s.AudioSeconds != 1 {
+		t.Errorf("Expected a second of audio and no turns, got %+v", s)
+	}
+}
+
+func TestSpokenPersonaSwitchIsNotATurn(t *testing.T) {
+	saved := personas
+	personas = NewPersonaStore()
+	personas.personas["pirate"] = Persona{Name: "pirate", SystemPrompt: "Arr."}
+	usageLedger = NewUsageLedger()
+	defer func() { personas, usageLedger = saved, NewUsageLedger() }()
+
+	registry := NewSessionRegistry(time.Minute)
+	session, _ := registry.Attach("robot-1", "", []string{shared.CapabilityTextInput})
+	createResponse(context.Background(), session, shared.Message{Type: shared.MessageTypeUserInput, Data: "switch to pirate mode"}, nil)
+
+	if session.Persona() != "pirate" {
+		t.Fatalf("Expected the switch to pirate, got %q", session.Persona())
+	}
+	if s := usageLedger.Report().Sessions["robot-1"]; s.Turns != 0 {
+		t.Errorf("Expected no turn counted, got %+v", s)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"robot-head/shared"
+)
+
+// Alignment is ElevenLabs' character timing for a piece of speech: one
+// start and end time, in seconds, per character of the text.
+type Alignment struct {
+	Characters []string  `json:"characters"`
+	StartTimes []float64 `json:"character_start_times_seconds"`
+	EndTimes   []float64 `json:"character_end_times_seconds"`
+}
+
+// digraphVisemes are letter pairs that make one sound. Both letters get
+// the pair's viseme.
+var digraphVisemes = map[string]string{
+	"th": shared.VisemeTH,
+	"ph": shared.VisemeFV,
+	"oo": shared.VisemeU,
+	"ee": shared.VisemeE,
+	"ea": shared.VisemeE,
+	"ou": shared.VisemeWQ,
+	"ow": shared.VisemeO,
+	"sh": shared.VisemeEtc,
+	"ch": shared.VisemeEtc,
+	"wh": shared.VisemeWQ,
+}
+
+// letterVisemes maps single letters. Anything not listed, such as spaces
+// and punctuation, is a rest.
+var letterVisemes = map[rune]string{
+	'a': shared.VisemeAI, 'i': shared.VisemeAI, 'y': shared.VisemeE,
+	'e': shared.VisemeE,
+	'o': shared.VisemeO,
+	'u': shared.VisemeU,
+	'w': shared.VisemeWQ, 'q': shared.VisemeWQ,
+	'm': shared.VisemeMBP, 'b': shared.VisemeMBP, 'p': shared.VisemeMBP,
+	'f': shared.VisemeFV, 'v': shared.VisemeFV,
+	'l': shared.VisemeL, 't': shared.VisemeL, 'd': shared.VisemeL, 'n': shared.VisemeL,
+	'c': shared.VisemeEtc, 'g': shared.VisemeEtc, 'k': shared.VisemeEtc, 'j': shared.VisemeEtc,
+	's': shared.VisemeEtc, 'z': shared.VisemeEtc, 'r': shared.VisemeEtc, 'x': shared.VisemeEtc,
+	'h': shared.VisemeEtc,
+}
+
+// charVisemes returns a viseme for each character. It's spelling-based
+// rather than phonetic, which is close enough to read as speech on a face.
+func charVisemes(chars []string) []string {
+	lower := make([]rune, len(chars))
+	for i, c := range chars {
+		for _, r := range strings.ToLower(c) {
+			lower[i] = r
+			break
+		}
+	}
+
+	visemes := make([]string, len(chars))
+	for i := 0; i < len(lower); i++ {
+		if i+1 < len(lower) {
+			if v, ok := digraphVisemes[string(lower[i:i+2])]; ok {
+				visemes[i], visemes[i+1] = v, v
+				i++
+				continue
+			}
+		}
+		if v, ok := letterVisemes[lower[i]]; ok {
+			visemes[i] = v
+		} else {
+			visemes[i] = shared.VisemeRest
+		}
+	}
+	return visemes
+}
+
+// Visemes turns the character timing into a viseme timeline, merging runs
+// of the same mouth shape into one cue.
+func (a Alignment) Visemes() []shared.VisemeCue {
+	n := len(a.Characters)
+	if len(a.StartTimes) < n || len(a.EndTimes) < n {
+		return nil
+	}
+
+	var cues []shared.VisemeCue
+	for i, viseme := range charVisemes(a.Characters) {
+		start, end := a.StartTimes[i], a.EndTimes[i]
+		if last := len(cues) - 1; last >= 0 && cues[last].Viseme == viseme {
+			cues[last].End = end
+			continue
+		}
+		cues = append(cues, shared.VisemeCue{Viseme: viseme, Start: start, End: end})
+	}
+	return cues
+}
+
+// Rough speaking rate for estimated timelines, at normal speed.
+const (
+	estimatedCharSeconds  = 0.065
+	estimatedCommaSeconds = 0.2
+	estimatedStopSeconds  = 0.35
+)
+
+// estimateAlignment guesses character timing from the text alone, for TTS
+// output that doesn't come with timestamps. speed is the voice's speaking
+// speed, 1 being normal.
+func estimateAlignment(text string, speed float64) Alignment {
+	if speed <= 0 {
+		speed = 1
+	}
+
+	var a Alignment
+	t := 0.0
+	for _, r := range text {
+		duration := estimatedCharSeconds
+		switch {
+		case r == ',' || r == ';' || r == ':':
+			duration = estimatedCommaSeconds
+		case r == '.' || r == '!' || r == '?':
+			duration = estimatedStopSeconds
+		case unicode.IsSpace(r):
+			duration = estimatedCharSeconds / 2
+		}
+		duration /= speed
+
+		a.Characters = append(a.Characters, string(r))
+		a.StartTimes = append(a.StartTimes, t)
+		a.EndTimes = append(a.EndTimes, t+duration)
+		t += duration
+	}
+	return a
+}
+
+// estimateSpeech is the rule-based fallback timing for speech without
+// alignment data, at the voice's speed.
+func estimateSpeech(text string, voice VoiceConfig) Alignment {
+	speed := 1.0
+	if voice.Settings.Speed != nil {
+		speed = *voice.Settings.Speed
+	}
+	return estimateAlignment(text, speed)
+}
+
+// TimeAt returns when the character at offset (counted in runes) starts
+// being spoken. Offsets past the end map to the end of the speech.
+func (a Alignment) TimeAt(offset int) float64 {
+	if offset < len(a.StartTimes) {
+		return a.StartTimes[offset]
+	}
+	if n := len(a.EndTimes); n > 0 {
+		return a.EndTimes[n-1]
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"robot-head/shared"
+)
+
+func TestCharVisemes(t *testing.T) {
+	got := charVisemes([]string{"T", "h", "e", " ", "m", "o", "o", "n"})
+	want := []string{
+		shared.VisemeTH, shared.VisemeTH, shared.VisemeE, shared.VisemeRest,
+		shared.VisemeMBP, shared.VisemeU, shared.VisemeU, shared.VisemeL,
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Character %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestAlignmentVisemesMergesRuns(t *testing.T) {
+	alignment := Alignment{
+		Characters: []string{"m", "b", "a", "!"},
+		StartTimes: []float64{0, 0.1, 0.2, 0.3},
+		EndTimes:   []float64{0.1, 0.2, 0.3, 0.4},
+	}
+	cues := alignment.Visemes()
+
+	if len(cues) != 3 {
+		t.Fatalf("Expected 3 cues, got %+v", cues)
+	}
+	if cues[0] != (shared.VisemeCue{Viseme: shared.VisemeMBP, Start: 0, End: 0.2}) {
+		t.Errorf("Expected m and b to merge, got %+v", cues[0])
+	}
+	if cues[1].Viseme != shared.VisemeAI || cues[2].Viseme != shared.VisemeRest {
+		t.Errorf("Unexpected cues %+v", cues)
+	}
+}
+
+func TestAlignmentVisemesMismatchedTimes(t *testing.T) {
+	alignment := Alignment{Characters: []string{"a", "b"}, StartTimes: []float64{0}, EndTimes: []float64{0.1}}
+	if cues := alignment.Visemes(); cues != nil {
+		t.Errorf("Expected no cues for a broken alignment, got %+v", cues)
+	}
+}
+
+func TestEstimateVisemes(t *testing.T) {
+	cues := estimateSpeech("Hello there. Bye", VoiceConfig{}).Visemes()
+	if len(cues) == 0 {
+		t.Fatal("Expected an estimated timeline")
+	}
+	for i := 1; i < len(cues); i++ {
+		if cues[i].Start != cues[i-1].End || cues[i].Viseme == cues[i-1].Viseme {
+			t.Errorf("Cues should be contiguous and merged, got %+v then %+v", cues[i-1], cues[i])
+		}
+	}
+
+	normal := cues[len(cues)-1].End
+	fast := estimateSpeech("Hello there. Bye", VoiceConfig{Settings: VoiceSettings{Speed: floatPtr(1.2)}}).Visemes()
+	if fast[len(fast)-1].End >= normal {
+		t.Errorf("Faster speech should finish sooner: %v vs %v", fast[len(fast)-1].End, normal)
+	}
+}
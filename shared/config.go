@@ -0,0 +1,51 @@
+package shared
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Both binaries resolve their settings the same way, lowest to highest
+// precedence:
+//
+//	built-in defaults < config file (--config) < environment < flags
+//
+// Each binary owns its Config struct; these helpers cover the file side.
+
+// LoadConfigFile decodes a YAML config file over v, leaving fields the file
+// doesn't mention untouched. Unknown keys are rejected so typos surface at
+// startup instead of being silently ignored.
+func LoadConfigFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(v); err != nil && err != io.EOF {
+		return fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// PrintConfig writes v as YAML. Callers are responsible for redacting
+// secrets first.
+func PrintConfig(w io.Writer, v interface{}) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(v)
+}
+
+// Redact hides a secret while still showing whether it was set.
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
@@ -0,0 +1,148 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logging is done with log/slog. Correlation ids such as the session and
+// turn are put in the context with WithLogAttrs, and every record logged
+// with that context carries them:
+//
+//	ctx = shared.WithLogAttrs(ctx, slog.String("session_id", id))
+//	slog.InfoContext(ctx, "Transcribed", "stage", "transcribe", "duration_ms", ms)
+
+type logAttrsKey struct{}
+
+// WithLogAttrs returns a context whose log records carry attrs as well as
+// any attributes ctx already had.
+func WithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	combined := make([]slog.Attr, 0, len(existing)+len(attrs))
+	combined = append(append(combined, existing...), attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, combined)
+}
+
+// contextHandler adds the context's attributes to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// ParseLogLevel reads "debug", "info", "warn" or "error".
+func ParseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("log level must be debug, info, warn or error, got %q", level)
+	}
+	return l, nil
+}
+
+// NewLogHandler writes records at level and above to w, formatted as
+// "text" or "json".
+func NewLogHandler(w io.Writer, level, format string) (slog.Handler, error) {
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case "text":
+		return contextHandler{slog.NewTextHandler(w, opts)}, nil
+	case "json":
+		return contextHandler{slog.NewJSONHandler(w, opts)}, nil
+	default:
+		return nil, fmt.Errorf("log format must be text or json, got %q", format)
+	}
+}
+
+// SetupLogging makes a handler from NewLogHandler the default. Anything
+// still using the standard log package goes through it too.
+func SetupLogging(w io.Writer, level, format string) error {
+	handler, err := NewLogHandler(w, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	log.SetFlags(0)
+	return nil
+}
+
+// Fatal logs a startup failure and exits.
+func Fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// LogValue keeps audio out of the logs: whatever the payload, audio data
+// is replaced by its size.
+func (m Message) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("type", string(m.Type))}
+	switch data := m.Data.(type) {
+	case nil:
+	case map[string]interface{}:
+		// Decoded from JSON, so audio is still base64
+		if audio, ok := data["audio_data"].(string); ok {
+			scrubbed := make(map[string]interface{}, len(data))
+			for k, v := range data {
+				scrubbed[k] = v
+			}
+			delete(scrubbed, "audio_data")
+			scrubbed["audio_bytes"] = len(audio) * 3 / 4
+			data = scrubbed
+		}
+		attrs = append(attrs, slog.Any("data", data))
+	default:
+		attrs = append(attrs, slog.Any("data", data))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (a AudioData) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("text", a.Text),
+		slog.String("mime_type", a.MimeType),
+		slog.Int("audio_bytes", len(a.AudioData)),
+		slog.Int("visemes", len(a.Visemes)),
+	)
+}
+
+func (e ErrorData) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("code", e.Code),
+		slog.String("stage", e.Stage),
+		slog.Bool("retryable", e.Retryable),
+		slog.Int64("retry_after_ms", e.RetryAfterMS),
+		slog.String("message", e.Message),
+		slog.Int("audio_bytes", len(e.AudioData)),
+	)
+}
+
+func (c AudioChunk) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("stream_id", c.StreamID),
+		slog.Int("seq", c.Seq),
+		slog.String("mime_type", c.MimeType),
+		slog.Int("audio_bytes", len(c.AudioData)),
+		slog.Bool("final", c.Final),
+	)
+}
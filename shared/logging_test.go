@@ -0,0 +1,87 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogHandlerAddsContextAttrs(t *testing.T) {
+	var out bytes.Buffer
+	handler, err := NewLogHandler(&out, "debug", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(handler).With("component", "test")
+
+	ctx := WithLogAttrs(context.Background(), slog.String("session_id", "robot-1"))
+	ctx = WithLogAttrs(ctx, slog.String("turn_id", "t1"))
+	logger.DebugContext(ctx, "Transcribed", "duration_ms", 42)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Expected one JSON record, got %q: %v", out.String(), err)
+	}
+	for key, want := range map[string]interface{}{
+		"msg":         "Transcribed",
+		"component":   "test",
+		"session_id":  "robot-1",
+		"turn_id":     "t1",
+		"duration_ms": float64(42),
+	} {
+		if record[key] != want {
+			t.Errorf("Expected %s=%v, got %v", key, want, record[key])
+		}
+	}
+}
+
+func TestLogValueScrubsAudio(t *testing.T) {
+	var out bytes.Buffer
+	handler, _ := NewLogHandler(&out, "info", "text")
+	logger := slog.New(handler)
+
+	// As decoded from the websocket
+	var decoded Message
+	json.Unmarshal([]byte(`{"type":"audio","data":{"audio_data":"c2VjcmV0IGF1ZGlv","mime_type":"audio/pcm"}}`), &decoded)
+	logger.Info("Received message", "msg", decoded)
+	logger.Info("Sending", "msg", Message{Type: MessageTypeAudio, Data: AudioData{Text: "hi", AudioData: []byte("secret audio")}})
+	logger.Info("Sending", "msg", Message{Type: MessageTypeAudioChunk, Data: AudioChunk{StreamID: "s1", AudioData: []byte("secret audio")}})
+
+	logs := out.String()
+	if strings.Contains(logs, "c2VjcmV0IGF1ZGlv") || strings.Contains(logs, "secret audio") {
+		t.Errorf("Expected audio left out of the logs, got:\n%s", logs)
+	}
+	if strings.Count(logs, "audio_bytes=12") != 2 || !strings.Contains(logs, "audio_bytes:12") {
+		t.Errorf("Expected each message to log its audio size, got:\n%s", logs)
+	}
+}
+
+func TestLogValueScrubsSpokenErrors(t *testing.T) {
+	var out bytes.Buffer
+	handler, _ := NewLogHandler(&out, "info", "json")
+	slog.New(handler).Info("Sending", "msg", Message{Type: MessageTypeError, Data: ErrorData{
+		Code: ErrorCodeTimeout, Stage: StageLLM, Retryable: true, Message: "Sorry", AudioData: []byte("secret audio"), MimeType: "audio/mpeg",
+	}})
+
+	logs := out.String()
+	if strings.Contains(logs, "c2VjcmV0IGF1ZGlv") || strings.Contains(logs, "secret audio") {
+		t.Errorf("Expected the spoken error left out of the logs, got:\n%s", logs)
+	}
+	for _, want := range []string{`"code":"timeout"`, `"stage":"llm"`, `"retryable":true`, `"message":"Sorry"`, `"audio_bytes":12`} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Expected %s in:\n%s", want, logs)
+		}
+	}
+}
+
+func TestNewLogHandlerRejectsBadSettings(t *testing.T) {
+	if _, err := NewLogHandler(&bytes.Buffer{}, "loud", "text"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+	if _, err := NewLogHandler(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
@@ -1,15 +1,49 @@
 package shared
 
+import "encoding/json"
+
 // custom type based on string
 type MessageType string
 
 // assigning constants for the values of various MessageType vars
 const (
-	MessageTypeUserInput	MessageType = "user_input"
-	MessageTypeAIResponse	MessageType = "ai_response"
-	MessageTypeStatus		MessageType = "status"
-	MessageTypeError		MessageType = "error"
-	MessageTypeAudio		MessageType = "audio"
+	MessageTypeUserInput  MessageType = "user_input"
+	MessageTypeAIResponse MessageType = "ai_response"
+	MessageTypeStatus     MessageType = "status"
+	MessageTypeError      MessageType = "error"
+	MessageTypeAudio      MessageType = "audio"
+	MessageTypeHello      MessageType = "hello"
+	MessageTypeSession    MessageType = "session"
+	MessageTypePersona    MessageType = "persona"
+	MessageTypeVoice      MessageType = "voice"
+	MessageTypeVoices     MessageType = "voices"
+	MessageTypeAudioChunk MessageType = "audio_chunk"
+	MessageTypeExpression MessageType = "expression"
+	MessageTypeReset      MessageType = "reset"
+	MessageTypeTranscript MessageType = "transcript"
+	MessageTypeRecord     MessageType = "record"
+)
+
+// Capabilities a client can advertise in its hello message. The server
+// replies with the subset it supports.
+const (
+	CapabilityTextInput   = "text_input"
+	CapabilityAudioInput  = "audio_input"
+	CapabilityAudioOutput = "audio_output"
+	CapabilityAudioStream = "audio_stream"
+	CapabilityExpressions = "expressions"
+	CapabilityStates      = "states"
+	CapabilityTranscripts = "transcripts"
+)
+
+// States the robot can be in, reported in status messages so the client
+// can show what's happening between replies.
+const (
+	StateIdle         = "idle"
+	StateListening    = "listening"
+	StateTranscribing = "transcribing"
+	StateThinking     = "thinking"
+	StateSpeaking     = "speaking"
 )
 
 // create a message "Class" (called struct in go)
@@ -17,10 +51,185 @@ type Message struct {
 	Type 	  MessageType  `json:"type"`
 	Timestamp int64        `json:"timestamp"`
 	Data 	  interface{}  `json:"data"`	
+	// TraceParent carries the W3C trace context so both ends' spans for a
+	// turn join one trace. See InjectTrace and ExtractTrace.
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// DecodeData converts the generic Data field into a typed payload. Data is
+// decoded as a map by encoding/json, so we round-trip it through JSON.
+func (m Message) DecodeData(v interface{}) error {
+	raw, err := json.Marshal(m.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
 }
 
 type AudioData struct {
-	Text      string  `json:"text"`
-	AudioData []byte  `json:"audio_data"`
-	MimeType  string  `json:"mime_type"`
+	Text      string      `json:"text"`
+	AudioData []byte      `json:"audio_data"`
+	MimeType  string      `json:"mime_type"`
+	Visemes   []VisemeCue `json:"visemes,omitempty"`
+}
+
+// AudioChunk is one piece of a streamed audio reply. Chunks of a stream
+// share a StreamID and arrive in Seq order; the first carries the text and
+// the last has Final set (and usually no audio).
+type AudioChunk struct {
+	StreamID  string `json:"stream_id"`
+	Seq       int    `json:"seq"`
+	Text      string `json:"text,omitempty"`
+	AudioData []byte `json:"audio_data,omitempty"`
+	MimeType  string `json:"mime_type"`
+	Final     bool   `json:"final,omitempty"`
+	// Visemes covers the whole stream and comes with the first chunk.
+	Visemes []VisemeCue `json:"visemes,omitempty"`
+}
+
+// Mouth shapes used in viseme timelines. They're the classic cartoon set,
+// which is about as much detail as an LED matrix can show.
+const (
+	VisemeRest = "rest" // closed, relaxed
+	VisemeMBP  = "MBP"  // lips pressed: m, b, p
+	VisemeFV   = "FV"   // teeth on lip: f, v
+	VisemeTH   = "TH"   // tongue between teeth
+	VisemeL    = "L"    // tongue up: l, and t/d/n
+	VisemeWQ   = "WQ"   // small round: w, q
+	VisemeU    = "U"    // rounded: oo, u
+	VisemeO    = "O"    // open round: o
+	VisemeAI   = "AI"   // wide open: a, i
+	VisemeE    = "E"    // wide, slightly open: e
+	VisemeEtc  = "etc"  // other consonants: c, g, k, s, r...
+)
+
+// ExpressionData asks the client to change the robot's facial expression.
+// At is when to change it, in seconds from the start of the reply's audio.
+type ExpressionData struct {
+	Name string  `json:"name"`
+	At   float64 `json:"at"`
+}
+
+// VisemeCue holds a mouth shape from Start to End, in seconds from the start
+// of the audio.
+type VisemeCue struct {
+	Viseme string  `json:"viseme"`
+	Start  float64 `json:"start"`
+	End    float64 `json:"end"`
+}
+
+// HelloData is sent by the client as its first message so the server can
+// attach it to an existing session (or start a new one).
+type HelloData struct {
+	SessionID    string   `json:"session_id"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Persona      string   `json:"persona,omitempty"`
+}
+
+// SessionInfo is the server's reply to a hello message.
+type SessionInfo struct {
+	SessionID    string   `json:"session_id"`
+	Resumed      bool     `json:"resumed"`
+	Capabilities []string `json:"capabilities"`
+	Persona      string   `json:"persona"`
+	Personas     []string `json:"personas,omitempty"`
+}
+
+// RecordData opts the session in or out of the server's debug recorder,
+// which keeps each turn's audio, transcript and replies on disk.
+type RecordData struct {
+	Enabled bool `json:"enabled"`
+}
+
+// PersonaData asks the server to switch the session to another persona.
+type PersonaData struct {
+	Name string `json:"name"`
+}
+
+// VoiceData overrides the TTS voice for the session. Empty or nil fields
+// keep the persona's setting.
+type VoiceData struct {
+	VoiceID                  string   `json:"voice_id,omitempty"`
+	ModelID                  string   `json:"model_id,omitempty"`
+	OutputFormat             string   `json:"output_format,omitempty"`
+	OptimizeStreamingLatency int      `json:"optimize_streaming_latency,omitempty"`
+	Stability                *float64 `json:"stability,omitempty"`
+	SimilarityBoost          *float64 `json:"similarity_boost,omitempty"`
+	Style                    *float64 `json:"style,omitempty"`
+	UseSpeakerBoost          *bool    `json:"use_speaker_boost,omitempty"`
+	Speed                    *float64 `json:"speed,omitempty"`
+	// Reset drops any earlier override and goes back to the persona's voice.
+	Reset bool `json:"reset,omitempty"`
+}
+
+// VoiceInfo describes one voice the TTS provider offers.
+type VoiceInfo struct {
+	VoiceID  string            `json:"voice_id"`
+	Name     string            `json:"name"`
+	Category string            `json:"category,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// VoiceList answers a voices request from the client.
+type VoiceList struct {
+	Voices []VoiceInfo `json:"voices"`
 }
+
+// StatusData is the payload of status messages from the server.
+type StatusData struct {
+	Message string `json:"message"`
+	Persona string `json:"persona,omitempty"`
+	// State is set on state updates, which have no message.
+	State string `json:"state,omitempty"`
+}
+
+// ErrorData is the payload of error messages from the server. Code and
+// Stage say what went wrong, for clients that react to particular failures,
+// and Message says it to the user. Retryable is set when sending the same
+// turn again might work, and RetryAfterMS is how long to wait first if the
+// server knows. AudioData is Message spoken, when the client can play
+// audio and the server could synthesize it.
+type ErrorData struct {
+	Code         string `json:"code"`
+	Stage        string `json:"stage"`
+	Retryable    bool   `json:"retryable"`
+	RetryAfterMS int64  `json:"retry_after_ms,omitempty"`
+	Message      string `json:"message"`
+	AudioData    []byte `json:"audio_data,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+}
+
+// Stages an error can come from.
+const (
+	StageSTT = "stt"
+	StageLLM = "llm"
+	StageTTS = "tts"
+	// The server's own turn limits refused the turn
+	StageLimits = "limits"
+	// The message itself was the problem
+	StageProtocol = "protocol"
+)
+
+// Error codes sent in ErrorData.
+const (
+	// The client's message couldn't be used
+	ErrorCodeBadRequest = "bad_request"
+	// Speech couldn't be turned into text
+	ErrorCodeSTTFailed = "stt_failed"
+	// An upstream API refused the server's key
+	ErrorCodeUpstreamAuth = "upstream_auth"
+	// An upstream API account is out of credit
+	ErrorCodeQuotaExceeded = "quota_exceeded"
+	// Too many turns, for the server's limits or an upstream's
+	ErrorCodeRateLimited = "rate_limited"
+	// The turn took too long
+	ErrorCodeTimeout = "timeout"
+	// The LLM wouldn't answer
+	ErrorCodeContentFiltered = "content_filtered"
+	// An upstream API rejected what it was sent
+	ErrorCodeUpstreamRejected = "upstream_rejected"
+	// An upstream API is down or failing
+	ErrorCodeUnavailable = "unavailable"
+	// Anything else
+	ErrorCodeInternal = "internal"
+)
@@ -106,4 +106,37 @@ func TestMessageWithDifferentDataTypes(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	msg := Message{
+		Type:      MessageTypeHello,
+		Timestamp: time.Now().Unix(),
+		Data: HelloData{
+			SessionID:    "abc123",
+			Capabilities: []string{CapabilityAudioInput, CapabilityAudioOutput},
+		},
+	}
+
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+
+	var decoded Message
+	if err := json.Unmarshal(jsonData, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal message: %v", err)
+	}
+
+	var hello HelloData
+	if err := decoded.DecodeData(&hello); err != nil {
+		t.Fatalf("Failed to decode hello data: %v", err)
+	}
+
+	if hello.SessionID != "abc123" {
+		t.Errorf("Expected session id abc123, got %v", hello.SessionID)
+	}
+	if len(hello.Capabilities) != 2 {
+		t.Errorf("Expected 2 capabilities, got %v", hello.Capabilities)
+	}
+}
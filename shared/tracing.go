@@ -0,0 +1,133 @@
+package shared
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig is the OpenTelemetry setup, the same for the server and
+// the client so their spans can end up side by side.
+type TracingConfig struct {
+	// Exporter is "none", "otlp" to send spans to a collector over
+	// OTLP/HTTP, or "file" to write them to File as JSON.
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the collector's URL, e.g. http://localhost:4318.
+	Endpoint string `yaml:"endpoint"`
+	File     string `yaml:"file"`
+	// SampleRatio is the share of traces kept, from 0 to 1. Traces the
+	// other side started are kept if it kept them.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func DefaultTracingConfig() TracingConfig {
+	return TracingConfig{
+		Exporter:    "none",
+		Endpoint:    "http://localhost:4318",
+		SampleRatio: 1,
+	}
+}
+
+// BindFlags registers the --trace-* flags.
+func (c *TracingConfig) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Exporter, "trace-exporter", c.Exporter, "where to send traces: none, otlp or file")
+	fs.StringVar(&c.Endpoint, "trace-endpoint", c.Endpoint, "OTLP/HTTP collector URL")
+	fs.StringVar(&c.File, "trace-file", c.File, "file to write traces to with the file exporter")
+	fs.Float64Var(&c.SampleRatio, "trace-sample-ratio", c.SampleRatio, "share of traces to keep, 0 to 1")
+}
+
+func (c TracingConfig) Validate() error {
+	switch c.Exporter {
+	case "none":
+		return nil
+	case "otlp":
+		if c.Endpoint == "" {
+			return fmt.Errorf("tracing.endpoint is required for the otlp exporter")
+		}
+	case "file":
+		if c.File == "" {
+			return fmt.Errorf("tracing.file is required for the file exporter")
+		}
+	default:
+		return fmt.Errorf("tracing.exporter must be none, otlp or file, got %q", c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("tracing.sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// SetupTracing installs the global tracer provider for service. Until it
+// is called, or when the exporter is "none", spans cost next to nothing
+// and go nowhere. The returned function flushes spans still buffered.
+func SetupTracing(ctx context.Context, service string, c TracingConfig) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exporter sdktrace.SpanExporter
+	switch c.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(c.Endpoint))
+	case "file":
+		var f *os.File
+		f, err = os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	default:
+		err = fmt.Errorf("unknown trace exporter %q", c.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// InjectTrace returns the W3C traceparent of ctx's span, for the other side
+// to continue the trace from, or "" if there is none.
+func InjectTrace(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// ExtractTrace continues the trace a message's traceparent came from.
+func ExtractTrace(ctx context.Context, traceParent string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceParent})
+}
+
+// EndSpan ends span, marking it failed if err isn't nil.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,74 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTraceRoundTrip(t *testing.T) {
+	ctx, span := sdktrace.NewTracerProvider().Tracer("test").Start(context.Background(), "capture")
+	defer span.End()
+
+	traceParent := InjectTrace(ctx)
+	if !strings.Contains(traceParent, span.SpanContext().TraceID().String()) {
+		t.Fatalf("Expected the trace id in %q", traceParent)
+	}
+	remote := ExtractTrace(context.Background(), traceParent)
+	_, child := sdktrace.NewTracerProvider().Tracer("test").Start(remote, "turn")
+	defer child.End()
+	if child.SpanContext().TraceID() != span.SpanContext().TraceID() {
+		t.Error("Expected the extracted trace to be continued")
+	}
+
+	if InjectTrace(context.Background()) != "" {
+		t.Error("Expected no traceparent without a span")
+	}
+	if ExtractTrace(context.Background(), "") != context.Background() {
+		t.Error("Expected an empty traceparent to leave the context alone")
+	}
+}
+
+func TestSetupTracingFileExporter(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	path := filepath.Join(t.TempDir(), "traces.json")
+	c := DefaultTracingConfig()
+	c.Exporter = "file"
+	c.File = path
+
+	shutdown, err := SetupTracing(context.Background(), "test", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "transcribeAudio")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), `"Name":"transcribeAudio"`) {
+		t.Errorf("Expected the span written to the file, got %q (%v)", data, err)
+	}
+}
+
+func TestTracingConfigValidate(t *testing.T) {
+	c := DefaultTracingConfig()
+	if err := c.Validate(); err != nil {
+		t.Errorf("Expected the defaults to be valid: %v", err)
+	}
+	for _, bad := range []TracingConfig{
+		{Exporter: "jaeger"},
+		{Exporter: "file"},
+		{Exporter: "otlp", Endpoint: "http://collector:4318", SampleRatio: 2},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}